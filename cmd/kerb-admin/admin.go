@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/ccache"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kclient"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+var verbose bool
+var help bool
+var cachePath string
+var outputFormat string
+
+var (
+	realm   string
+	asHost  string
+	asPort  int
+	tgsHost string
+	tgsPort int
+)
+
+func parseFlags() {
+	flag.StringVar(&asHost, "ash", "127.0.0.1", "Authentication server host, which serves remote administration")
+	flag.IntVar(&asPort, "asp", 8555, "Authentication server port")
+	flag.StringVar(&tgsHost, "tgsh", "127.0.0.1", "Ticket granting server host")
+	flag.IntVar(&tgsPort, "tgsp", 8655, "Ticket granting server port")
+	flag.StringVar(&realm, "realm", kerb.DefaultRealm, "Realm to administer")
+	flag.StringVar(&cachePath, "cache", ccache.DefaultPath(), "Credential cache file (overrides $"+ccache.EnvVar+")")
+	flag.StringVar(&outputFormat, "o", "table", "Output format: table or json")
+	flag.BoolVar(&verbose, "v", false, "Verbose logging")
+	flag.BoolVar(&help, "help", false, "Display help")
+	flag.Parse()
+}
+
+func main() {
+	parseFlags()
+
+	if help {
+		displayHelp()
+		os.Exit(kadmin.ExitOK)
+	}
+	if outputFormat != "table" && outputFormat != "json" {
+		log.Printf("Unknown output format %q", outputFormat)
+		os.Exit(kadmin.ExitUsage)
+	}
+	if len(flag.Args()) == 0 {
+		log.Println("Missing command!")
+		displayHelp()
+		os.Exit(kadmin.ExitUsage)
+	}
+
+	var command *adminCommand
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			command = &commands[i]
+		}
+	}
+	if command == nil {
+		log.Printf("Unknown command %q", flag.Arg(0))
+		displayHelp()
+		os.Exit(kadmin.ExitUsage)
+	}
+
+	req, err := command.request(command.flags(), flag.Args()[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(kadmin.ExitOK)
+	} else if err != nil {
+		if err != errUsage {
+			log.Print(err)
+		}
+		os.Exit(kadmin.ExitUsage)
+	}
+
+	reply, err := send(req)
+	if err != nil {
+		log.Print("Remote administration: ", kclient.DescribeError(err))
+		os.Exit(exitCode(err))
+	}
+	if reply.Status != kadmin.StatusOK {
+		log.Printf("%s: %s", command.name, reply.Message)
+		os.Exit(reply.Status.ExitCode())
+	}
+	if command.name == "delete" {
+		logVerbose("Deleted " + req.Username)
+		return
+	}
+	if err := printUsers(reply.Users); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// send authenticates to the remote administration service with a ticket for
+// kadmin/admin and returns its reply to req. The ticket is obtained with the
+// cached TGT, so the user must have run kerb-client kinit first.
+func send(req kadmin.Request) (kadmin.Reply, error) {
+	cache, err := ccache.Load(cachePath)
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+	st, err := kadminTicket(cache)
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+
+	encReq, err := encryption.EncryptWith(st.KeyType, st.SessionKey, kadmin.KeyUsageRequest, req)
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+	auth := kerb.Autheticator{Username: st.Client, Timestamp: time.Now()}
+	auth.Checksum, err = encryption.Checksum(st.KeyType, st.SessionKey, kerb.KeyUsageAPReqChecksum, encReq)
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+	encAuth, err := encryption.EncryptWith(st.KeyType, st.SessionKey, kerb.KeyUsageAPReqAuth, auth)
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+
+	body := append(append(append([]byte{}, st.Ticket...), encAuth...), encReq...)
+	httpReq, err := http.NewRequest(http.MethodPost, "http://"+asHost+":"+strconv.Itoa(asPort)+kadmin.Path, bytes.NewReader(body))
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+	httpReq.Header.Set("X-Ticket-Length", strconv.Itoa(len(st.Ticket)))
+	httpReq.Header.Set("X-Auth-Length", strconv.Itoa(len(encAuth)))
+
+	logVerbose("Sending " + string(req.Op) + " request as " + st.Client)
+	c := http.Client{Timeout: time.Duration(30) * time.Second}
+	resp, err := c.Do(httpReq)
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return kadmin.Reply{}, kerb.ReadError(resp)
+	}
+
+	if err := kclient.VerifyServer(resp.Header.Get("X-Ap-Rep"), auth, st.KeyType, st.SessionKey); err != nil {
+		return kadmin.Reply{}, err
+	}
+	encReply, _ := ioutil.ReadAll(resp.Body)
+	var reply kadmin.Reply
+	if err := encryption.DecryptWith(st.KeyType, st.SessionKey, kadmin.KeyUsageReply, encReply, &reply); err != nil {
+		return kadmin.Reply{}, errors.New("failed to decrypt reply")
+	}
+	return reply, nil
+}
+
+// kadminTicket returns a ticket for kadmin/admin, from the cache if it
+// holds one.
+func kadminTicket(cache *ccache.Cache) (ccache.Credential, error) {
+	service := kerb.QualifyPrincipal(kerb.KadminService, realm)
+	if st, ok := cache.Get(service, time.Now()); ok {
+		logVerbose("Using cached service ticket for " + service)
+		return st, nil
+	}
+
+	tgt, ok := cache.TGT(time.Now())
+	if !ok {
+		return ccache.Credential{}, errNoTGT
+	}
+
+	logVerbose("Requesting service ticket for " + service + " from ticket granting server")
+	st, err := kclient.RequestTicket("http://"+tgsHost+":"+strconv.Itoa(tgsPort), tgt, service, encryption.Supported())
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+	if st.Service != service {
+		return ccache.Credential{}, fmt.Errorf("expected a ticket for %s, got one for %s", service, st.Service)
+	}
+
+	cache.Store(st)
+	if err := cache.Save(); err != nil {
+		log.Printf("Unable to save credential cache %s: %v", cache.Path(), err)
+	}
+	return st, nil
+}
+
+var errNoTGT = errors.New("no valid ticket-granting ticket, run kerb-client kinit first")
+
+// exitCode maps an error that kept a request from being answered to the
+// exit code.
+func exitCode(err error) int {
+	if errors.Is(err, errNoTGT) || errors.Is(err, kerb.ErrServiceUnknown) || errors.Is(err, kerb.ErrTicketExpired) {
+		return kadmin.ExitDenied
+	}
+	return kadmin.ExitError
+}
+
+func logVerbose(msg string) {
+	if verbose {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+func displayHelp() {
+	fmt.Println("\nUsage: kerb-admin [-ash HOST] [-asp PORT] [-tgsh HOST] [-tgsp PORT] [-realm REALM] [-cache PATH] [-o table|json] [-v verbose] [-help] COMMAND [flags]")
+	flag.PrintDefaults()
+	fmt.Println("Commands:")
+	for _, c := range commands {
+		fmt.Printf("  %s\n", c.usage())
+	}
+}
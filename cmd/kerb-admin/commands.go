@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/utils"
+)
+
+var errUsage = errors.New("usage")
+
+// adminCommand is a command of kerb-admin. request defines its flags on fs
+// and builds the request to send from the arguments after its name.
+type adminCommand struct {
+	name     string
+	synopsis string
+	request  func(fs *flag.FlagSet, args []string) (kadmin.Request, error)
+}
+
+var commands = []adminCommand{
+	{"add", "[-first NAME] [-last NAME] [-policy NAME] [-no-preauth] [-password-stdin] USERNAME", addRequest},
+	{"list", "", listRequest},
+	{"get", "USERNAME", getRequest},
+	{"modify", "[-first NAME] [-last NAME] [-rename USERNAME] [-policy NAME|none] [-preauth=true|false] USERNAME", modifyRequest},
+	{"delete", "USERNAME", deleteRequest},
+	{"set-password", "[-password-stdin] USERNAME", setPasswordRequest},
+}
+
+func (c *adminCommand) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kerb-admin %s\n", c.usage())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func (c *adminCommand) usage() string {
+	return strings.TrimSpace(c.name + " " + c.synopsis)
+}
+
+// parseCommand parses the flags of a command, which may come before or
+// after its arguments, and returns the arguments. It fails unless there are
+// nargs of them.
+func parseCommand(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	positional := make([]string, 0, nargs)
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, errUsage
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != nargs {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// readPassword reads a new password from the first line of stdin, for
+// scripts, or else prompts for it twice.
+func readPassword(fromStdin bool, username string) (string, error) {
+	if !fromStdin {
+		return utils.NewPassword(fmt.Sprintf("Enter new password for %s: ", username))
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("unable to read password from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func addRequest(fs *flag.FlagSet, args []string) (kadmin.Request, error) {
+	firstName := fs.String("first", "", "First name of the user")
+	lastName := fs.String("last", "", "Last name of the user")
+	policy := fs.String("policy", "", "Password policy of the user (default the default policy, if it exists)")
+	noPreauth := fs.Bool("no-preauth", false, "Do not require the user to pre-authenticate")
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from the first line of stdin")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return kadmin.Request{}, err
+	}
+
+	preauth := !*noPreauth
+	req := kadmin.Request{Op: kadmin.OpAdd, Username: names[0], FirstName: firstName, LastName: lastName, Policy: policy, RequirePreauth: &preauth}
+	req.Password, err = readPassword(*passwordStdin, req.Username)
+	return req, err
+}
+
+func listRequest(fs *flag.FlagSet, args []string) (kadmin.Request, error) {
+	_, err := parseCommand(fs, args, 0)
+	return kadmin.Request{Op: kadmin.OpList}, err
+}
+
+func getRequest(fs *flag.FlagSet, args []string) (kadmin.Request, error) {
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return kadmin.Request{}, err
+	}
+	return kadmin.Request{Op: kadmin.OpGet, Username: names[0]}, nil
+}
+
+func modifyRequest(fs *flag.FlagSet, args []string) (kadmin.Request, error) {
+	firstName := fs.String("first", "", "New first name")
+	lastName := fs.String("last", "", "New last name")
+	rename := fs.String("rename", "", "New username")
+	policy := fs.String("policy", "", "New password policy, none to remove it")
+	preauth := fs.Bool("preauth", true, "Whether the user must pre-authenticate")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return kadmin.Request{}, err
+	}
+
+	// Only the flags given change anything
+	req := kadmin.Request{Op: kadmin.OpModify, Username: names[0]}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "first":
+			req.FirstName = firstName
+		case "last":
+			req.LastName = lastName
+		case "rename":
+			req.Rename = rename
+		case "policy":
+			if *policy == "none" {
+				*policy = ""
+			}
+			req.Policy = policy
+		case "preauth":
+			req.RequirePreauth = preauth
+		}
+	})
+	return req, nil
+}
+
+func deleteRequest(fs *flag.FlagSet, args []string) (kadmin.Request, error) {
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return kadmin.Request{}, err
+	}
+	return kadmin.Request{Op: kadmin.OpDelete, Username: names[0]}, nil
+}
+
+func setPasswordRequest(fs *flag.FlagSet, args []string) (kadmin.Request, error) {
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from the first line of stdin")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return kadmin.Request{}, err
+	}
+
+	req := kadmin.Request{Op: kadmin.OpSetPassword, Username: names[0]}
+	if req.Password, err = readPassword(*passwordStdin, req.Username); err != nil {
+		return req, err
+	}
+	if req.Password == "" {
+		return req, errors.New("the password must not be empty")
+	}
+	return req, nil
+}
+
+// printUsers writes users to stdout as a JSON array or as a table.
+func printUsers(users []kadmin.User) error {
+	if outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tFIRST NAME\tLAST NAME\tPREAUTH\tPOLICY\tKVNO\tETYPES")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%d\t%s\n", u.Username, u.FirstName, u.LastName, u.RequirePreauth, u.Policy, u.Kvno, strings.Join(u.ETypes, ","))
+	}
+	return w.Flush()
+}
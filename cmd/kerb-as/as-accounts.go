@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/utils"
+)
+
+// minAdminPasswordLength applies to administrator passwords on top of the
+// default password policy, if there is one.
+const minAdminPasswordLength = 8
+
+// currentAdmin is the administrator logged in to the menu.
+var currentAdmin authdb.Admin
+
+// adminLogin returns the administrator whose credentials are entered. If
+// there are no administrators yet, the first one is created instead, with
+// full access. An administrator whose password was set by someone else must
+// change it before going on.
+func adminLogin(store authdb.PrincipalStore) authdb.Admin {
+	ctx := context.Background()
+	admins, err := store.ListAdmins(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(admins) == 0 {
+		return bootstrapAdmin(store)
+	}
+
+	fmt.Println("Enter Administrator credentials")
+	username, password, _ := utils.Credentials()
+	admin, err := store.GetAdmin(ctx, username)
+	if err != nil && !errors.Is(err, authdb.ErrAdminNotFound) {
+		log.Fatal(err)
+	}
+	if err != nil || !admin.CheckPassword(password) {
+		log.Printf("Failed administrator login as %s", username)
+		log.Fatal("Invalid administrator credentials")
+	}
+	log.Printf("Administrator %s (%s) logged in", admin.Username, admin.Role)
+
+	if admin.MustChangePassword {
+		fmt.Println("You must choose a new password before going on.")
+		if err := changeAdminPassword(store, &admin); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return admin
+}
+
+// bootstrapAdmin creates the first administrator, with full access.
+func bootstrapAdmin(store authdb.PrincipalStore) authdb.Admin {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Println("No administrator accounts exist yet. Create the first one, which will have full access.")
+	fmt.Print("Enter Username: ")
+	username, _ := reader.ReadString('\n')
+	username = strings.TrimSpace(username)
+	if username == "" {
+		log.Fatal("An administrator needs a username")
+	}
+
+	admin := authdb.Admin{Username: username, Role: authdb.RoleFull}
+	password, err := newAdminPassword(store, admin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	admin.SetPassword(password)
+	if err := store.AddAdmin(context.Background(), admin); err != nil {
+		log.Fatal("Unable to add administrator: ", err)
+	}
+
+	admin, err = store.GetAdmin(context.Background(), username)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Administrator %s created with full access", admin.Username)
+	return admin
+}
+
+// newAdminPassword prompts for a new password for admin until one is
+// entered twice that is long enough, is not the username, and satisfies
+// the default password policy.
+func newAdminPassword(store authdb.PrincipalStore, admin authdb.Admin) (string, error) {
+	var policy *authdb.PasswordPolicy
+	if p, err := store.GetPolicy(context.Background(), authdb.DefaultPolicy); err == nil {
+		policy = &p
+	} else if !errors.Is(err, authdb.ErrPolicyNotFound) {
+		return "", err
+	}
+
+	for {
+		password, err := utils.NewPassword(fmt.Sprintf("Enter new password for %s: ", admin.Username))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		if utf8.RuneCountInString(password) < minAdminPasswordLength {
+			log.Printf("An administrator password must be at least %d characters long", minAdminPasswordLength)
+		} else if strings.EqualFold(password, admin.Username) {
+			log.Print("An administrator password must not be the username")
+		} else if admin.CheckPassword(password) {
+			log.Print("The new password must differ from the old one")
+		} else if policy != nil {
+			if err := policy.Check(password); err != nil {
+				log.Print(err)
+			} else {
+				return password, nil
+			}
+		} else {
+			return password, nil
+		}
+	}
+}
+
+func changeAdminPassword(store authdb.PrincipalStore, admin *authdb.Admin) error {
+	password, err := newAdminPassword(store, *admin)
+	if err != nil {
+		return err
+	}
+	admin.SetPassword(password)
+	admin.MustChangePassword = false
+	if err := store.UpdateAdmin(context.Background(), *admin); err != nil {
+		return fmt.Errorf("unable to change password: %w", err)
+	}
+	log.Printf("Password of administrator %s changed", admin.Username)
+	return nil
+}
+
+func changeOwnPassword(store authdb.PrincipalStore) {
+	if err := changeAdminPassword(store, &currentAdmin); err != nil {
+		log.Print(err)
+	}
+}
+
+// addAdmin creates an administrator with a temporary password, which they
+// must change when they first log in.
+func addAdmin(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Println("Enter username of the new administrator: ")
+	username, _ := reader.ReadString('\n')
+	username = strings.TrimSpace(username)
+	if username == "" {
+		log.Print("An administrator needs a username")
+		return
+	}
+
+	roles := make([]string, len(authdb.Roles))
+	for i, r := range authdb.Roles {
+		roles[i] = string(r)
+	}
+	fmt.Printf("Enter role (%s): ", strings.Join(roles, ", "))
+	input, _ := reader.ReadString('\n')
+	role, err := authdb.ParseAdminRole(strings.TrimSpace(input))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	admin := authdb.Admin{Username: username, Role: role, MustChangePassword: true}
+	password, err := utils.NewPassword("Enter temporary password: ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	admin.SetPassword(password)
+
+	err = store.AddAdmin(context.Background(), admin)
+	if errors.Is(err, authdb.ErrDuplicateAdmin) {
+		log.Printf("Administrator %s already exists", username)
+		return
+	} else if err != nil {
+		log.Print("Unable to add administrator: ", err)
+		return
+	}
+	log.Printf("Added Successfully\nAdministrator: %s\nRole: %s\n", admin.Username, admin.Role)
+}
+
+func listAdmins(store authdb.PrincipalStore) {
+	admins, err := store.ListAdmins(context.Background())
+	if err != nil {
+		log.Print("Unable to list administrators: ", err)
+		return
+	}
+	log.Printf("Found %d results\n", len(admins))
+
+	for _, admin := range admins {
+		log.Printf("{id: %d, username: %s, role: %s, must_change_password: %t}", admin.Id, admin.Username, admin.Role, admin.MustChangePassword)
+	}
+}
+
+// deleteAdmin removes an administrator other than the one logged in, so
+// that an administrator with full access always remains.
+func deleteAdmin(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+	ctx := context.Background()
+
+	fmt.Println("Enter username of the administrator you wish to delete: ")
+	username, _ := reader.ReadString('\n')
+	username = strings.TrimSpace(username)
+
+	admin, err := store.GetAdmin(ctx, username)
+	if errors.Is(err, authdb.ErrAdminNotFound) {
+		log.Println("No administrator found for that username.")
+		return
+	} else if err != nil {
+		log.Print(err)
+		return
+	}
+	if admin.Id == currentAdmin.Id {
+		log.Print("You cannot delete your own account")
+		return
+	}
+
+	fmt.Printf("Deleting administrator: %s\nAre you sure you wish to proceed? y/n: ", admin.Username)
+	confirm, _ := reader.ReadString('\n')
+	confirm = strings.ToLower(strings.TrimSpace(confirm))
+	if confirm != "y" && confirm != "yes" {
+		fmt.Printf("Administrator %s was not deleted.", admin.Username)
+		return
+	}
+	if err := store.DeleteAdmin(ctx, admin.Id); err != nil {
+		log.Print("Unable to delete administrator: ", err)
+		return
+	}
+	log.Printf("Administrator %s deleted successfully", admin.Username)
+}
+
+// resetPassword sets a user's password, which must satisfy their password
+// policy. It is all the helpdesk role may change.
+func resetPassword(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+	ctx := context.Background()
+
+	fmt.Println("Enter username of the user whose password to reset: ")
+	user := getUserByUsername(reader, store)
+
+	password, err := utils.NewPassword(fmt.Sprintf("Enter new password for %s: ", user.Username))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = updatePrincipal(ctx, store, user, password)
+	if errors.Is(err, authdb.ErrPasswordRejected) {
+		log.Print(err)
+		return
+	} else if err != nil {
+		log.Print("Unable to reset password: ", err)
+		return
+	}
+	log.Printf("Password of %s reset successfully", user.Username)
+}
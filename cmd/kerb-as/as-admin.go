@@ -2,39 +2,82 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dixonwille/wmenu"
 	"github.com/khaugen7/kerberos-go/internal/authdb"
 	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/keytab"
 	"github.com/khaugen7/kerberos-go/internal/utils"
 )
 
 var adminMenu, findMenu *wmenu.Menu
 
-func adminMain(db *sql.DB) {
-	fmt.Println("Enter Administrator credentials")
-	username, password, _ := utils.Credentials()
-	if username == "admin" && password == "admin" {
+// menuOption is an entry of the administrator menu, shown to
+// administrators whose role grants perm.
+type menuOption struct {
+	text  string
+	value int
+	perm  authdb.Permission
+	run   func(store authdb.PrincipalStore)
+}
 
-		adminMenu = wmenu.NewMenu("What would you like to do?")
-		adminMenu.Action(func(opts []wmenu.Opt) error { handleFunc(db, opts); return nil })
-		adminMenu.Option("Add a new User", 0, false, nil)
-		adminMenu.Option("Find a user", 1, false, nil)
-		adminMenu.Option("Update user information", 2, false, nil)
-		adminMenu.Option("Delete a user", 3, false, nil)
-		adminMenu.Option("Quit", 4, false, nil)
+var menuOptions = []menuOption{
+	{"Add a new User", 0, authdb.PermModify, addUser},
+	{"Find a user", 1, authdb.PermRead, findUser},
+	{"Update user information", 2, authdb.PermModify, updateUserInfo},
+	{"Delete a user", 3, authdb.PermModify, deleteUser},
+	{"Add a service principal", 4, authdb.PermModify, addService},
+	{"List service principals", 5, authdb.PermRead, listServices},
+	{"Delete a service principal", 6, authdb.PermModify, deleteService},
+	{"Add a cross-realm trust", 7, authdb.PermModify, addTrust},
+	{"Rotate a key", 8, authdb.PermModify, rotateKeyPrompt},
+	{"Export keys to a keytab", 9, authdb.PermModify, exportKeytabPrompt},
+	{"Add a password policy", 10, authdb.PermModify, addPolicy},
+	{"List password policies", 11, authdb.PermRead, listPolicies},
+	{"Reset a user's password", 12, authdb.PermResetPassword, resetPassword},
+	{"Add an administrator", 13, authdb.PermModify, addAdmin},
+	{"List administrators", 14, authdb.PermRead, listAdmins},
+	{"Delete an administrator", 15, authdb.PermModify, deleteAdmin},
+	{"Change my password", 16, authdb.PermRead, changeOwnPassword},
+	{"Import users from a file", 17, authdb.PermModify, importPrompt},
+	{"Export users to a file", 18, authdb.PermRead, exportPrompt},
+}
 
-		runAdminMenu()
+const quitOption = 19
 
-	} else {
-		log.Fatal("Invalid administrator credentials")
+func adminMain(store authdb.PrincipalStore) {
+	currentAdmin = adminLogin(store)
+
+	adminMenu = wmenu.NewMenu("What would you like to do?")
+	adminMenu.Action(func(opts []wmenu.Opt) error { handleFunc(store, opts); return nil })
+	for _, option := range allowedOptions(currentAdmin.Role) {
+		adminMenu.Option(option.text, option.value, false, nil)
+	}
+	adminMenu.Option("Quit", quitOption, false, nil)
+
+	runAdminMenu()
+}
+
+// allowedOptions returns the menu options role grants.
+func allowedOptions(role authdb.AdminRole) []menuOption {
+	allowed := make([]menuOption, 0, len(menuOptions))
+	for _, option := range menuOptions {
+		if role.Allows(option.perm) {
+			allowed = append(allowed, option)
+		}
 	}
+	return allowed
 }
 
 func runAdminMenu() {
@@ -47,32 +90,32 @@ func runAdminMenu() {
 	}
 }
 
-func handleFunc(db *sql.DB, opts []wmenu.Opt) {
-
-	switch opts[0].Value {
-
-	case 0:
-		fmt.Println("\nADDING USER")
-		newUser := gatherUserInfo()
-		authdb.AddUser(newUser, db)
-	case 1:
-		fmt.Println("\nFINDING USERS")
-		findUser(db)
-	case 2:
-		fmt.Println("\nUPDATING USER INFORMATION")
-		updateUserInfo(db)
-	case 3:
-		fmt.Println("\nDELETING USER")
-		deleteUser(db)
-	case 4:
+// handleFunc runs the chosen option, checking the role again so that no
+// option is run that the menu should not have offered. Every choice is
+// logged with the administrator who made it.
+func handleFunc(store authdb.PrincipalStore, opts []wmenu.Opt) {
+	if opts[0].Value == quitOption {
 		fmt.Println("\nQuitting application.")
 		os.Exit(0)
-	default:
-		fmt.Println("\nPlease select an option. '4' to quit.")
 	}
+
+	for _, option := range menuOptions {
+		if option.value != opts[0].Value {
+			continue
+		}
+		if !currentAdmin.Role.Allows(option.perm) {
+			log.Printf("Administrator %s (%s) is not allowed to %s", currentAdmin.Username, currentAdmin.Role, strings.ToLower(option.text))
+			return
+		}
+		log.Printf("Administrator %s: %s", currentAdmin.Username, option.text)
+		fmt.Printf("\n%s\n", strings.ToUpper(option.text))
+		option.run(store)
+		return
+	}
+	fmt.Println("\nPlease select an option.")
 }
 
-func gatherUserInfo() authdb.UserAuth {
+func gatherUserInfo() (authdb.UserAuth, string) {
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Println("Enter first name of user: ")
@@ -91,21 +134,43 @@ func gatherUserInfo() authdb.UserAuth {
 	password, _ := reader.ReadString('\n')
 	password = strings.TrimSpace(password)
 
-	key := encryption.DeriveSecretKey(username, password)
-	stringKey := hex.EncodeToString(key)
+	fmt.Println("Require pre-authentication? Y/n: ")
+	preauth, _ := reader.ReadString('\n')
+	preauth = strings.ToLower(strings.TrimSpace(preauth))
 
-	return authdb.UserAuth{
-		FirstName: firstName,
-		LastName:  lastName,
-		Username:  username,
-		Key:       stringKey,
+	user := authdb.UserAuth{
+		FirstName:      firstName,
+		LastName:       lastName,
+		Username:       username,
+		RequirePreauth: preauth != "n" && preauth != "no",
 	}
+	user.SetPassword(password)
+	return user, password
 }
 
-func findUser(db *sql.DB) {
+func addUser(store authdb.PrincipalStore) {
+	ctx := context.Background()
+	newUser, password := gatherUserInfo()
+
+	// New users follow the default password policy once one is created
+	newUser, err := addPrincipal(ctx, store, newUser, password)
+	if errors.Is(err, authdb.ErrPasswordRejected) {
+		log.Print(err)
+		return
+	} else if errors.Is(err, authdb.ErrDuplicateUsername) {
+		log.Printf("Username %s is already taken", newUser.Username)
+		return
+	} else if err != nil {
+		log.Print("Unable to add user: ", err)
+		return
+	}
+	log.Printf("Added Successfully\nUser: %s %s\nUsername: %s\n", newUser.FirstName, newUser.LastName, newUser.Username)
+}
+
+func findUser(store authdb.PrincipalStore) {
 	findMenu = wmenu.NewMenu("What would you like to do?")
 
-	findMenu.Action(func(opts []wmenu.Opt) error { findFunc(db, opts); return nil })
+	findMenu.Action(func(opts []wmenu.Opt) error { findFunc(store, opts); return nil })
 
 	findMenu.Option("Find user by username", 0, false, nil)
 	findMenu.Option("Find user by first name", 1, false, nil)
@@ -119,34 +184,42 @@ func findUser(db *sql.DB) {
 	}
 }
 
-func findFunc(db *sql.DB, opts []wmenu.Opt) {
+func findFunc(store authdb.PrincipalStore, opts []wmenu.Opt) {
 	reader := bufio.NewReader(os.Stdin)
+	ctx := context.Background()
 	var results []authdb.UserAuth
+	var err error
 	switch opts[0].Value {
 
 	case 0:
 		fmt.Println("Enter username: ")
 		username, _ := reader.ReadString('\n')
 		username = strings.TrimSpace(username)
-		results = authdb.FindUserByUsername(username, db)
+		var user authdb.UserAuth
+		user, err = store.GetUserByUsername(ctx, username)
+		if err == nil {
+			results = []authdb.UserAuth{user}
+		} else if errors.Is(err, authdb.ErrUserNotFound) {
+			results, err = []authdb.UserAuth{}, nil
+		}
 
 	case 1:
 		fmt.Println("Enter first name: ")
 		name, _ := reader.ReadString('\n')
 		name = strings.TrimSpace(name)
-		results = authdb.FindUserByFirstName(name, db)
+		results, err = store.FindUserByFirstName(ctx, name)
 
 	case 2:
 		fmt.Println("Enter last name: ")
 		name, _ := reader.ReadString('\n')
 		name = strings.TrimSpace(name)
-		results = authdb.FindUserByLastName(name, db)
+		results, err = store.FindUserByLastName(ctx, name)
 
 	case 3:
 		fmt.Println("Enter first and last name: ")
 		name, _ := reader.ReadString('\n')
 		name = strings.TrimSpace(name)
-		results = authdb.FindUserByFirstAndLastName(name, db)
+		results, err = store.FindUserByFirstAndLastName(ctx, name)
 
 	case 4:
 		fmt.Println("Quitting application")
@@ -156,6 +229,10 @@ func findFunc(db *sql.DB, opts []wmenu.Opt) {
 		findMenu.Run()
 	}
 
+	if err != nil {
+		log.Print(err)
+		findMenu.Run()
+	}
 	if results == nil {
 		findMenu.Run()
 	}
@@ -163,15 +240,15 @@ func findFunc(db *sql.DB, opts []wmenu.Opt) {
 	log.Printf("Found %d results\n", len(results))
 
 	for _, user := range results {
-		log.Printf("{id: %d, first_name: %s, last_name: %s, username: %s}", user.Id, user.FirstName, user.LastName, user.Username)
+		log.Printf("{id: %d, first_name: %s, last_name: %s, username: %s, requires_preauth: %t, policy: %s}", user.Id, user.FirstName, user.LastName, user.Username, user.RequirePreauth, user.Policy)
 	}
 }
 
-func updateUserInfo(db *sql.DB) {
+func updateUserInfo(store authdb.PrincipalStore) {
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Println("Enter username of user you wish to update: ")
-	currentUser := getUserByUsername(reader, db)
+	currentUser := getUserByUsername(reader, store)
 	updatedUser := currentUser
 
 	fmt.Println("Enter updated information. Leave any field empty to keep it the same.")
@@ -197,41 +274,430 @@ func updateUserInfo(db *sql.DB) {
 		updatedUser.Username = username
 	}
 
+	fmt.Printf("\nCurrent password policy: %s\nNew password policy (\"none\" to remove): ", currentUser.Policy)
+	policy, _ := reader.ReadString('\n')
+	policy = strings.TrimSpace(policy)
+	if policy == "none" {
+		updatedUser.Policy = ""
+	} else if policy != "" {
+		updatedUser.Policy = policy
+	}
+
 	fmt.Println("\nEnter new password (leave empty to keep the same): ")
 	password, _ := reader.ReadString('\n')
 	password = strings.TrimSpace(password)
 
-	if password != "" {
-		key := encryption.DeriveSecretKey(username, password)
-		updatedUser.Key = hex.EncodeToString(key)
+	fmt.Printf("\nCurrently requires pre-authentication: %t\nRequire pre-authentication? y/n: ", currentUser.RequirePreauth)
+	preauth, _ := reader.ReadString('\n')
+	preauth = strings.ToLower(strings.TrimSpace(preauth))
+	if preauth == "y" || preauth == "yes" {
+		updatedUser.RequirePreauth = true
+	} else if preauth == "n" || preauth == "no" {
+		updatedUser.RequirePreauth = false
 	}
 
-	authdb.UpdateUser(currentUser.Id, updatedUser, db)
+	err := updatePrincipal(context.Background(), store, updatedUser, password)
+	if errors.Is(err, authdb.ErrPasswordRejected) {
+		log.Print(err)
+		return
+	} else if errors.Is(err, authdb.ErrDuplicateUsername) {
+		log.Printf("Username %s is already taken", updatedUser.Username)
+		return
+	} else if errors.Is(err, authdb.ErrPolicyNotFound) {
+		log.Printf("Password policy %s does not exist", updatedUser.Policy)
+		return
+	} else if err != nil {
+		log.Print("Unable to update user: ", err)
+		return
+	}
+	log.Printf("User %s updated successfully", updatedUser.Username)
 }
 
-func deleteUser(db *sql.DB) {
+func deleteUser(store authdb.PrincipalStore) {
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Println("Enter username of user you wish to delete: ")
-	user := getUserByUsername(reader, db)
+	user := getUserByUsername(reader, store)
 	fmt.Printf("Deleting user: {id: %d, first_name: %s, last_name: %s, username: %s}\nAre you sure you wish to proceed? y/n: ",
 		user.Id, user.FirstName, user.LastName, user.Username)
 	confirm, _ := reader.ReadString('\n')
 	confirm = strings.ToLower(strings.TrimSpace(confirm))
 	if confirm == "y" || confirm == "yes" {
-		authdb.DeleteUser(user.Id, user.Username, db)
+		if err := store.DeleteUser(context.Background(), user.Id); err != nil {
+			log.Print("Unable to delete user: ", err)
+			return
+		}
+		log.Printf("User %s deleted successfully", user.Username)
 	} else {
 		fmt.Printf("User %s was not deleted.", user.Username)
 	}
 }
 
-func getUserByUsername(reader *bufio.Reader, db *sql.DB) authdb.UserAuth {
+func getUserByUsername(reader *bufio.Reader, store authdb.PrincipalStore) authdb.UserAuth {
 	currentUsername, _ := reader.ReadString('\n')
 	currentUsername = strings.TrimSpace(currentUsername)
-	currentUserSlice := authdb.FindUserByUsername(currentUsername, db)
-	if len(currentUserSlice) == 0 {
+	user, err := store.GetUserByUsername(context.Background(), currentUsername)
+	if errors.Is(err, authdb.ErrUserNotFound) {
 		log.Println("No users found for that username.")
 		os.Exit(0)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return user
+}
+
+func addService(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Println("Enter service principal (e.g. http/api.example.com): ")
+	principal, _ := reader.ReadString('\n')
+	principal = kerb.QualifyPrincipal(strings.TrimSpace(principal), realm)
+
+	service, err := addServicePrincipal(context.Background(), store, principal)
+	if errors.Is(err, authdb.ErrDuplicateService) {
+		log.Printf("Service %s already exists", service.Principal)
+		return
+	} else if err != nil {
+		log.Print("Unable to add service: ", err)
+		return
+	}
+	log.Printf("Added Successfully\nService: %s\n", service.Principal)
+}
+
+func storeService(store authdb.PrincipalStore, service authdb.ServicePrincipal) {
+	err := store.AddService(context.Background(), service)
+	if errors.Is(err, authdb.ErrDuplicateService) {
+		log.Printf("Service %s already exists", service.Principal)
+		return
+	} else if err != nil {
+		log.Print("Unable to add service: ", err)
+		return
+	}
+	log.Printf("Added Successfully\nService: %s\n", service.Principal)
+}
+
+func listServices(store authdb.PrincipalStore) {
+	services, err := store.ListServices(context.Background())
+	if err != nil {
+		log.Print("Unable to list services: ", err)
+		return
+	}
+	log.Printf("Found %d results\n", len(services))
+
+	for _, service := range services {
+		key, _ := service.CurrentKey()
+		log.Printf("{id: %d, principal: %s, kvno: %d, etype: %s}", service.Id, service.Principal, key.Kvno, key.EType)
+	}
+}
+
+func deleteService(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Println("Enter service principal you wish to delete: ")
+	principal, _ := reader.ReadString('\n')
+	principal = kerb.QualifyPrincipal(strings.TrimSpace(principal), realm)
+
+	service, err := store.GetServiceByPrincipal(context.Background(), principal)
+	if errors.Is(err, authdb.ErrServiceNotFound) {
+		log.Println("No service found for that principal.")
+		return
+	} else if err != nil {
+		log.Print(err)
+		return
+	}
+
+	fmt.Printf("Deleting service: %s\nAre you sure you wish to proceed? y/n: ", principal)
+	confirm, _ := reader.ReadString('\n')
+	confirm = strings.ToLower(strings.TrimSpace(confirm))
+	if confirm == "y" || confirm == "yes" {
+		if err := store.DeleteService(context.Background(), service.Id); err != nil {
+			log.Print("Unable to delete service: ", err)
+			return
+		}
+		log.Printf("Service %s deleted successfully", principal)
+	} else {
+		fmt.Printf("Service %s was not deleted.", principal)
+	}
+}
+
+// addPolicy stores a password policy. A policy named "default" is given to
+// every user added after it.
+func addPolicy(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Printf("Enter policy name (%s applies to new users): ", authdb.DefaultPolicy)
+	name, _ := reader.ReadString('\n')
+	name = strings.TrimSpace(name)
+	if name == "" || name == "none" {
+		log.Printf("Invalid policy name %q", name)
+		return
+	}
+
+	policy := authdb.PasswordPolicy{Name: name}
+	for _, field := range []struct {
+		prompt string
+		value  *int
+	}{
+		{"Minimum password length", &policy.MinLength},
+		{"Minimum kinds of character (lower case, upper case, digits, others)", &policy.MinClasses},
+	} {
+		fmt.Printf("%s [0]: ", field.prompt)
+		input, _ := reader.ReadString('\n')
+		if input = strings.TrimSpace(input); input == "" {
+			continue
+		}
+		n, err := strconv.Atoi(input)
+		if err != nil || n < 0 {
+			log.Printf("Invalid number %q", input)
+			return
+		}
+		*field.value = n
+	}
+
+	err := store.AddPolicy(context.Background(), policy)
+	if errors.Is(err, authdb.ErrDuplicatePolicy) {
+		log.Printf("Password policy %s already exists", policy.Name)
+		return
+	} else if err != nil {
+		log.Print("Unable to add password policy: ", err)
+		return
+	}
+	log.Printf("Added Successfully\nPassword policy: %s\n", policy.Name)
+}
+
+func listPolicies(store authdb.PrincipalStore) {
+	policies, err := store.ListPolicies(context.Background())
+	if err != nil {
+		log.Print("Unable to list password policies: ", err)
+		return
+	}
+	log.Printf("Found %d results\n", len(policies))
+
+	for _, policy := range policies {
+		log.Printf("{name: %s, min_length: %d, min_classes: %d}", policy.Name, policy.MinLength, policy.MinClasses)
+	}
+}
+
+// addTrust registers the keys for a two-way trust with another realm:
+// krbtgt/REMOTE@LOCAL for referrals from this realm and krbtgt/LOCAL@REMOTE
+// for referrals into it. The keys are derived from a password so that the
+// remote realm's administrator can create identical keys on their side by
+// entering the same password. The principal name serves as the salt.
+func addTrust(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Println("Enter the realm to trust (e.g. PROD): ")
+	remote, _ := reader.ReadString('\n')
+	remote = strings.TrimSpace(remote)
+	if remote == "" || remote == realm || strings.ContainsAny(remote, "/@") {
+		log.Printf("Invalid realm %q", remote)
+		return
+	}
+
+	password, err := utils.NewPassword("Enter the trust password agreed with the other realm: ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, p := range []kerb.Principal{kerb.TGSPrincipal(remote, realm), kerb.TGSPrincipal(realm, remote)} {
+		principal := p.String()
+		params := encryption.KeyParams{EType: encryption.DefaultEType, Salt: []byte(principal), Iterations: encryption.DefaultIterations}
+		key := hex.EncodeToString(params.StringToKey(password))
+		keys := []authdb.KeyVersion{{Kvno: 1, EType: params.EType, Key: key}}
+		storeService(store, authdb.ServicePrincipal{Principal: principal, Keys: keys})
+	}
+}
+
+func rotateKeyPrompt(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Printf("Enter the principal whose key to rotate (%s for the TGS): ", kerb.TGSPrincipal(realm, realm))
+	principal, _ := reader.ReadString('\n')
+	principal = strings.TrimSpace(principal)
+
+	fmt.Printf("Keep the old key for how long? [%s]: ", kerb.DefaultKeyGracePeriod)
+	input, _ := reader.ReadString('\n')
+	grace := kerb.DefaultKeyGracePeriod
+	if input = strings.TrimSpace(input); input != "" {
+		d, err := time.ParseDuration(input)
+		if err != nil {
+			log.Printf("Invalid duration %q", input)
+			return
+		}
+		grace = d
+	}
+
+	if err := rotateKey(store, principal, grace); err != nil {
+		log.Print(err)
+	}
+}
+
+// rotateKey gives principal a new random key. Its old key still decrypts
+// tickets for grace, which should be at least the longest ticket lifetime
+// so that tickets already issued stay usable. Our own krbtgt principal
+// names the key shared by the AS and TGS. Cross-realm keys are derived
+// from a password agreed with the other realm and cannot be rotated here.
+func rotateKey(store authdb.PrincipalStore, principal string, grace time.Duration) error {
+	p, err := kerb.ParsePrincipal(principal, realm)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var rotated authdb.KeyVersion
+	if p == kerb.TGSPrincipal(realm, realm) {
+		rotated, err = store.RotateSharedKey(ctx, "as-tgs", grace, time.Now())
+	} else if p.IsTGS() {
+		return fmt.Errorf("%s is a cross-realm key, which is derived from the trust password", p)
+	} else {
+		var service authdb.ServicePrincipal
+		service, err = store.GetServiceByPrincipal(ctx, p.String())
+		if errors.Is(err, authdb.ErrServiceNotFound) {
+			return fmt.Errorf("service %s does not exist", p)
+		} else if err != nil {
+			return err
+		}
+		rotated, err = store.RotateServiceKey(ctx, service.Id, encryption.Supported()[0], grace, time.Now())
+	}
+	if err != nil {
+		return fmt.Errorf("unable to rotate key of %s: %w", p, err)
+	}
+
+	log.Printf("Rotated key of %s to kvno %d, the previous key remains valid until %s", p, rotated.Kvno, time.Now().Add(grace).Format(time.RFC1123))
+	return nil
+}
+
+func exportKeytabPrompt(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Printf("Enter the principal whose keys to export (%s for the TGS): ", kerb.TGSPrincipal(realm, realm))
+	principal, _ := reader.ReadString('\n')
+	principal = strings.TrimSpace(principal)
+
+	fmt.Print("Enter the keytab file to write: ")
+	path, _ := reader.ReadString('\n')
+	path = strings.TrimSpace(path)
+
+	if err := exportKeytab(store, principal, path); err != nil {
+		log.Print(err)
+	}
+}
+
+// exportKeytab writes the keys of principal that still decrypt tickets to
+// the keytab at path, replacing any keys of principal it already holds so
+// that one keytab can serve several principals. Our own krbtgt principal
+// exports everything the TGS needs: the key shared with the AS and the keys
+// of every service, including cross-realm ones, that it issues tickets for.
+// Export again after rotating a key.
+func exportKeytab(store authdb.PrincipalStore, principal string, path string) error {
+	if path == "" {
+		return fmt.Errorf("no keytab file given")
+	}
+	p, err := kerb.ParsePrincipal(principal, realm)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var services []authdb.ServicePrincipal
+	if p == kerb.TGSPrincipal(realm, realm) {
+		keys, err := store.FindSharedKeys(ctx, "as-tgs")
+		if err != nil {
+			return err
+		}
+		registered, err := store.ListServices(ctx)
+		if err != nil {
+			return err
+		}
+		services = append(services, authdb.ServicePrincipal{Principal: p.String(), Keys: keys})
+		services = append(services, registered...)
+	} else {
+		service, err := store.GetServiceByPrincipal(ctx, p.String())
+		if errors.Is(err, authdb.ErrServiceNotFound) {
+			return fmt.Errorf("service %s does not exist: %w", p, err)
+		} else if err != nil {
+			return err
+		}
+		services = append(services, service)
 	}
-	return currentUserSlice[0]
+
+	kt, err := keytab.Load(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		kt = &keytab.Keytab{}
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, service := range services {
+		entries := make([]keytab.Entry, 0)
+		for _, k := range service.Keys {
+			if k.Usable(now) {
+				entries = append(entries, k.KeytabEntry(service.Principal))
+			}
+		}
+		kt.Replace(service.Principal, entries)
+		log.Printf("Exported %d keys of %s to %s", len(entries), service.Principal, path)
+	}
+	return kt.Save(path)
+}
+
+// migrateDb upgrades the database schema, or with dryRun lists the steps an
+// upgrade would apply.
+func migrateDb(dryRun bool) error {
+	plan, err := authdb.MigrateDb(context.Background(), sqlitePath, dryRun)
+	if plan.Backup != "" {
+		log.Printf("Backed up the database to %s", plan.Backup)
+	}
+	if err != nil {
+		return err
+	}
+	if len(plan.Steps) == 0 {
+		log.Printf("Database schema is up to date at version %d", plan.Current)
+		return nil
+	}
+
+	if dryRun {
+		log.Printf("Database schema is at version %d, migrating to version %d would apply:", plan.Current, plan.Latest)
+	} else {
+		log.Printf("Migrated database schema from version %d to version %d, applying:", plan.Current, plan.Latest)
+	}
+	for _, m := range plan.Steps {
+		log.Printf("  %d: %s", m.Version, m.Description)
+	}
+	return nil
+}
+
+// reencryptDb re-encrypts every stored key under a new master key derived
+// from a new master password. While it runs the stash file holds both the
+// old and the new key, so that whichever one the database ends up under can
+// be read. The TGS and file server must be restarted to pick up the new key.
+func reencryptDb(store *authdb.SQLiteStore) error {
+	old := store.MasterKey()
+	password, err := utils.NewPassword("Choose the new KDC master password: ")
+	if err != nil {
+		return err
+	}
+	newKey := authdb.DeriveMasterKey(password, realm, old.Kvno+1)
+
+	stashed := utils.FileExists(stashPath)
+	if stashed {
+		if err := authdb.SaveStash(stashPath, realm, old, newKey); err != nil {
+			return err
+		}
+	}
+	n, err := store.ReencryptKeys(context.Background(), newKey)
+	if err != nil {
+		return fmt.Errorf("unable to re-encrypt keys: %w", err)
+	}
+	if stashed {
+		if err := authdb.SaveStash(stashPath, realm, newKey); err != nil {
+			return err
+		}
+		log.Printf("Stashed master key version %d in %s", newKey.Kvno, stashPath)
+	}
+
+	log.Printf("Re-encrypted %d keys under master key version %d", n, newKey.Kvno)
+	return nil
 }
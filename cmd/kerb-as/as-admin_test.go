@@ -2,9 +2,12 @@ package main
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
 )
 
 type credentialsTest struct {
@@ -16,11 +19,11 @@ type credentialsTest struct {
 var stdinInputForUser = "John\nDoe\njdoe42\nmypass123\n"
 
 var expectedUserResult = authdb.UserAuth{
-	Id:        0,
-	FirstName: "John",
-	LastName:  "Doe",
-	Username:  "jdoe42",
-	Key:       "18445eb01497746de56289359f0a252681b79a612ef6223e76b0c581d9bab6a4",
+	Id:             0,
+	FirstName:      "John",
+	LastName:       "Doe",
+	Username:       "jdoe42",
+	RequirePreauth: true,
 }
 
 func TestGatherUserInfo(t *testing.T) {
@@ -31,13 +34,76 @@ func TestGatherUserInfo(t *testing.T) {
 
 	defer cleanup()
 
-	actual := gatherUserInfo()
+	actual, password := gatherUserInfo()
+	if password != "mypass123" {
+		t.Errorf("Expected password mypass123 got %q", password)
+	}
+
+	// The salt is random, so check the keys were derived from it separately
+	if !reflect.DeepEqual(actual.ETypes(), encryption.Supported()) {
+		t.Errorf("Expected keys for %v got %v", encryption.Supported(), actual.ETypes())
+	}
+	for _, etype := range encryption.Supported() {
+		params := actual.KeyParams(etype)
+		if len(params.Salt) != encryption.SaltSize || params.Iterations != encryption.DefaultIterations {
+			t.Errorf("Unexpected key parameters %v", params)
+		}
+		key, _ := actual.Key(etype)
+		if expectedKey := params.StringToKey("mypass123"); !reflect.DeepEqual(key, expectedKey) {
+			t.Errorf("%s key %x not derived from the password, expected %x", etype, key, expectedKey)
+		}
+	}
 
-	if actual != expectedUserResult {
+	actual.Keys, actual.Salt, actual.Iterations = nil, "", 0
+	if !reflect.DeepEqual(actual, expectedUserResult) {
 		t.Errorf("Actual output %v did not match expected output %v", actual, expectedUserResult)
 	}
 }
 
+func TestAllowedOptionsFollowRole(t *testing.T) {
+	tests := []struct {
+		role    authdb.AdminRole
+		allowed []string
+		denied  []string
+	}{
+		{authdb.RoleFull, []string{"Add a new User", "Reset a user's password", "Add an administrator"}, nil},
+		{authdb.RoleReadOnly, []string{"Find a user", "List administrators", "Change my password"}, []string{"Add a new User", "Reset a user's password", "Export keys to a keytab"}},
+		{authdb.RoleHelpdesk, []string{"Find a user", "Reset a user's password"}, []string{"Update user information", "Delete a user", "Add an administrator"}},
+	}
+
+	for _, test := range tests {
+		offered := make(map[string]bool)
+		for _, option := range allowedOptions(test.role) {
+			offered[option.text] = true
+		}
+		for _, text := range test.allowed {
+			if !offered[text] {
+				t.Errorf("Expected %s to be offered %q", test.role, text)
+			}
+		}
+		for _, text := range test.denied {
+			if offered[text] {
+				t.Errorf("Expected %s not to be offered %q", test.role, text)
+			}
+		}
+	}
+}
+
+func TestAdminCheckPassword(t *testing.T) {
+	admin := authdb.Admin{Username: "root"}
+	admin.SetPassword("correct horse")
+
+	if !admin.CheckPassword("correct horse") {
+		t.Error("Expected the password to match")
+	}
+	if admin.CheckPassword("admin") {
+		t.Error("Expected another password not to match")
+	}
+	if strings.Contains(admin.Hash, "correct horse") || admin.Salt == "" {
+		t.Errorf("Expected a salted hash, got %+v", admin)
+	}
+}
+
 func mockStdin(t *testing.T, dummyInput string) (funcDefer func(), err error) {
 	t.Helper()
 
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/utils"
+)
+
+var (
+	errUsage  = errors.New("usage")
+	errDenied = errors.New("permission denied")
+	// errInvalid reports an import file with invalid entries
+	errInvalid = errors.New("invalid entries")
+)
+
+// adminCommand is a subcommand of kerb-as admin. run defines its flags on
+// fs and is given the arguments after the subcommand's name.
+type adminCommand struct {
+	name     string
+	synopsis string
+	perm     authdb.Permission
+	run      func(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error
+}
+
+var adminCommands = []adminCommand{
+	{"add-principal", "[-service] [-first NAME] [-last NAME] [-policy NAME] [-no-preauth] [-password-stdin] PRINCIPAL", authdb.PermModify, cmdAddPrincipal},
+	{"list", "[-service]", authdb.PermRead, cmdList},
+	{"get", "[-service] PRINCIPAL", authdb.PermRead, cmdGet},
+	{"modify", "[-first NAME] [-last NAME] [-rename USERNAME] [-policy NAME|none] [-preauth=true|false] PRINCIPAL", authdb.PermModify, cmdModify},
+	{"delete", "[-service] PRINCIPAL", authdb.PermModify, cmdDelete},
+	{"set-password", "[-password-stdin] PRINCIPAL", authdb.PermResetPassword, cmdSetPassword},
+	{"export", "-keytab PATH PRINCIPAL", authdb.PermModify, cmdExport},
+	{"import", "[-format csv|json|ldif] [-dry-run] FILE", authdb.PermModify, cmdImport},
+	{"export-principals", "[-format csv|json|ldif] [-keys] [-file PATH]", authdb.PermRead, cmdExportPrincipals},
+}
+
+var (
+	adminUser    string
+	outputFormat string
+)
+
+// runAdminCommand runs kerb-as admin with args and returns the exit code.
+// The administrator is named by -u or KERB_ADMIN_USER, and their password
+// is taken from KERB_ADMIN_PASSWORD or prompted for.
+func runAdminCommand(store authdb.PrincipalStore, args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.StringVar(&adminUser, "u", os.Getenv("KERB_ADMIN_USER"), "Administrator to run the command as (default $KERB_ADMIN_USER)")
+	fs.StringVar(&outputFormat, "o", "table", "Output format: table or json")
+	fs.Usage = func() { adminUsage(fs) }
+	if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return kadmin.ExitOK
+	} else if err != nil {
+		return kadmin.ExitUsage
+	}
+	if outputFormat != "table" && outputFormat != "json" {
+		log.Printf("Unknown output format %q", outputFormat)
+		return kadmin.ExitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return kadmin.ExitUsage
+	}
+
+	var command *adminCommand
+	for i := range adminCommands {
+		if adminCommands[i].name == fs.Arg(0) {
+			command = &adminCommands[i]
+		}
+	}
+	if command == nil {
+		log.Printf("Unknown admin command %q", fs.Arg(0))
+		return kadmin.ExitUsage
+	}
+
+	ctx := context.Background()
+	admin, err := authenticateAdmin(ctx, store)
+	if err == nil && !admin.Role.Allows(command.perm) {
+		err = fmt.Errorf("%w: %s (%s) may not %s", errDenied, admin.Username, admin.Role, command.name)
+	}
+	if err != nil {
+		log.Print(err)
+		return exitCode(err)
+	}
+
+	currentAdmin = admin
+	if err := command.run(ctx, store, command.flags(), fs.Args()[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return kadmin.ExitOK
+		}
+		// Bare usage errors have been explained by the usage message
+		if err != errUsage {
+			log.Printf("%s: %v", command.name, err)
+		}
+		return exitCode(err)
+	}
+	log.Printf("Administrator %s: %s", admin.Username, strings.Join(fs.Args(), " "))
+	return kadmin.ExitOK
+}
+
+func adminUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(fs.Output(), "\nUsage: kerb-as [-db PATH] admin [-u USER] [-o table|json] COMMAND [flags]")
+	fs.PrintDefaults()
+	fmt.Fprintln(fs.Output(), "\nCommands:")
+	for _, c := range adminCommands {
+		fmt.Fprintf(fs.Output(), "  %s %s\n", c.name, c.synopsis)
+	}
+}
+
+// authenticateAdmin checks the credentials of the administrator running the
+// command. Administrators who must change their password have to do so in
+// the menu first.
+func authenticateAdmin(ctx context.Context, store authdb.PrincipalStore) (authdb.Admin, error) {
+	if adminUser == "" {
+		return authdb.Admin{}, fmt.Errorf("%w: no administrator given, use -u or KERB_ADMIN_USER", errUsage)
+	}
+	password, ok := os.LookupEnv("KERB_ADMIN_PASSWORD")
+	if !ok {
+		var err error
+		if password, err = utils.Password(fmt.Sprintf("Password for administrator %s: ", adminUser)); err != nil {
+			return authdb.Admin{}, err
+		}
+	}
+
+	admin, err := store.GetAdmin(ctx, adminUser)
+	if err != nil && !errors.Is(err, authdb.ErrAdminNotFound) {
+		return authdb.Admin{}, err
+	}
+	if err != nil || !admin.CheckPassword(password) {
+		log.Printf("Failed administrator login as %s", adminUser)
+		return authdb.Admin{}, fmt.Errorf("%w: invalid administrator credentials", errDenied)
+	}
+	if admin.MustChangePassword {
+		return authdb.Admin{}, fmt.Errorf("%w: %s must change their password with kerb-as -admin first", errDenied, admin.Username)
+	}
+	return admin, nil
+}
+
+// exitCode maps the error a command failed with to its exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return kadmin.ExitOK
+	case errors.Is(err, errUsage):
+		return kadmin.ExitUsage
+	case errors.Is(err, authdb.ErrUserNotFound), errors.Is(err, authdb.ErrServiceNotFound),
+		errors.Is(err, authdb.ErrPolicyNotFound), errors.Is(err, authdb.ErrAdminNotFound):
+		return kadmin.ExitNotFound
+	case errors.Is(err, authdb.ErrDuplicateUsername), errors.Is(err, authdb.ErrDuplicateService),
+		errors.Is(err, authdb.ErrDuplicateAdmin):
+		return kadmin.ExitExists
+	case errors.Is(err, errDenied):
+		return kadmin.ExitDenied
+	case errors.Is(err, authdb.ErrPasswordRejected):
+		return kadmin.ExitRejected
+	case errors.Is(err, errInvalid):
+		return kadmin.ExitInvalid
+	}
+	return kadmin.ExitError
+}
+
+// parseCommand parses the flags of a subcommand, which may come before or
+// after its arguments, and returns the arguments. It fails unless there are
+// nargs of them.
+func parseCommand(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+	positional := make([]string, 0, nargs)
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: %v", errUsage, err)
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != nargs {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+func (c *adminCommand) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kerb-as admin %s %s\n", c.name, c.synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// readPassword reads a new password from the first line of stdin, for
+// scripts, or else prompts for it twice.
+func readPassword(fromStdin bool, username string) (string, error) {
+	if !fromStdin {
+		return utils.NewPassword(fmt.Sprintf("Enter new password for %s: ", username))
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("unable to read password from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func cmdAddPrincipal(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	service := fs.Bool("service", false, "Add a service principal with a random key instead of a user")
+	firstName := fs.String("first", "", "First name of the user")
+	lastName := fs.String("last", "", "Last name of the user")
+	policy := fs.String("policy", "", "Password policy of the user (default the default policy, if it exists)")
+	noPreauth := fs.Bool("no-preauth", false, "Do not require the user to pre-authenticate")
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from the first line of stdin")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if *service {
+		added, err := addServicePrincipal(ctx, store, names[0])
+		if err != nil {
+			return err
+		}
+		return printServices([]authdb.ServicePrincipal{added})
+	}
+
+	user := authdb.UserAuth{FirstName: *firstName, LastName: *lastName, Username: names[0], RequirePreauth: !*noPreauth, Policy: *policy}
+	password, err := readPassword(*passwordStdin, user.Username)
+	if err != nil {
+		return err
+	}
+	user.SetPassword(password)
+	if _, err := addPrincipal(ctx, store, user, password); err != nil {
+		return err
+	}
+
+	added, err := store.GetUserByUsername(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	return printUsers([]authdb.UserAuth{added})
+}
+
+func cmdList(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	service := fs.Bool("service", false, "List service principals instead of users")
+	if _, err := parseCommand(fs, args, 0); err != nil {
+		return err
+	}
+
+	if *service {
+		services, err := store.ListServices(ctx)
+		if err != nil {
+			return err
+		}
+		return printServices(services)
+	}
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	return printUsers(users)
+}
+
+func cmdGet(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	service := fs.Bool("service", false, "Get a service principal instead of a user")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if *service {
+		found, err := store.GetServiceByPrincipal(ctx, kerb.QualifyPrincipal(names[0], realm))
+		if err != nil {
+			return err
+		}
+		return printServices([]authdb.ServicePrincipal{found})
+	}
+	user, err := store.GetUserByUsername(ctx, names[0])
+	if err != nil {
+		return err
+	}
+	return printUsers([]authdb.UserAuth{user})
+}
+
+func cmdModify(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	firstName := fs.String("first", "", "New first name")
+	lastName := fs.String("last", "", "New last name")
+	rename := fs.String("rename", "", "New username")
+	policy := fs.String("policy", "", "New password policy, none to remove it")
+	preauth := fs.Bool("preauth", true, "Whether the user must pre-authenticate")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	user, err := store.GetUserByUsername(ctx, names[0])
+	if err != nil {
+		return err
+	}
+	// Only the flags given change anything
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "first":
+			user.FirstName = *firstName
+		case "last":
+			user.LastName = *lastName
+		case "rename":
+			user.Username = *rename
+		case "policy":
+			user.Policy = *policy
+			if user.Policy == "none" {
+				user.Policy = ""
+			}
+		case "preauth":
+			user.RequirePreauth = *preauth
+		}
+	})
+	if err := updatePrincipal(ctx, store, user, ""); err != nil {
+		return err
+	}
+
+	updated, err := store.GetUserByUsername(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	return printUsers([]authdb.UserAuth{updated})
+}
+
+func cmdDelete(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	service := fs.Bool("service", false, "Delete a service principal instead of a user")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if *service {
+		found, err := store.GetServiceByPrincipal(ctx, kerb.QualifyPrincipal(names[0], realm))
+		if err != nil {
+			return err
+		}
+		return store.DeleteService(ctx, found.Id)
+	}
+	user, err := store.GetUserByUsername(ctx, names[0])
+	if err != nil {
+		return err
+	}
+	return store.DeleteUser(ctx, user.Id)
+}
+
+func cmdSetPassword(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from the first line of stdin")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	user, err := store.GetUserByUsername(ctx, names[0])
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(*passwordStdin, user.Username)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("%w: the password must not be empty", errUsage)
+	}
+	if err := updatePrincipal(ctx, store, user, password); err != nil {
+		return err
+	}
+
+	updated, err := store.GetUserByUsername(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	return printUsers([]authdb.UserAuth{updated})
+}
+
+func cmdExport(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	path := fs.String("keytab", "", "Keytab file to write")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *path == "" {
+		fs.Usage()
+		return errUsage
+	}
+	return exportKeytab(store, names[0], *path)
+}
+
+func cmdImport(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	format := fs.String("format", "", "Format of the file: csv, json or ldif (default from the file extension)")
+	dryRun := fs.Bool("dry-run", false, "Check the file without importing anything")
+	names, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *format, err = formatOf(*format, names[0]); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if names[0] != "-" {
+		if in, err = os.Open(names[0]); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	records, err := readPrincipals(in, *format)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", names[0], err)
+	}
+
+	users, invalid, err := importPrincipals(ctx, store, records, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, err := range invalid {
+		log.Print(err)
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%w: %d of %d entries, nothing was imported", errInvalid, len(invalid), len(records))
+	}
+	if *dryRun {
+		log.Printf("Dry run: all %d entries are valid, nothing was imported", len(records))
+		return nil
+	}
+	log.Printf("Imported %d users", len(users))
+	return printUsers(users)
+}
+
+func cmdExportPrincipals(ctx context.Context, store authdb.PrincipalStore, fs *flag.FlagSet, args []string) error {
+	format := fs.String("format", "", "Format to write: csv, json or ldif (default from the file extension, else json)")
+	withKeys := fs.Bool("keys", false, "Include the users' keys, unencrypted, which needs full access")
+	path := fs.String("file", "", "File to write, readable only by its owner (default stdout)")
+	if _, err := parseCommand(fs, args, 0); err != nil {
+		return err
+	}
+	if *format == "" && *path == "" {
+		*format = "json"
+	}
+	var err error
+	if *format, err = formatOf(*format, *path); err != nil {
+		return err
+	}
+	if *withKeys && !currentAdmin.Role.Allows(authdb.PermModify) {
+		return fmt.Errorf("%w: %s (%s) may not export keys", errDenied, currentAdmin.Username, currentAdmin.Role)
+	}
+
+	out := os.Stdout
+	if *path != "" {
+		if out, err = createPrivate(*path); err != nil {
+			return err
+		}
+	}
+	n, err := exportPrincipals(ctx, store, out, *format, *withKeys)
+	if *path != "" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d users", n)
+	return nil
+}
+
+// serviceView is what the subcommands show of services, and kadmin.User
+// what they show of users. Keys are never shown.
+type serviceView struct {
+	Principal string `json:"principal"`
+	Kvno      int    `json:"kvno"`
+	EType     string `json:"etype"`
+}
+
+func printUsers(users []authdb.UserAuth) error {
+	views := make([]kadmin.User, len(users))
+	for i, u := range users {
+		views[i] = kadminUser(u)
+	}
+	return printOutput(views, []string{"USERNAME", "FIRST NAME", "LAST NAME", "PREAUTH", "POLICY", "KVNO", "ETYPES"}, func(w io.Writer) {
+		for _, v := range views {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%d\t%s\n", v.Username, v.FirstName, v.LastName, v.RequirePreauth, v.Policy, v.Kvno, strings.Join(v.ETypes, ","))
+		}
+	})
+}
+
+func printServices(services []authdb.ServicePrincipal) error {
+	views := make([]serviceView, len(services))
+	for i, s := range services {
+		key, _ := s.CurrentKey()
+		views[i] = serviceView{s.Principal, key.Kvno, key.EType.String()}
+	}
+	return printOutput(views, []string{"PRINCIPAL", "KVNO", "ETYPE"}, func(w io.Writer) {
+		for _, v := range views {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", v.Principal, v.Kvno, v.EType)
+		}
+	})
+}
+
+// printOutput writes v to stdout as JSON, or as a table with header whose
+// rows are written by rows.
+func printOutput(v any, header []string, rows func(w io.Writer)) error {
+	if outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	rows(w)
+	return w.Flush()
+}
+
+func etypeNames(etypes []encryption.EType) []string {
+	names := make([]string, len(etypes))
+	for i, etype := range etypes {
+		names[i] = etype.String()
+	}
+	return names
+}
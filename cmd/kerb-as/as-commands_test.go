@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+)
+
+// addTestAdmin gives the in-memory store an administrator with role and
+// runs the admin subcommands as them.
+func addTestAdmin(t *testing.T, role authdb.AdminRole) {
+	t.Helper()
+
+	admin := authdb.Admin{Username: "ops", Role: role}
+	admin.SetPassword("ops-password")
+	if err := store.AddAdmin(context.Background(), admin); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KERB_ADMIN_USER", "ops")
+	t.Setenv("KERB_ADMIN_PASSWORD", "ops-password")
+}
+
+func TestAdminCommandAddPrincipal(t *testing.T) {
+	useMemoryStore(t)
+	addTestAdmin(t, authdb.RoleFull)
+
+	cleanup, err := mockStdin(t, "Secret99!\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	code := runAdminCommand(store, []string{"-o", "json", "add-principal", "alee", "-first", "Ann", "-no-preauth", "-password-stdin"})
+	if code != kadmin.ExitOK {
+		t.Fatalf("Expected exit code %d got %d", kadmin.ExitOK, code)
+	}
+
+	user, err := store.GetUserByUsername(context.Background(), "alee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := user.Key(user.ETypes()[0])
+	if expected := user.KeyParams(user.ETypes()[0]).StringToKey("Secret99!"); string(key) != string(expected) {
+		t.Error("Key not derived from the password read from stdin")
+	}
+	if user.FirstName != "Ann" || user.RequirePreauth {
+		t.Errorf("Unexpected user %+v", user)
+	}
+}
+
+func TestAdminCommandExitCodes(t *testing.T) {
+	tests := []struct {
+		role authdb.AdminRole
+		args []string
+		code int
+	}{
+		{authdb.RoleReadOnly, []string{"list"}, kadmin.ExitOK},
+		{authdb.RoleReadOnly, []string{"get", "jdoe"}, kadmin.ExitOK},
+		{authdb.RoleReadOnly, []string{"get", "nobody"}, kadmin.ExitNotFound},
+		{authdb.RoleReadOnly, []string{"delete", "jdoe"}, kadmin.ExitDenied},
+		{authdb.RoleHelpdesk, []string{"modify", "-last", "Smith", "jdoe"}, kadmin.ExitDenied},
+		{authdb.RoleFull, []string{"modify", "-policy", "missing", "jdoe"}, kadmin.ExitNotFound},
+		{authdb.RoleFull, []string{"add-principal", "-service", "fs/localhost"}, kadmin.ExitExists},
+		{authdb.RoleFull, []string{"get"}, kadmin.ExitUsage},
+		{authdb.RoleFull, []string{"frobnicate"}, kadmin.ExitUsage},
+	}
+
+	for _, test := range tests {
+		useMemoryStore(t)
+		addTestAdmin(t, test.role)
+		if code := runAdminCommand(store, test.args); code != test.code {
+			t.Errorf("%s %v: expected exit code %d got %d", test.role, test.args, test.code, code)
+		}
+	}
+}
+
+func TestAdminCommandRejectsBadCredentials(t *testing.T) {
+	useMemoryStore(t)
+	addTestAdmin(t, authdb.RoleFull)
+	t.Setenv("KERB_ADMIN_PASSWORD", "wrong")
+
+	if code := runAdminCommand(store, []string{"list"}); code != kadmin.ExitDenied {
+		t.Errorf("Expected exit code %d got %d", kadmin.ExitDenied, code)
+	}
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+)
+
+// importFormats are the file formats users are imported from and exported
+// to.
+var importFormats = []string{"csv", "json", "ldif"}
+
+// principalRecord is a user as import and export files hold them. A user to
+// import is given a password, or keys as exported with their salt,
+// iterations and kvno. Keys are written as ETYPE:HEXKEY.
+type principalRecord struct {
+	Username       string   `json:"username"`
+	FirstName      string   `json:"first_name"`
+	LastName       string   `json:"last_name"`
+	Policy         string   `json:"policy,omitempty"`
+	RequirePreauth *bool    `json:"requires_preauth,omitempty"`
+	Password       string   `json:"password,omitempty"`
+	Kvno           int      `json:"kvno,omitempty"`
+	Salt           string   `json:"salt,omitempty"`
+	Iterations     int      `json:"iterations,omitempty"`
+	Keys           []string `json:"keys,omitempty"`
+
+	// source says where the record is in its file, and err why it could
+	// not be read
+	source string
+	err    error
+}
+
+// csvColumns are the columns of a CSV file, in the order they are exported.
+// The fields of LDIF entries are named after them too.
+var csvColumns = []string{"username", "first_name", "last_name", "policy", "requires_preauth", "password", "kvno", "salt", "iterations", "keys"}
+
+// ldifAttributes maps the LDIF attributes that are imported, in lower case,
+// to the fields they hold. kerbKey may be given once for each key.
+var ldifAttributes = map[string]string{
+	"uid":                 "username",
+	"givenname":           "first_name",
+	"sn":                  "last_name",
+	"userpassword":        "password",
+	"kerbpolicy":          "policy",
+	"kerbrequirespreauth": "requires_preauth",
+	"kerbkvno":            "kvno",
+	"kerbsalt":            "salt",
+	"kerbiterations":      "iterations",
+	"kerbkey":             "keys",
+}
+
+// formatOf returns format, or if it is empty the format named by the
+// extension of path.
+func formatOf(format, path string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	for _, f := range importFormats {
+		if f == format {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown format %q, expected one of %s", errUsage, format, strings.Join(importFormats, ", "))
+}
+
+// importPrompt checks a file of users and, if every entry is valid and the
+// administrator confirms, imports them.
+func importPrompt(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+	ctx := context.Background()
+
+	fmt.Print("Enter the file to import (.csv, .json or .ldif): ")
+	path, _ := reader.ReadString('\n')
+	path = strings.TrimSpace(path)
+	format, err := formatOf("", path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	records, err := readPrincipals(file, format)
+	file.Close()
+	if err != nil {
+		log.Printf("Unable to read %s: %v", path, err)
+		return
+	}
+
+	_, invalid, err := importPrincipals(ctx, store, records, true)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if len(invalid) > 0 {
+		for _, err := range invalid {
+			log.Print(err)
+		}
+		log.Printf("%d of %d entries are invalid, nothing was imported", len(invalid), len(records))
+		return
+	}
+
+	fmt.Printf("Import %d users? y/n: ", len(records))
+	confirm, _ := reader.ReadString('\n')
+	confirm = strings.ToLower(strings.TrimSpace(confirm))
+	if confirm != "y" && confirm != "yes" {
+		fmt.Println("Nothing was imported.")
+		return
+	}
+	users, invalid, err := importPrincipals(ctx, store, records, false)
+	if err != nil {
+		log.Print("Unable to import users: ", err)
+		return
+	}
+	for _, err := range invalid {
+		log.Print(err)
+	}
+	if len(invalid) == 0 {
+		log.Printf("Imported %d users", len(users))
+	}
+}
+
+// exportPrompt writes every user to a file, with their keys if the
+// administrator asks for them and has full access.
+func exportPrompt(store authdb.PrincipalStore) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Print("Enter the file to write (.csv, .json or .ldif): ")
+	path, _ := reader.ReadString('\n')
+	path = strings.TrimSpace(path)
+	format, err := formatOf("", path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	withKeys := false
+	if currentAdmin.Role.Allows(authdb.PermModify) {
+		fmt.Print("Include the users' keys, unencrypted? y/N: ")
+		answer, _ := reader.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		withKeys = answer == "y" || answer == "yes"
+	}
+
+	file, err := createPrivate(path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	n, err := exportPrincipals(context.Background(), store, file, format, withKeys)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Print("Unable to export users: ", err)
+		return
+	}
+	log.Printf("Exported %d users to %s", n, path)
+}
+
+// createPrivate opens path for an export, truncating it. The file is made
+// readable only by its owner even if it already existed with a wider mode,
+// since exports may hold keys.
+func createPrivate(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// readPrincipals reads the users in r. An entry that cannot be read is
+// returned with the reason, so that every bad entry can be reported; a file
+// that cannot be read at all is an error.
+func readPrincipals(r io.Reader, format string) ([]principalRecord, error) {
+	switch format {
+	case "csv":
+		return readCSV(r)
+	case "json":
+		return readJSON(r)
+	case "ldif":
+		return readLDIF(r)
+	}
+	return nil, fmt.Errorf("%w: unknown format %q", errUsage, format)
+}
+
+// readCSV reads a CSV file whose first row names its columns.
+func readCSV(r io.Reader) ([]principalRecord, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+		if !isCSVColumn(header[i]) {
+			return nil, fmt.Errorf("unknown column %q, expected %s", name, strings.Join(csvColumns, ", "))
+		}
+	}
+
+	records := make([]principalRecord, 0)
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		// A row with the wrong number of fields is still read, so only it
+		// is rejected
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, err
+		}
+		record := principalRecord{source: fmt.Sprintf("line %d", line), err: err}
+		if err == nil {
+			fields := make(map[string]string, len(header))
+			for i, name := range header {
+				fields[name] = row[i]
+			}
+			record, err = recordFromFields(fields)
+			record.source, record.err = fmt.Sprintf("line %d", line), err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func isCSVColumn(name string) bool {
+	for _, c := range csvColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readJSON reads a JSON array of records.
+func readJSON(r io.Reader) ([]principalRecord, error) {
+	var entries []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	records := make([]principalRecord, len(entries))
+	for i, entry := range entries {
+		decoder := json.NewDecoder(strings.NewReader(string(entry)))
+		decoder.DisallowUnknownFields()
+		records[i].err = decoder.Decode(&records[i])
+		records[i].source = fmt.Sprintf("entry %d", i+1)
+	}
+	return records, nil
+}
+
+// ldifLine is an attribute of an LDIF entry, unfolded, with the number of
+// the line it starts on.
+type ldifLine struct {
+	number int
+	text   string
+}
+
+// readLDIF reads the entries of an LDIF file, ignoring attributes other
+// than those in ldifAttributes, as directories export many more.
+func readLDIF(r io.Reader) ([]principalRecord, error) {
+	records := make([]principalRecord, 0)
+	entry := make([]ldifLine, 0)
+	inComment := false
+	flush := func() {
+		// The version line is part of the first entry
+		if len(records) == 0 && len(entry) > 0 && strings.HasPrefix(strings.ToLower(entry[0].text), "version:") {
+			entry = entry[1:]
+		}
+		if len(entry) > 0 {
+			records = append(records, ldifRecord(entry))
+		}
+		entry = make([]ldifLine, 0)
+	}
+
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			flush()
+			inComment = false
+		case strings.HasPrefix(line, " "):
+			// A folded line continues the one before it
+			if inComment {
+				continue
+			}
+			if len(entry) == 0 {
+				return nil, fmt.Errorf("line %d: continuation of nothing", number)
+			}
+			entry[len(entry)-1].text += line[1:]
+		case strings.HasPrefix(line, "#"):
+			inComment = true
+		default:
+			inComment = false
+			entry = append(entry, ldifLine{number, line})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return records, nil
+}
+
+func ldifRecord(entry []ldifLine) principalRecord {
+	source := fmt.Sprintf("line %d", entry[0].number)
+	fields := make(map[string]string)
+	for _, line := range entry {
+		attr, value, err := parseLDIFLine(line.text)
+		if err != nil {
+			return principalRecord{source: fmt.Sprintf("line %d", line.number), err: err}
+		}
+		field, ok := ldifAttributes[attr]
+		if !ok {
+			continue
+		}
+		if field == "keys" {
+			fields[field] = strings.TrimSpace(fields[field] + " " + value)
+			continue
+		}
+		if _, ok := fields[field]; ok {
+			return principalRecord{source: source, err: fmt.Errorf("more than one %s", attr)}
+		}
+		fields[field] = value
+	}
+
+	record, err := recordFromFields(fields)
+	record.source, record.err = source, err
+	return record
+}
+
+// parseLDIFLine returns the attribute, in lower case and without options,
+// and the value of an attribute line.
+func parseLDIFLine(text string) (string, string, error) {
+	attr, value, ok := strings.Cut(text, ":")
+	if !ok {
+		return "", "", fmt.Errorf("expected ATTRIBUTE: VALUE, got %q", text)
+	}
+	attr, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(attr)), ";")
+
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("%s: invalid base64 value", attr)
+		}
+		return attr, string(decoded), nil
+	case strings.HasPrefix(value, "<"):
+		return "", "", fmt.Errorf("%s: values read from URLs are not supported", attr)
+	}
+	return attr, strings.TrimLeft(value, " "), nil
+}
+
+// recordFromFields reads a record from the text of its fields, named as in
+// csvColumns. Keys are separated by spaces.
+func recordFromFields(fields map[string]string) (principalRecord, error) {
+	record := principalRecord{
+		Username:  strings.TrimSpace(fields["username"]),
+		FirstName: strings.TrimSpace(fields["first_name"]),
+		LastName:  strings.TrimSpace(fields["last_name"]),
+		Policy:    strings.TrimSpace(fields["policy"]),
+		Password:  fields["password"],
+		Salt:      strings.TrimSpace(fields["salt"]),
+	}
+	if keys := strings.Fields(fields["keys"]); len(keys) > 0 {
+		record.Keys = keys
+	}
+	if value := strings.TrimSpace(fields["requires_preauth"]); value != "" {
+		preauth, err := strconv.ParseBool(value)
+		if err != nil {
+			return record, fmt.Errorf("requires_preauth: %q is not true or false", value)
+		}
+		record.RequirePreauth = &preauth
+	}
+	numbers := []struct {
+		name string
+		n    *int
+	}{{"kvno", &record.Kvno}, {"iterations", &record.Iterations}}
+	for _, number := range numbers {
+		if value := strings.TrimSpace(fields[number.name]); value != "" {
+			var err error
+			if *number.n, err = strconv.Atoi(value); err != nil {
+				return record, fmt.Errorf("%s: %q is not a number", number.name, value)
+			}
+		}
+	}
+	return record, nil
+}
+
+// importPrincipals checks every record and turns it into a user, then adds
+// the users in a single transaction unless dryRun. If any record is invalid
+// nothing is added, and the reasons are returned, one for each invalid
+// record. Keys are only derived from passwords once every record is valid.
+func importPrincipals(ctx context.Context, store authdb.PrincipalStore, records []principalRecord, dryRun bool) ([]authdb.UserAuth, []error, error) {
+	users := make([]authdb.UserAuth, 0, len(records))
+	invalid := make([]error, 0)
+	seen := make(map[string]string)
+	for _, record := range records {
+		user, err := record.user(ctx, store)
+		if err == nil {
+			if other, ok := seen[strings.ToLower(user.Username)]; ok {
+				err = fmt.Errorf("%w: %s is also at %s", authdb.ErrDuplicateUsername, user.Username, other)
+			} else {
+				seen[strings.ToLower(user.Username)] = record.source
+			}
+		}
+		if err != nil {
+			invalid = append(invalid, record.fail(err))
+			continue
+		}
+		users = append(users, user)
+	}
+	if len(invalid) > 0 || dryRun {
+		return users, invalid, nil
+	}
+
+	// Every record is valid, so users line up with records
+	for i, record := range records {
+		if record.Password != "" {
+			users[i].SetPassword(record.Password)
+		}
+	}
+	err := store.AddUsers(ctx, users)
+	var batchErr *authdb.BatchError
+	if errors.As(err, &batchErr) {
+		return nil, []error{records[batchErr.Index].fail(batchErr.Err)}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return users, nil, nil
+}
+
+// fail says which record err is about.
+func (r principalRecord) fail(err error) error {
+	if r.Username == "" {
+		return fmt.Errorf("%s: %w", r.source, err)
+	}
+	return fmt.Errorf("%s (%s): %w", r.source, r.Username, err)
+}
+
+// user checks the record and returns the user it describes, with its keys
+// if it has them rather than a password.
+func (r principalRecord) user(ctx context.Context, store authdb.PrincipalStore) (authdb.UserAuth, error) {
+	if r.err != nil {
+		return authdb.UserAuth{}, r.err
+	}
+	if r.Username == "" {
+		return authdb.UserAuth{}, errors.New("no username")
+	}
+	if strings.ContainsAny(r.Username, " \t@/") {
+		return authdb.UserAuth{}, errors.New("a username must not contain spaces, @ or /")
+	}
+
+	user := authdb.UserAuth{
+		FirstName:      r.FirstName,
+		LastName:       r.LastName,
+		Username:       r.Username,
+		RequirePreauth: r.RequirePreauth == nil || *r.RequirePreauth,
+		Policy:         r.Policy,
+	}
+	if user.Policy == "" {
+		policy, err := defaultPolicy(ctx, store)
+		if err != nil {
+			return user, err
+		}
+		user.Policy = policy
+	} else if _, err := store.GetPolicy(ctx, user.Policy); err != nil {
+		return user, fmt.Errorf("%w: %s", err, user.Policy)
+	}
+	if _, err := store.GetUserByUsername(ctx, user.Username); err == nil {
+		return user, authdb.ErrDuplicateUsername
+	} else if !errors.Is(err, authdb.ErrUserNotFound) {
+		return user, err
+	}
+
+	switch {
+	case r.Password != "" && len(r.Keys) > 0:
+		return user, errors.New("give either a password or keys, not both")
+	case r.Password != "":
+		if err := authdb.CheckPassword(ctx, store, user, r.Password); err != nil {
+			return user, err
+		}
+	case len(r.Keys) > 0:
+		keys, err := r.userKeys()
+		if err != nil {
+			return user, err
+		}
+		user.Keys, user.Salt, user.Iterations = keys, r.Salt, r.Iterations
+	default:
+		return user, errors.New("no password or keys")
+	}
+	return user, nil
+}
+
+// userKeys checks the record's keys and the parameters they were derived
+// with.
+func (r principalRecord) userKeys() ([]authdb.UserKey, error) {
+	if _, err := hex.DecodeString(r.Salt); err != nil || r.Salt == "" {
+		return nil, errors.New("keys need the hex salt they were derived with")
+	}
+	if r.Iterations < 0 || r.Kvno < 0 {
+		return nil, errors.New("iterations and kvno must not be negative")
+	}
+	kvno := r.Kvno
+	if kvno == 0 {
+		kvno = 1
+	}
+
+	keys := make([]authdb.UserKey, 0, len(r.Keys))
+	for _, k := range r.Keys {
+		name, value, _ := strings.Cut(k, ":")
+		etypes, err := encryption.ParseETypes(name)
+		if err != nil || len(etypes) != 1 {
+			return nil, fmt.Errorf("key %q: expected ETYPE:HEXKEY", k)
+		}
+		enctype, _ := encryption.Lookup(etypes[0])
+		key, err := hex.DecodeString(value)
+		if err != nil || len(key) != enctype.KeySize() {
+			return nil, fmt.Errorf("key %q: expected %d hex bytes", k, enctype.KeySize())
+		}
+		for _, other := range keys {
+			if other.EType == etypes[0] {
+				return nil, fmt.Errorf("more than one %s key", etypes[0])
+			}
+		}
+		keys = append(keys, authdb.UserKey{Kvno: kvno, EType: etypes[0], Key: hex.EncodeToString(key)})
+	}
+	return keys, nil
+}
+
+// exportPrincipals writes every user to w in format and returns how many
+// there are. Their keys, which are written unencrypted, are only included
+// if withKeys.
+func exportPrincipals(ctx context.Context, store authdb.PrincipalStore, w io.Writer, format string, withKeys bool) (int, error) {
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	records := make([]principalRecord, len(users))
+	for i, u := range users {
+		records[i] = exportRecord(u, withKeys)
+	}
+
+	switch format {
+	case "csv":
+		err = writeCSV(w, records, withKeys)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(records)
+	case "ldif":
+		err = writeLDIF(w, records)
+	default:
+		err = fmt.Errorf("%w: unknown format %q", errUsage, format)
+	}
+	return len(records), err
+}
+
+func exportRecord(u authdb.UserAuth, withKeys bool) principalRecord {
+	preauth := u.RequirePreauth
+	record := principalRecord{Username: u.Username, FirstName: u.FirstName, LastName: u.LastName, Policy: u.Policy, RequirePreauth: &preauth}
+	if withKeys {
+		record.Kvno, record.Salt, record.Iterations = u.Kvno(), u.Salt, u.Iterations
+		for _, k := range u.Keys {
+			record.Keys = append(record.Keys, k.EType.String()+":"+k.Key)
+		}
+	}
+	return record
+}
+
+func writeCSV(w io.Writer, records []principalRecord, withKeys bool) error {
+	writer := csv.NewWriter(w)
+	header := []string{"username", "first_name", "last_name", "policy", "requires_preauth"}
+	if withKeys {
+		header = append(header, "kvno", "salt", "iterations", "keys")
+	}
+	writer.Write(header)
+	for _, r := range records {
+		row := []string{r.Username, r.FirstName, r.LastName, r.Policy, strconv.FormatBool(*r.RequirePreauth)}
+		if withKeys {
+			row = append(row, strconv.Itoa(r.Kvno), r.Salt, strconv.Itoa(r.Iterations), strings.Join(r.Keys, " "))
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeLDIF(w io.Writer, records []principalRecord) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "version: 1")
+	for _, r := range records {
+		fmt.Fprintln(bw)
+		writeLDIFAttr(bw, "dn", "uid="+r.Username+",ou=people")
+		writeLDIFAttr(bw, "objectClass", "inetOrgPerson")
+		writeLDIFAttr(bw, "uid", r.Username)
+		writeLDIFAttr(bw, "cn", strings.TrimSpace(r.FirstName+" "+r.LastName))
+		writeLDIFAttr(bw, "givenName", r.FirstName)
+		writeLDIFAttr(bw, "sn", r.LastName)
+		writeLDIFAttr(bw, "kerbPolicy", r.Policy)
+		writeLDIFAttr(bw, "kerbRequiresPreauth", strings.ToUpper(strconv.FormatBool(*r.RequirePreauth)))
+		if len(r.Keys) > 0 {
+			writeLDIFAttr(bw, "kerbKvno", strconv.Itoa(r.Kvno))
+			writeLDIFAttr(bw, "kerbSalt", r.Salt)
+			writeLDIFAttr(bw, "kerbIterations", strconv.Itoa(r.Iterations))
+			for _, k := range r.Keys {
+				writeLDIFAttr(bw, "kerbKey", k)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// writeLDIFAttr writes a non-empty value, base64 encoded unless it is safe
+// to write as it is.
+func writeLDIFAttr(w io.Writer, attr, value string) {
+	if value == "" {
+		return
+	}
+	if ldifSafe(value) {
+		fmt.Fprintf(w, "%s: %s\n", attr, value)
+	} else {
+		fmt.Fprintf(w, "%s:: %s\n", attr, base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+}
+
+// ldifSafe reports whether value is a SAFE-STRING of RFC 2849.
+func ldifSafe(value string) bool {
+	if strings.HasPrefix(value, " ") || strings.HasPrefix(value, ":") || strings.HasPrefix(value, "<") || strings.HasSuffix(value, " ") {
+		return false
+	}
+	for _, c := range value {
+		if c == 0 || c == '\n' || c == '\r' || c > 127 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+)
+
+func TestReadPrincipalsFormats(t *testing.T) {
+	preauth := false
+	expected := principalRecord{Username: "alee", FirstName: "Ann", LastName: "Lee", RequirePreauth: &preauth, Password: " Secret99!"}
+
+	files := map[string]string{
+		"csv":  "username,first_name,last_name,requires_preauth,password\nalee,Ann,Lee,false, Secret99!\n",
+		"json": `[{"username": "alee", "first_name": "Ann", "last_name": "Lee", "requires_preauth": false, "password": " Secret99!"}]`,
+		"ldif": "version: 1\n# a comment\n\ndn: uid=alee,ou=people\nobjectClass: inetOrgPerson\nuid: alee\ngivenName: A\n nn\nsn: Lee\nkerbRequiresPreauth: FALSE\nuserPassword:: IFNlY3JldDk5IQ==\n",
+	}
+	for format, file := range files {
+		records, err := readPrincipals(strings.NewReader(file), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("%s: expected 1 record got %d", format, len(records))
+		}
+		record := records[0]
+		if record.err != nil {
+			t.Errorf("%s: %v", format, record.err)
+		}
+		record.source = ""
+		if !reflect.DeepEqual(record, expected) {
+			t.Errorf("%s: expected %+v got %+v", format, expected, record)
+		}
+	}
+}
+
+func TestImportReportsEveryInvalidEntry(t *testing.T) {
+	useMemoryStore(t)
+	ctx := context.Background()
+
+	file := "username,first_name,last_name,requires_preauth,password\n" +
+		"alee,Ann,Lee,,Secret99!\n" +
+		"jdoe,John,Doe,,Secret99!\n" +
+		"bsmith,Bob,Smith,,\n" +
+		"cjones,Cat,Jones,maybe,Secret99!\n" +
+		"ALEE,Ann,Lee,,Secret99!\n" +
+		"dkim,Dan\n"
+	records, err := readPrincipals(strings.NewReader(file), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, invalid, err := importPrincipals(ctx, store, records, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invalid) != 5 {
+		t.Fatalf("Expected 5 invalid entries got %d: %v", len(invalid), invalid)
+	}
+	if !strings.HasPrefix(invalid[0].Error(), "line 3 (jdoe)") || !errors.Is(invalid[0], authdb.ErrDuplicateUsername) {
+		t.Errorf("Unexpected error %v", invalid[0])
+	}
+	if !errors.Is(invalid[3], authdb.ErrDuplicateUsername) {
+		t.Errorf("Expected a duplicate in the file to be rejected, got %v", invalid[3])
+	}
+
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Errorf("Expected nothing to be imported, found %d users", len(users))
+	}
+}
+
+func TestExportImportKeys(t *testing.T) {
+	useMemoryStore(t)
+	ctx := context.Background()
+	jdoe, err := store.GetUserByUsername(ctx, "jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range importFormats {
+		var file bytes.Buffer
+		if _, err := exportPrincipals(ctx, store, &file, format, true); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		records, err := readPrincipals(&file, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		target, err := authdb.NewMemoryStore(realm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, invalid, err := importPrincipals(ctx, target, records, false); err != nil || len(invalid) > 0 {
+			t.Fatalf("%s: %v %v", format, err, invalid)
+		}
+		imported, err := target.GetUserByUsername(ctx, "jdoe")
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		imported.Id = jdoe.Id
+		if !reflect.DeepEqual(imported, jdoe) {
+			t.Errorf("%s: expected %+v got %+v", format, jdoe, imported)
+		}
+	}
+}
+
+func TestExportLeavesOutKeys(t *testing.T) {
+	useMemoryStore(t)
+
+	for _, format := range importFormats {
+		var file bytes.Buffer
+		if _, err := exportPrincipals(context.Background(), store, &file, format, false); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if out := strings.ToLower(file.String()); !strings.Contains(out, "jdoe") || strings.Contains(out, "key") || strings.Contains(out, "salt") {
+			t.Errorf("%s: unexpected export %q", format, file.String())
+		}
+	}
+}
+
+func TestExportOverExistingFileIsPrivate(t *testing.T) {
+	useMemoryStore(t)
+	addTestAdmin(t, authdb.RoleFull)
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte("old contents that are longer than nothing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := runAdminCommand(store, []string{"export-principals", "-keys", "-file", path}); code != kadmin.ExitOK {
+		t.Fatalf("Expected exit code %d got %d", kadmin.ExitOK, code)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected mode 0600 got %o", mode)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "old contents") || !strings.Contains(string(data), "jdoe") {
+		t.Errorf("Unexpected export %q", data)
+	}
+}
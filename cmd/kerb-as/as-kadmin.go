@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/replay"
+)
+
+var (
+	acl    kadminACL
+	rcache *replay.Cache
+)
+
+// kadminPerms are the permissions each remote operation needs, as the
+// same operations do in the menu.
+var kadminPerms = map[kadmin.Op]authdb.Permission{
+	kadmin.OpAdd:         authdb.PermModify,
+	kadmin.OpModify:      authdb.PermModify,
+	kadmin.OpDelete:      authdb.PermModify,
+	kadmin.OpList:        authdb.PermRead,
+	kadmin.OpGet:         authdb.PermRead,
+	kadmin.OpSetPassword: authdb.PermResetPassword,
+}
+
+// aclEntry gives the principals matching pattern the permissions of role.
+type aclEntry struct {
+	pattern string
+	role    authdb.AdminRole
+}
+
+// kadminACL decides who may use the remote administration service. It is
+// read from a file with a PRINCIPAL ROLE entry on each line, where
+// PRINCIPAL may use the wildcards of path.Match, so that */admin matches
+// every admin instance. The first entry that matches a principal applies.
+type kadminACL []aclEntry
+
+// loadACL reads the ACL at path. Principals without a realm belong to ours.
+// A missing file is an empty ACL, which lets nobody in.
+func loadACL(path string) (kadminACL, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseACL(file)
+}
+
+func parseACL(r io.Reader) (kadminACL, error) {
+	acl := make(kadminACL, 0)
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("acl line %d: expected PRINCIPAL ROLE", number)
+		}
+		pattern := strings.ToLower(kerb.QualifyPrincipal(fields[0], realm))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("acl line %d: %w", number, err)
+		}
+		role, err := authdb.ParseAdminRole(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("acl line %d: %w", number, err)
+		}
+		acl = append(acl, aclEntry{pattern, role})
+	}
+	return acl, scanner.Err()
+}
+
+// role returns the role of principal, ignoring case, if any entry matches.
+func (a kadminACL) role(principal string) (authdb.AdminRole, bool) {
+	for _, entry := range a {
+		if ok, _ := path.Match(entry.pattern, strings.ToLower(principal)); ok {
+			return entry.role, true
+		}
+	}
+	return "", false
+}
+
+// handleKadmin serves a remote administration request, see the kadmin
+// package for the protocol.
+func handleKadmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, kerb.ErrBadRequest)
+		return
+	}
+	var req kadmin.Request
+	ticket, auth, err := openAPRequest(r, kerb.KadminService, kadmin.KeyUsageRequest, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	reply := runKadmin(r.Context(), ticket.Username, req)
+	writeReply(w, ticket, auth, kadmin.KeyUsageReply, reply)
+}
+
+// openAPRequest checks the ticket and authenticator of a request to the
+// service name and decrypts the request they carry into v. The body holds
+// the ticket, the authenticator and the encrypted request, in that order.
+func openAPRequest(r *http.Request, name string, usage uint32, v any) (kerb.Ticket, kerb.Autheticator, error) {
+	var ticket kerb.Ticket
+	var auth kerb.Autheticator
+
+	tickLen, _ := strconv.Atoi(r.Header.Get("X-Ticket-Length"))
+	if tickLen == 0 {
+		return ticket, auth, kerb.MissingField("X-Ticket-Length")
+	}
+	authLen, _ := strconv.Atoi(r.Header.Get("X-Auth-Length"))
+	if authLen == 0 {
+		return ticket, auth, kerb.MissingField("X-Auth-Length")
+	}
+	content, _ := io.ReadAll(r.Body)
+	if tickLen < 0 || authLen < 0 || tickLen+authLen > len(content) {
+		return ticket, auth, kerb.ErrBadRequest
+	}
+	encTicket, encAuth, encReq := content[:tickLen], content[tickLen:tickLen+authLen], content[tickLen+authLen:]
+
+	sealed, err := kerb.OpenSealedTicket(encTicket)
+	if err != nil {
+		return ticket, auth, kerb.ErrBadRequest
+	}
+	principal := kerb.QualifyPrincipal(name, realm)
+	if sealed.Service != principal {
+		log.Printf("Received ticket for %s instead of %s", sealed.Service, principal)
+		return ticket, auth, kerb.ErrServiceUnknown
+	}
+
+	// Keys are looked up for every request so that a rotated key is picked
+	// up without a restart
+	service, err := store.GetServiceByPrincipal(r.Context(), principal)
+	if err != nil {
+		log.Printf("Unable to look up the key of %s: %v", principal, err)
+		return ticket, auth, kerb.ErrUnavailable
+	}
+	key, ok := service.KeyByVersion(sealed.Kvno, clock.Now())
+	if !ok {
+		log.Printf("Received ticket sealed with unknown or expired key version %d", sealed.Kvno)
+		return ticket, auth, kerb.ErrBadKeyVersion
+	}
+	if ticket, err = sealed.Decrypt(key.ServiceKey().Key); err != nil {
+		log.Printf("Failed to decrypt ticket for %s", principal)
+		return ticket, auth, kerb.ErrBadIntegrity
+	}
+
+	if err := encryption.DecryptWith(ticket.SessionKeyType, ticket.SessionKey, kerb.KeyUsageAPReqAuth, encAuth, &auth); err != nil {
+		log.Printf("Failed to decrypt %s authenticator for user %s", name, ticket.Username)
+		return ticket, auth, kerb.ErrBadIntegrity
+	}
+	if err := validator.Validate(auth, ticket); err != nil {
+		log.Printf("Rejected %s authenticator for user %s: %v", name, ticket.Username, err)
+		return ticket, auth, err
+	}
+	if err := encryption.VerifyChecksum(ticket.SessionKeyType, ticket.SessionKey, kerb.KeyUsageAPReqChecksum, encReq, auth.Checksum); err != nil {
+		log.Printf("%s request checksum mismatch for user %s", name, ticket.Username)
+		return ticket, auth, kerb.ErrBadChecksum
+	}
+
+	// Authenticators outside the skew window are rejected above, so the
+	// replay cache only needs to remember them for that long
+	err = rcache.Check(auth.Username, auth.Timestamp, encAuth, auth.Timestamp.Add(validator.Skew))
+	if errors.Is(err, replay.ErrReplay) {
+		log.Printf("Rejected replayed %s authenticator for user %s", name, auth.Username)
+		return ticket, auth, kerb.ErrReplay
+	} else if err != nil {
+		log.Print("Replay cache error:", err)
+		return ticket, auth, kerb.ErrUnavailable
+	}
+
+	if err := encryption.DecryptWith(ticket.SessionKeyType, ticket.SessionKey, usage, encReq, v); err != nil {
+		return ticket, auth, kerb.ErrBadIntegrity
+	}
+	return ticket, auth, nil
+}
+
+// writeReply sends reply encrypted under the ticket's session key with
+// usage, along with an AP-REP for auth.
+func writeReply(w http.ResponseWriter, ticket kerb.Ticket, auth kerb.Autheticator, usage uint32, reply kadmin.Reply) {
+	encReply, err := encryption.EncryptWith(ticket.SessionKeyType, ticket.SessionKey, usage, reply)
+	if err != nil {
+		writeError(w, kerb.ErrUnavailable)
+		return
+	}
+	apRep, err := encryption.EncryptWith(ticket.SessionKeyType, ticket.SessionKey, kerb.KeyUsageAPRepPart, kerb.NewAPRep(auth))
+	if err != nil {
+		writeError(w, kerb.ErrUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Ap-Rep", hex.EncodeToString(apRep))
+	w.Write(encReply)
+}
+
+// runKadmin carries out req for client if the ACL allows it.
+func runKadmin(ctx context.Context, client string, req kadmin.Request) kadmin.Reply {
+	perm, ok := kadminPerms[req.Op]
+	if !ok {
+		return kadmin.Reply{Status: kadmin.StatusInvalid, Message: fmt.Sprintf("unknown operation %q", req.Op)}
+	}
+	role, ok := acl.role(client)
+	if !ok || !role.Allows(perm) {
+		log.Printf("Denied remote administrator %s: %s %s", client, req.Op, req.Username)
+		return kadmin.Reply{Status: kadmin.StatusDenied, Message: fmt.Sprintf("%s may not %s", client, req.Op)}
+	}
+	// Changing a principal the ACL names would let the client act as it, so
+	// only a role with at least the same rights may
+	if req.Op == kadmin.OpSetPassword || req.Op == kadmin.OpModify || req.Op == kadmin.OpDelete {
+		target, listed := acl.role(kerb.QualifyPrincipal(req.Username, realm))
+		if listed && !role.Covers(target) {
+			log.Printf("Denied remote administrator %s: %s %s, who is %s", client, req.Op, req.Username, target)
+			return kadmin.Reply{Status: kadmin.StatusDenied, Message: fmt.Sprintf("%s may not %s %s, who is %s", client, req.Op, req.Username, target)}
+		}
+	}
+
+	users, err := applyKadmin(ctx, req)
+	if err != nil {
+		return kadmin.Reply{Status: kadminStatus(err), Message: err.Error()}
+	}
+	if req.Op != kadmin.OpList && req.Op != kadmin.OpGet {
+		log.Printf("Remote administrator %s (%s): %s %s", client, role, req.Op, req.Username)
+	}
+
+	reply := kadmin.Reply{Status: kadmin.StatusOK, Users: make([]kadmin.User, len(users))}
+	for i, u := range users {
+		reply.Users[i] = kadminUser(u)
+	}
+	return reply
+}
+
+// applyKadmin carries out req and returns the users it lists or changes.
+func applyKadmin(ctx context.Context, req kadmin.Request) ([]authdb.UserAuth, error) {
+	if req.Op == kadmin.OpList {
+		return store.ListUsers(ctx)
+	}
+	if req.Username == "" {
+		return nil, fmt.Errorf("%w: no username given", errUsage)
+	}
+	if req.Op == kadmin.OpAdd {
+		if req.Password == "" {
+			return nil, fmt.Errorf("%w: a new user needs a password", errUsage)
+		}
+		user := authdb.UserAuth{Username: req.Username, RequirePreauth: true}
+		applyChanges(&user, req)
+		user.SetPassword(req.Password)
+		if _, err := addPrincipal(ctx, store, user, req.Password); err != nil {
+			return nil, err
+		}
+		added, err := store.GetUserByUsername(ctx, user.Username)
+		return []authdb.UserAuth{added}, err
+	}
+
+	user, err := store.GetUserByUsername(ctx, req.Username)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Op {
+	case kadmin.OpGet:
+		return []authdb.UserAuth{user}, nil
+	case kadmin.OpDelete:
+		return []authdb.UserAuth{user}, store.DeleteUser(ctx, user.Id)
+	case kadmin.OpModify:
+		applyChanges(&user, req)
+		if err := updatePrincipal(ctx, store, user, ""); err != nil {
+			return nil, err
+		}
+	case kadmin.OpSetPassword:
+		if req.Password == "" {
+			return nil, fmt.Errorf("%w: the password must not be empty", errUsage)
+		}
+		if err := updatePrincipal(ctx, store, user, req.Password); err != nil {
+			return nil, err
+		}
+	}
+	updated, err := store.GetUserByUsername(ctx, user.Username)
+	return []authdb.UserAuth{updated}, err
+}
+
+// applyChanges sets the fields of user that req gives.
+func applyChanges(user *authdb.UserAuth, req kadmin.Request) {
+	if req.FirstName != nil {
+		user.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		user.LastName = *req.LastName
+	}
+	if req.Rename != nil {
+		user.Username = *req.Rename
+	}
+	if req.Policy != nil {
+		user.Policy = *req.Policy
+	}
+	if req.RequirePreauth != nil {
+		user.RequirePreauth = *req.RequirePreauth
+	}
+}
+
+// kadminStatus maps the error an operation failed with to the status
+// reported to the client.
+func kadminStatus(err error) kadmin.Status {
+	return kadmin.StatusOf(exitCode(err))
+}
+
+func kadminUser(u authdb.UserAuth) kadmin.User {
+	return kadmin.User{
+		Username:       u.Username,
+		FirstName:      u.FirstName,
+		LastName:       u.LastName,
+		RequirePreauth: u.RequirePreauth,
+		Policy:         u.Policy,
+		Kvno:           u.Kvno(),
+		ETypes:         etypeNames(u.ETypes()),
+	}
+}
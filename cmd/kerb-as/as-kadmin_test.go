@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/replay"
+)
+
+func TestParseACL(t *testing.T) {
+	realm = kerb.DefaultRealm
+	parsed, err := parseACL(strings.NewReader("# helpdesk first\nbob helpdesk\n*/admin full\n\n*@OTHER read-only\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		principal string
+		role      authdb.AdminRole
+		ok        bool
+	}{
+		{"bob@KERBEROS", authdb.RoleHelpdesk, true},
+		{"BOB@kerberos", authdb.RoleHelpdesk, true},
+		{"alice/admin@KERBEROS", authdb.RoleFull, true},
+		{"alice/admin@OTHER", "", false},
+		{"alice@OTHER", authdb.RoleReadOnly, true},
+		{"alice@KERBEROS", "", false},
+		{"bob/admin/x@KERBEROS", "", false},
+	}
+	for _, test := range tests {
+		role, ok := parsed.role(test.principal)
+		if role != test.role || ok != test.ok {
+			t.Errorf("%s: expected %q %t got %q %t", test.principal, test.role, test.ok, role, ok)
+		}
+	}
+
+	if _, err := parseACL(strings.NewReader("bob superuser\n")); !errors.Is(err, authdb.ErrUnknownRole) {
+		t.Errorf("Expected an unknown role to be rejected, got %v", err)
+	}
+}
+
+// kadminRequest sends req to handleKadmin as jdoe with a ticket for
+// kadmin/admin, and returns the response along with the reply decrypted if
+// there is one.
+func kadminRequest(t *testing.T, req kadmin.Request) (*httptest.ResponseRecorder, kadmin.Reply) {
+	t.Helper()
+
+	body, header, ticket := kadminMessage(t, req)
+	w := postKadmin(body, header)
+	var reply kadmin.Reply
+	if w.Code == http.StatusOK {
+		if err := encryption.DecryptWith(ticket.SessionKeyType, ticket.SessionKey, kadmin.KeyUsageReply, w.Body.Bytes(), &reply); err != nil {
+			t.Fatal("Unable to decrypt reply: ", err)
+		}
+	}
+	return w, reply
+}
+
+// kadminMessage returns the body and headers of a request from jdoe, and
+// the ticket it carries.
+func kadminMessage(t *testing.T, req kadmin.Request) ([]byte, http.Header, kerb.Ticket) {
+	t.Helper()
+	ticket := kerb.GenerateTicket("jdoe@" + realm)
+	body, header := apMessage(t, kerb.KadminService, ticket, kadmin.KeyUsageRequest, req)
+	return body, header, ticket
+}
+
+// apMessage returns the body and headers of a request to the service name
+// carrying ticket, an authenticator for its client and req encrypted with
+// usage.
+func apMessage(t *testing.T, name string, ticket kerb.Ticket, usage uint32, req any) ([]byte, http.Header) {
+	t.Helper()
+
+	service, err := store.GetServiceByPrincipal(context.Background(), kerb.QualifyPrincipal(name, realm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := service.CurrentKey()
+	encTicket, err := kerb.SealTicket(ticket, service.Principal, key.ServiceKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encReq, _ := encryption.EncryptWith(ticket.SessionKeyType, ticket.SessionKey, usage, req)
+	auth := kerb.Autheticator{Username: ticket.Username, Timestamp: time.Now()}
+	auth.Checksum, _ = encryption.Checksum(ticket.SessionKeyType, ticket.SessionKey, kerb.KeyUsageAPReqChecksum, encReq)
+	encAuth, _ := encryption.EncryptWith(ticket.SessionKeyType, ticket.SessionKey, kerb.KeyUsageAPReqAuth, auth)
+
+	header := http.Header{}
+	header.Set("X-Ticket-Length", strconv.Itoa(len(encTicket)))
+	header.Set("X-Auth-Length", strconv.Itoa(len(encAuth)))
+	return append(append(encTicket, encAuth...), encReq...), header
+}
+
+func postKadmin(body []byte, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, kadmin.Path, bytes.NewReader(body))
+	r.Header = header
+	w := httptest.NewRecorder()
+	handleKadmin(w, r)
+	return w
+}
+
+func useKadmin(t *testing.T, role authdb.AdminRole) {
+	t.Helper()
+	useMemoryStore(t)
+	rcache = replay.NewCache(replay.DefaultMaxEntries)
+	acl = kadminACL{{"jdoe@" + strings.ToLower(realm), role}}
+}
+
+func TestHandleKadminAddsUser(t *testing.T) {
+	useKadmin(t, authdb.RoleFull)
+
+	firstName := "Ann"
+	w, reply := kadminRequest(t, kadmin.Request{Op: kadmin.OpAdd, Username: "alee", FirstName: &firstName, Password: "Secret99!"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d: %s", w.Code, w.Body)
+	}
+	if reply.Status != kadmin.StatusOK || len(reply.Users) != 1 || reply.Users[0].FirstName != "Ann" {
+		t.Fatalf("Unexpected reply %+v", reply)
+	}
+	if w.Header().Get("X-Ap-Rep") == "" {
+		t.Error("Expected an AP-REP")
+	}
+
+	user, err := store.GetUserByUsername(context.Background(), "alee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := user.Key(user.ETypes()[0])
+	if expected := user.KeyParams(user.ETypes()[0]).StringToKey("Secret99!"); string(key) != string(expected) {
+		t.Error("Key not derived from the password sent")
+	}
+}
+
+func TestHandleKadminFollowsACL(t *testing.T) {
+	tests := []struct {
+		role   authdb.AdminRole
+		req    kadmin.Request
+		status kadmin.Status
+	}{
+		{authdb.RoleReadOnly, kadmin.Request{Op: kadmin.OpList}, kadmin.StatusOK},
+		{authdb.RoleReadOnly, kadmin.Request{Op: kadmin.OpDelete, Username: "jdoe"}, kadmin.StatusDenied},
+		{authdb.RoleHelpdesk, kadmin.Request{Op: kadmin.OpSetPassword, Username: "jdoe", Password: "Secret99!"}, kadmin.StatusOK},
+		{authdb.RoleHelpdesk, kadmin.Request{Op: kadmin.OpAdd, Username: "alee", Password: "Secret99!"}, kadmin.StatusDenied},
+		{authdb.RoleFull, kadmin.Request{Op: kadmin.OpGet, Username: "nobody"}, kadmin.StatusNotFound},
+		{authdb.RoleFull, kadmin.Request{Op: kadmin.OpAdd, Username: "jdoe", Password: "Secret99!"}, kadmin.StatusExists},
+		{authdb.RoleFull, kadmin.Request{Op: "frobnicate"}, kadmin.StatusInvalid},
+	}
+
+	for _, test := range tests {
+		useKadmin(t, test.role)
+		_, reply := kadminRequest(t, test.req)
+		if reply.Status != test.status {
+			t.Errorf("%s %s: expected %s got %s: %s", test.role, test.req.Op, test.status, reply.Status, reply.Message)
+		}
+	}
+
+	useKadmin(t, authdb.RoleFull)
+	acl = nil
+	if _, reply := kadminRequest(t, kadmin.Request{Op: kadmin.OpList}); reply.Status != kadmin.StatusDenied {
+		t.Errorf("Expected a principal missing from the ACL to be denied, got %s", reply.Status)
+	}
+}
+
+func TestHandleKadminRejectsReplayAndTampering(t *testing.T) {
+	useKadmin(t, authdb.RoleFull)
+
+	body, header, _ := kadminMessage(t, kadmin.Request{Op: kadmin.OpList})
+	if w := postKadmin(body, header); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d: %s", w.Code, w.Body)
+	}
+	if err := kerb.ReadError(postKadmin(body, header).Result()); !errors.Is(err, kerb.ErrReplay) {
+		t.Errorf("Expected a replay to be rejected, got %v", err)
+	}
+
+	// Changing the request breaks the authenticator's checksum
+	body, header, _ = kadminMessage(t, kadmin.Request{Op: kadmin.OpList})
+	body[len(body)-1] ^= 1
+	if err := kerb.ReadError(postKadmin(body, header).Result()); !errors.Is(err, kerb.ErrBadChecksum) {
+		t.Errorf("Expected a tampered request to be rejected, got %v", err)
+	}
+}
+
+func TestHandleKadminProtectsListedPrincipals(t *testing.T) {
+	useKadmin(t, authdb.RoleHelpdesk)
+	acl = append(acl, aclEntry{"root/admin@" + strings.ToLower(realm), authdb.RoleFull}, aclEntry{"carol@" + strings.ToLower(realm), authdb.RoleHelpdesk})
+
+	ctx := context.Background()
+	for _, username := range []string{"root/admin", "carol", "plain"} {
+		user := authdb.UserAuth{Username: username, RequirePreauth: true}
+		user.SetPassword("Original1!")
+		if err := store.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		username string
+		status   kadmin.Status
+	}{
+		{"root/admin", kadmin.StatusDenied},
+		{"ROOT/ADMIN", kadmin.StatusDenied},
+		{"carol", kadmin.StatusOK},
+		{"plain", kadmin.StatusOK},
+	}
+	for _, test := range tests {
+		_, reply := kadminRequest(t, kadmin.Request{Op: kadmin.OpSetPassword, Username: test.username, Password: "Takeover1!"})
+		if reply.Status != test.status {
+			t.Errorf("Reset of %s: expected %s got %s: %s", test.username, test.status, reply.Status, reply.Message)
+		}
+	}
+
+	admin, _ := store.GetUserByUsername(ctx, "root/admin")
+	key, _ := admin.Key(admin.ETypes()[0])
+	if expected := admin.KeyParams(admin.ETypes()[0]).StringToKey("Original1!"); string(key) != string(expected) {
+		t.Error("A helpdesk principal changed the password of a full administrator")
+	}
+}
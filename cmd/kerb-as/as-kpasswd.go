@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+// handleKpasswd changes the password of the client of a ticket for
+// kadmin/changepw, see the kadmin package for the protocol.
+func handleKpasswd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, kerb.ErrBadRequest)
+		return
+	}
+	var req kadmin.PasswdRequest
+	ticket, auth, err := openAPRequest(r, kerb.ChangePwService, kadmin.KeyUsagePasswdRequest, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	reply := changePassword(r.Context(), ticket, req.NewPassword)
+	writeReply(w, ticket, auth, kadmin.KeyUsagePasswdReply, reply)
+}
+
+// changePassword sets the password of the ticket's client, subject to
+// their password policy.
+func changePassword(ctx context.Context, ticket kerb.Ticket, password string) kadmin.Reply {
+	// A ticket from the TGS only proves the client had a TGT, which may
+	// have been stolen, not that they know the password
+	if !ticket.Flags.Has(kerb.FlagInitial) {
+		log.Printf("Refused password change for %s with a ticket that is not initial", ticket.Username)
+		return kadmin.Reply{Status: kadmin.StatusDenied, Message: "the ticket must be issued by the authentication server"}
+	}
+	if password == "" {
+		return kadmin.Reply{Status: kadmin.StatusInvalid, Message: "the password must not be empty"}
+	}
+
+	client, err := kerb.ParsePrincipal(ticket.Username, realm)
+	if err != nil || client.Realm != realm {
+		return kadmin.Reply{Status: kadmin.StatusDenied, Message: ticket.Username + " is not a user of realm " + realm}
+	}
+	user, err := store.GetUserByUsername(ctx, client.NameString())
+	if err == nil {
+		err = updatePrincipal(ctx, store, user, password)
+	}
+	if err != nil {
+		log.Printf("Password change for %s failed: %v", ticket.Username, err)
+		return kadmin.Reply{Status: kadminStatus(err), Message: err.Error()}
+	}
+
+	log.Printf("Password changed for %s", ticket.Username)
+	return kadmin.Reply{Status: kadmin.StatusOK}
+}
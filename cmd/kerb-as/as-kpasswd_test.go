@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/replay"
+)
+
+// kpasswdRequest asks handleKpasswd to change jdoe's password with a ticket
+// with flags, and returns the reply.
+func kpasswdRequest(t *testing.T, flags kerb.TicketFlags, password string) kadmin.Reply {
+	t.Helper()
+
+	ticket := kerb.GenerateTicket("jdoe@" + realm)
+	ticket.Flags = flags
+	body, header := apMessage(t, kerb.ChangePwService, ticket, kadmin.KeyUsagePasswdRequest, kadmin.PasswdRequest{NewPassword: password})
+	r := httptest.NewRequest(http.MethodPost, kadmin.PasswdPath, bytes.NewReader(body))
+	r.Header = header
+	w := httptest.NewRecorder()
+	handleKpasswd(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("X-Ap-Rep") == "" {
+		t.Error("Expected an AP-REP")
+	}
+	var reply kadmin.Reply
+	if err := encryption.DecryptWith(ticket.SessionKeyType, ticket.SessionKey, kadmin.KeyUsagePasswdReply, w.Body.Bytes(), &reply); err != nil {
+		t.Fatal("Unable to decrypt reply: ", err)
+	}
+	return reply
+}
+
+func TestHandleKpasswd(t *testing.T) {
+	ctx := context.Background()
+	useMemoryStore(t)
+	rcache = replay.NewCache(replay.DefaultMaxEntries)
+
+	if err := store.AddPolicy(ctx, authdb.PasswordPolicy{Name: "strict", MinLength: 10, MinClasses: 3}); err != nil {
+		t.Fatal(err)
+	}
+	user, _ := store.GetUserByUsername(ctx, "jdoe")
+	user.Policy = "strict"
+	if err := store.UpdateUser(ctx, user.Id, user); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flags    kerb.TicketFlags
+		password string
+		status   kadmin.Status
+	}{
+		{kerb.FlagInitial, "short", kadmin.StatusRejected},
+		{kerb.FlagInitial, "", kadmin.StatusInvalid},
+		{0, "Long-enough-1", kadmin.StatusDenied},
+		{kerb.FlagInitial, "Long-enough-1", kadmin.StatusOK},
+	}
+	for _, test := range tests {
+		if reply := kpasswdRequest(t, test.flags, test.password); reply.Status != test.status {
+			t.Errorf("%s %q: expected %s got %s: %s", test.flags, test.password, test.status, reply.Status, reply.Message)
+		}
+	}
+
+	user, _ = store.GetUserByUsername(ctx, "jdoe")
+	etype := user.ETypes()[0]
+	key, _ := user.Key(etype)
+	if expected := user.KeyParams(etype).StringToKey("Long-enough-1"); string(key) != string(expected) {
+		t.Error("Key not derived from the new password")
+	}
+}
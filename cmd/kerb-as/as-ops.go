@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+// The operations below are shared by the administrator menu and the admin
+// subcommands, which only differ in how they gather input and report the
+// outcome.
+
+// addPrincipal stores a new user, whose keys have been derived from
+// password. A user without a password policy is given the default one if it
+// exists, and password must satisfy the user's policy.
+func addPrincipal(ctx context.Context, store authdb.PrincipalStore, user authdb.UserAuth, password string) (authdb.UserAuth, error) {
+	if user.Policy == "" {
+		policy, err := defaultPolicy(ctx, store)
+		if err != nil {
+			return user, err
+		}
+		user.Policy = policy
+	}
+	if err := authdb.CheckPassword(ctx, store, user, password); err != nil {
+		return user, err
+	}
+	return user, store.AddUser(ctx, user)
+}
+
+// defaultPolicy returns the name of the default password policy, or an
+// empty name if it does not exist.
+func defaultPolicy(ctx context.Context, store authdb.PrincipalStore) (string, error) {
+	if _, err := store.GetPolicy(ctx, authdb.DefaultPolicy); errors.Is(err, authdb.ErrPolicyNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return authdb.DefaultPolicy, nil
+}
+
+// updatePrincipal stores the changed details of a user. A non-empty
+// password must satisfy the user's policy, and gives them new keys.
+func updatePrincipal(ctx context.Context, store authdb.PrincipalStore, user authdb.UserAuth, password string) error {
+	// The salt is stored with the key, so renaming the user keeps the key
+	// valid and a new password gets a new salt
+	if password != "" {
+		if err := authdb.CheckPassword(ctx, store, user, password); err != nil {
+			return err
+		}
+		user.SetPassword(password)
+	}
+	return store.UpdateUser(ctx, user.Id, user)
+}
+
+// addServicePrincipal registers a service with a random key.
+func addServicePrincipal(ctx context.Context, store authdb.PrincipalStore, principal string) (authdb.ServicePrincipal, error) {
+	// Services have no password so their long-term key is random, of the
+	// strongest type we support
+	etype := encryption.Supported()[0]
+	key, err := encryption.GenerateKey(etype)
+	if err != nil {
+		return authdb.ServicePrincipal{}, err
+	}
+	service := authdb.ServicePrincipal{
+		Principal: kerb.QualifyPrincipal(principal, realm),
+		Keys:      []authdb.KeyVersion{{Kvno: 1, EType: etype, Key: hex.EncodeToString(key)}},
+	}
+	if err := store.AddService(ctx, service); err != nil {
+		return service, err
+	}
+	return store.GetServiceByPrincipal(ctx, service.Principal)
+}
@@ -1,28 +1,60 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/khaugen7/kerberos-go/internal/authdb"
 	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
 	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/replay"
 )
 
-var sqlDb *sql.DB
+var store authdb.PrincipalStore
+var clock kerb.Clock = kerb.SystemClock{}
+var validator kerb.Validator
+var policy kerb.Policy
 
-func serverMain(host string, port int, db *sql.DB) {
-	sqlDb = db
+func serverMain(host string, port int, s authdb.PrincipalStore) {
+	store = s
+	validator = kerb.Validator{Clock: clock, Skew: skew}
+	policy = kerb.Policy{MaxLifetime: maxLifetime, MaxRenewableLifetime: maxRenewLifetime}
 	addr := host + ":" + strconv.Itoa(port)
 
+	if aclPath == "" {
+		aclPath = authdb.DefaultACLPath(sqlitePath)
+	}
+	var err error
+	if acl, err = loadACL(aclPath); err != nil {
+		log.Fatal("Unable to read the kadmin ACL: ", err)
+	}
+	if len(acl) == 0 {
+		log.Printf("No entries in %s, remote administration is disabled", aclPath)
+	}
+	rcache, err = replay.Open(rcachePath, rcacheSize)
+	if err != nil {
+		log.Fatal("Unable to open replay cache:", err)
+	}
+	defer rcache.Close()
+	stopSweeper := rcache.StartSweeper(time.Minute, func(err error) { log.Print("Replay cache sweep failed:", err) })
+	defer stopSweeper()
+
 	http.HandleFunc("/auth", handleAuth)
+	http.HandleFunc(kadmin.Path, handleKadmin)
+	http.HandleFunc(kadmin.PasswdPath, handleKpasswd)
 
 	log.Printf("Server listening at %s", addr)
-	err := http.ListenAndServe(addr, nil)
+	err = http.ListenAndServe(addr, nil)
 
 	if errors.Is(err, http.ErrServerClosed) {
 		log.Printf("Server closed.")
@@ -35,27 +67,138 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 	username := r.Header.Get("X-Username")
 	if username == "" {
 		w.Header().Set("X-Missing-Field", "X-Username")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, kerb.MissingField("X-Username"))
+		return
+	}
+
+	client, err := kerb.ParsePrincipal(username, realm)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if client.Realm != realm {
+		// Users authenticate with the AS of their own realm
+		writeError(w, kerb.ErrWrongRealm)
+		return
+	}
+
+	padata := r.Header.Get("X-Preauth")
+
+	// Besides TGTs the AS only issues tickets for the password change
+	// service, so that they prove the user has just entered their password
+	changePw := r.Header.Get("X-Service") != ""
+	if changePw && kerb.QualifyPrincipal(r.Header.Get("X-Service"), realm) != kerb.QualifyPrincipal(kerb.ChangePwService, realm) {
+		writeError(w, kerb.ErrPolicy)
+		return
+	}
+
+	options, err := kerb.ParseTicketFlags(r.Header.Get("X-Kdc-Options"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	offered, err := etypesHeader(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// The TGS accepts every session key type we support
+	sessionKeyType, err := encryption.Negotiate(offered, encryption.Supported())
+	if err != nil {
+		writeError(w, kerb.ErrETypeNoSupport)
+		return
+	}
+
+	user, err := store.GetUserByUsername(r.Context(), client.NameString())
+	if errors.Is(err, authdb.ErrUserNotFound) {
+		// Answer exactly as we would for a real user so that usernames
+		// cannot be enumerated. Only users who do not require
+		// pre-authentication can be told apart, as they get a TGT.
+		params, err := unknownUserParams(r.Context(), client.NameString(), sessionKeyType)
+		if err != nil {
+			log.Print("Unable to make up key parameters: ", err)
+			writeError(w, kerb.ErrUnavailable)
+			return
+		}
+		w.Header().Set("X-Etype-Info2", kerb.EncodeETypeInfo2(params))
+		if padata == "" {
+			writeError(w, kerb.ErrPreauthRequired)
+		} else {
+			writeError(w, kerb.ErrPreauthFailed)
+		}
+		return
+	} else if err != nil {
+		log.Print("Unable to look up user: ", err)
+		writeError(w, kerb.ErrUnavailable)
+		return
+	}
+
+	userKeyType, err := encryption.Negotiate(offered, user.ETypes())
+	if err != nil {
+		log.Printf("User %s has no key of the types offered: %s", user.Username, encryption.FormatETypes(offered))
+		writeError(w, kerb.ErrETypeNoSupport)
+		return
+	}
+	userKey, ok := user.Key(userKeyType)
+	if !ok {
+		log.Printf("Unable to read the %s key of user %s", userKeyType, user.Username)
+		writeError(w, kerb.ErrUnavailable)
 		return
 	}
 
-	foundUsers := authdb.FindUserByUsername(username, sqlDb)
-	if len(foundUsers) == 0 {
-		w.WriteHeader(http.StatusUnauthorized)
+	// Tell the client how to derive the user's key from the password
+	w.Header().Set("X-Etype-Info2", kerb.EncodeETypeInfo2(user.KeyParams(userKeyType)))
+
+	if padata != "" {
+		if err := verifyPreauth(padata, userKeyType, userKey); err != nil {
+			log.Printf("Pre-authentication failed for user %s: %v", user.Username, err)
+			writeError(w, err)
+			return
+		}
+	} else if user.RequirePreauth {
+		writeError(w, kerb.ErrPreauthRequired)
 		return
 	}
 
-	user := foundUsers[0]
-	tgt := kerb.GenerateTicket(user.Username)
+	now := clock.Now()
+	// Name the client as stored rather than however it was typed
+	if stored, err := kerb.ParsePrincipal(user.Username, realm); err == nil {
+		client = stored
+	}
+	req := kerb.TicketRequest{Username: client.String(), SessionKeyType: sessionKeyType, Options: options, Preauthenticated: padata != ""}
+	req.SetLifetimes(now, durationHeader(r, "X-Lifetime"), durationHeader(r, "X-Renewable-Lifetime"))
+
+	ticketPolicy := policy
+	if changePw {
+		// Password change tickets are short lived and cannot be renewed or
+		// passed on
+		ticketPolicy = kerb.Policy{MaxLifetime: kerb.ChangePwLifetime}
+		if policy.MaxLifetime < ticketPolicy.MaxLifetime {
+			ticketPolicy.MaxLifetime = policy.MaxLifetime
+		}
+		req.Options = 0
+	}
 
-	userKey, _ := hex.DecodeString(user.Key)
+	tgt, err := kerb.IssueTicket(req, now, ticketPolicy, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-	// Encrypt TGT with shared key between AS and TGS
-	asTgsKey, _ := hex.DecodeString(authdb.GetSharedKey("as-tgs", sqlDb))
-	encTgt, _ := encryption.Encrypt(asTgsKey, tgt)
+	// Encrypt TGT with shared key between AS and TGS, or the ticket with the
+	// password change service's key
+	tgsPrincipal, tgsKey, err := asTicketKey(r.Context(), changePw)
+	if err != nil {
+		log.Print("Unable to look up the key to encrypt the ticket with: ", err)
+		writeError(w, kerb.ErrUnavailable)
+		return
+	}
+	encTgt, _ := kerb.SealTicket(tgt, tgsPrincipal, tgsKey.ServiceKey())
 
-	// Encrypt user-TGS session key with user key
-	encTgsSessionKey, _ := encryption.Encrypt(userKey, tgt.SessionKey)
+	// Encrypt user-TGS session key and TGT expiry with user key
+	encTgsSessionKey, _ := encryption.EncryptWith(userKeyType, userKey, kerb.KeyUsageASRepPart, tgt.ReplyPart(tgsPrincipal))
 	keyLen := strconv.Itoa(len(encTgsSessionKey))
 
 	response := append(encTgsSessionKey, encTgt...)
@@ -65,3 +208,78 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(response)
 }
+
+// asTicketKey returns the principal the AS issues a ticket for and the key
+// it is encrypted with: the TGS and the key it shares with the AS, or the
+// password change service and its key.
+func asTicketKey(ctx context.Context, changePw bool) (string, authdb.KeyVersion, error) {
+	if !changePw {
+		key, err := authdb.CurrentSharedKey(ctx, store, "as-tgs")
+		return kerb.TGSPrincipal(realm, realm).String(), key, err
+	}
+	service, err := store.GetServiceByPrincipal(ctx, kerb.QualifyPrincipal(kerb.ChangePwService, realm))
+	if err != nil {
+		return "", authdb.KeyVersion{}, err
+	}
+	key, ok := service.CurrentKey()
+	if !ok {
+		return "", authdb.KeyVersion{}, fmt.Errorf("%w: %s", authdb.ErrNoKey, service.Principal)
+	}
+	return service.Principal, key, nil
+}
+
+// verifyPreauth decrypts a hex encoded PA-ENC-TIMESTAMP with the user's key
+// and checks that the timestamp is current.
+func verifyPreauth(padata string, etype encryption.EType, userKey []byte) error {
+	encTimestamp, err := hex.DecodeString(padata)
+	if err != nil {
+		return kerb.ErrPreauthFailed
+	}
+
+	var pa kerb.PAEncTimestamp
+	if err := encryption.DecryptWith(etype, userKey, kerb.KeyUsagePAEncTimestamp, encTimestamp, &pa); err != nil {
+		return kerb.ErrPreauthFailed
+	}
+	return validator.ValidatePreauth(pa)
+}
+
+// unknownUserParams makes up key parameters for a user that does not exist.
+// The salt is derived from the username with salt-secret, a key only the KDC
+// knows, so repeated requests see the same salt just as they would for a
+// real user. That key is never rotated, or every made-up salt would change
+// at once.
+func unknownUserParams(ctx context.Context, username string, etype encryption.EType) (encryption.KeyParams, error) {
+	key, err := authdb.CurrentSharedKey(ctx, store, "salt-secret")
+	if err != nil {
+		return encryption.KeyParams{}, err
+	}
+	secret, _ := hex.DecodeString(key.Key)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("salt:" + strings.ToLower(username)))
+	return encryption.KeyParams{EType: etype, Salt: mac.Sum(nil)[:encryption.SaltSize], Iterations: encryption.DefaultIterations}, nil
+}
+
+// etypesHeader parses the encryption types offered by the client. A client
+// that offers none is assumed to support them all.
+func etypesHeader(r *http.Request) ([]encryption.EType, error) {
+	header := r.Header.Get("X-Etypes")
+	if header == "" {
+		return encryption.Supported(), nil
+	}
+	return encryption.ParseETypes(header)
+}
+
+// writeError sends err to the client as a KRB-ERROR from our realm.
+func writeError(w http.ResponseWriter, err error) {
+	kerb.WriteError(w, err, realm, clock.Now())
+}
+
+// durationHeader parses a duration sent by the client, returning zero if the
+// header is missing or invalid.
+func durationHeader(r *http.Request, name string) time.Duration {
+	d, err := time.ParseDuration(r.Header.Get(name))
+	if err != nil {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+// useMemoryStore points the server at a fresh in-memory store holding one
+// user, jdoe, who does not have to pre-authenticate.
+func useMemoryStore(t *testing.T) authdb.UserAuth {
+	t.Helper()
+
+	realm = kerb.DefaultRealm
+	validator = kerb.NewValidator()
+	policy = kerb.DefaultPolicy()
+
+	memory, err := authdb.NewMemoryStore(realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = memory
+
+	user := authdb.UserAuth{FirstName: "John", LastName: "Doe", Username: "jdoe"}
+	user.SetPassword("pass123")
+	if err := store.AddUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestHandleAuthIssuesTGT(t *testing.T) {
+	user := useMemoryStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Username", "jdoe")
+	w := httptest.NewRecorder()
+	handleAuth(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.Bytes()
+	keyLen, err := strconv.Atoi(w.Header().Get("X-Key-Length"))
+	if err != nil || keyLen > len(body) {
+		t.Fatalf("Bad X-Key-Length %q", w.Header().Get("X-Key-Length"))
+	}
+
+	etype := encryption.Supported()[0]
+	userKey, _ := user.Key(etype)
+	var reply kerb.EncKDCRepPart
+	if err := encryption.DecryptWith(etype, userKey, kerb.KeyUsageASRepPart, body[:keyLen], &reply); err != nil {
+		t.Fatal("Unable to decrypt reply with the user's key: ", err)
+	}
+
+	sealed, err := kerb.OpenSealedTicket(body[keyLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	asTgsKey, err := authdb.CurrentSharedKey(context.Background(), store, "as-tgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt, err := sealed.Decrypt(asTgsKey.ServiceKey().Key)
+	if err != nil {
+		t.Fatal("Unable to decrypt TGT with the AS-TGS key: ", err)
+	}
+	if tgt.Username != "jdoe@"+realm || string(tgt.SessionKey) != string(reply.SessionKey) {
+		t.Errorf("TGT %+v does not match reply %+v", tgt, reply)
+	}
+}
+
+func TestHandleAuthUnknownUser(t *testing.T) {
+	useMemoryStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Username", "nobody")
+	w := httptest.NewRecorder()
+	handleAuth(w, r)
+
+	err := kerb.ReadError(w.Result())
+	if !errors.Is(err, kerb.ErrPreauthRequired) {
+		t.Errorf("Expected pre-authentication to be required, got %v", err)
+	}
+	if w.Header().Get("X-Etype-Info2") == "" {
+		t.Error("Expected key parameters for the unknown user")
+	}
+}
+
+func TestHandleAuthUnreadableKey(t *testing.T) {
+	useMemoryStore(t)
+
+	user := authdb.UserAuth{Username: "broken", Keys: []authdb.UserKey{{Kvno: 1, EType: encryption.Supported()[0], Key: "not hex"}}}
+	if err := store.AddUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Username", "broken")
+	w := httptest.NewRecorder()
+	handleAuth(w, r)
+
+	if err := kerb.ReadError(w.Result()); !errors.Is(err, kerb.ErrUnavailable) {
+		t.Errorf("Expected the AS to be unavailable, got %v", err)
+	}
+}
+
+func TestHandleAuthIssuesChangePwTicket(t *testing.T) {
+	useMemoryStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Username", "jdoe")
+	r.Header.Set("X-Service", kerb.ChangePwService)
+	r.Header.Set("X-Kdc-Options", "forwardable,renewable")
+	r.Header.Set("X-Renewable-Lifetime", "8h")
+	w := httptest.NewRecorder()
+	handleAuth(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d: %s", w.Code, w.Body)
+	}
+	keyLen, _ := strconv.Atoi(w.Header().Get("X-Key-Length"))
+	sealed, err := kerb.OpenSealedTicket(w.Body.Bytes()[keyLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := store.GetServiceByPrincipal(context.Background(), kerb.QualifyPrincipal(kerb.ChangePwService, realm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := service.CurrentKey()
+	ticket, err := sealed.Decrypt(key.ServiceKey().Key)
+	if err != nil {
+		t.Fatal("Unable to decrypt ticket with the kadmin/changepw key: ", err)
+	}
+	if sealed.Service != service.Principal || ticket.Flags != kerb.FlagInitial {
+		t.Errorf("Expected an initial ticket for %s only, got one for %s with flags %s", service.Principal, sealed.Service, ticket.Flags)
+	}
+	if lifetime := ticket.Validity.Sub(ticket.StartTime); lifetime > kerb.ChangePwLifetime {
+		t.Errorf("Expected a lifetime of at most %s, got %s", kerb.ChangePwLifetime, lifetime)
+	}
+
+	// Tickets for other services come from the TGS
+	r = httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Username", "jdoe")
+	r.Header.Set("X-Service", kerb.DefaultFileService)
+	w = httptest.NewRecorder()
+	handleAuth(w, r)
+	if err := kerb.ReadError(w.Result()); !errors.Is(err, kerb.ErrPolicy) {
+		t.Errorf("Expected a ticket for another service to be refused, got %v", err)
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"time"
 
 	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/replay"
+	"github.com/khaugen7/kerberos-go/internal/utils"
 )
 
 var admin bool
@@ -13,8 +20,38 @@ var sqlitePath string
 var help bool
 
 var (
-	host string
-	port int
+	rotate string
+	grace  time.Duration
+)
+
+var (
+	exportPrincipal string
+	keytabPath      string
+)
+
+var (
+	migrate bool
+	dryRun  bool
+)
+
+var (
+	stashPath string
+	reencrypt bool
+)
+
+var (
+	aclPath    string
+	rcachePath string
+	rcacheSize int
+)
+
+var (
+	realm            string
+	host             string
+	port             int
+	skew             time.Duration
+	maxLifetime      time.Duration
+	maxRenewLifetime time.Duration
 )
 
 type User struct {
@@ -24,8 +61,23 @@ type User struct {
 func parseFlags() {
 	flag.BoolVar(&admin, "admin", false, "Administrator login")
 	flag.StringVar(&sqlitePath, "db", "", "Directory for Sqlite db")
+	flag.StringVar(&realm, "realm", kerb.DefaultRealm, "Realm served by this KDC")
 	flag.StringVar(&host, "h", "127.0.0.1", "Server host")
 	flag.IntVar(&port, "p", 8555, "Server port")
+	flag.DurationVar(&skew, "skew", kerb.DefaultSkew, "Maximum clock skew tolerated for pre-authentication")
+	flag.DurationVar(&maxLifetime, "max-life", kerb.DefaultLifetime, "Maximum lifetime granted to TGTs")
+	flag.DurationVar(&maxRenewLifetime, "max-renew", kerb.DefaultMaxRenewableLifetime, "Maximum renewable lifetime granted to TGTs (0 disables renewal)")
+	flag.StringVar(&rotate, "rotate", "", "Rotate the key of this principal and exit")
+	flag.DurationVar(&grace, "grace", kerb.DefaultKeyGracePeriod, "How long a key replaced by -rotate keeps decrypting tickets")
+	flag.StringVar(&exportPrincipal, "export-keytab", "", "Export the keys of this principal to the file given by -keytab and exit")
+	flag.StringVar(&keytabPath, "keytab", "", "Keytab file written by -export-keytab")
+	flag.BoolVar(&migrate, "migrate", false, "Upgrade the database schema to the latest version and exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "With -migrate, list the steps that would be applied without changing the database")
+	flag.StringVar(&stashPath, "stash", "", "Stash file holding the master key (default .k5.REALM next to the db)")
+	flag.BoolVar(&reencrypt, "reencrypt", false, "Re-encrypt every stored key under a new master key and exit")
+	flag.StringVar(&aclPath, "acl", "", "Access control list of the remote administration service (default kadm5.acl next to the db)")
+	flag.StringVar(&rcachePath, "rcache", "", "File to persist the replay cache of the remote administration service in (default in-memory only)")
+	flag.IntVar(&rcacheSize, "rcache-size", replay.DefaultMaxEntries, "Maximum number of authenticators held in the replay cache")
 	flag.BoolVar(&help, "help", false, "Display help")
 	flag.Parse()
 }
@@ -37,18 +89,65 @@ func main() {
 		displayHelp()
 	}
 
-	db := authdb.InitializeDb(sqlitePath)
+	command := flag.Args()
+	if len(command) > 0 && command[0] != "admin" {
+		log.Fatalf("Unknown command %q", command[0])
+	}
+
+	if migrate {
+		if err := migrateDb(dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if stashPath == "" {
+		stashPath = authdb.DefaultStashPath(sqlitePath, realm)
+	}
+	db, err := authdb.InitializeDb(context.Background(), sqlitePath, realm, masterKeySource())
+	if errors.Is(err, authdb.ErrMigrationRequired) {
+		log.Fatal(err, "; run kerb-as -migrate to upgrade it")
+	} else if err != nil {
+		log.Fatal(err)
+	}
 	defer db.Close()
 
-	if admin {
+	if len(command) > 0 {
+		code := runAdminCommand(db, command[1:])
+		db.Close()
+		os.Exit(code)
+	} else if reencrypt {
+		if err := reencryptDb(db); err != nil {
+			log.Fatal(err)
+		}
+	} else if rotate != "" {
+		if err := rotateKey(db, rotate, grace); err != nil {
+			log.Fatal(err)
+		}
+	} else if exportPrincipal != "" {
+		if err := exportKeytab(db, exportPrincipal, keytabPath); err != nil {
+			log.Fatal(err)
+		}
+	} else if admin {
 		adminMain(db)
 	} else {
 		serverMain(host, port, db)
 	}
 }
 
+// masterKeySource reads the master key from the stash file, or asks for the
+// master password if there is none. A new master key is stashed.
+func masterKeySource() authdb.MasterKeySource {
+	return authdb.StashOrPassword(stashPath, realm, func(isNew bool) (string, error) {
+		if isNew {
+			return utils.NewPassword("Choose the KDC master password: ")
+		}
+		return utils.Password("Enter the KDC master password: ")
+	})
+}
+
 func displayHelp() {
-	fmt.Println("\nUsage: kerb-as [-admin] [-db PATH] [-h HOST] [-p PORT] [-help]")
+	fmt.Println("\nUsage: kerb-as [-admin] [-db PATH] [-h HOST] [-p PORT] [-realm REALM] [-skew DURATION] [-max-life DURATION] [-max-renew DURATION] [-rotate PRINCIPAL [-grace DURATION]] [-export-keytab PRINCIPAL -keytab PATH] [-migrate [-dry-run]] [-stash PATH] [-reencrypt] [-acl PATH] [-rcache PATH] [-rcache-size N] [-help] [admin COMMAND ...]")
 	flag.PrintDefaults()
 	os.Exit(0)
 }
\ No newline at end of file
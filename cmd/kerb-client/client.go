@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,15 +12,31 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/khaugen7/kerberos-go/internal/ccache"
 	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kclient"
 	"github.com/khaugen7/kerberos-go/internal/kerb"
 	"github.com/khaugen7/kerberos-go/internal/utils"
 )
 
 var verbose bool
 var help bool
+var cachePath string
+var fileService string
+
+var (
+	etypesFlag string
+	etypes     []encryption.EType
+)
+
+var (
+	realm     string
+	realmTGSs string
+)
 
 var (
 	asHost  string
@@ -39,6 +57,11 @@ func parseFlags() {
 	flag.IntVar(&tgsPort, "tgsp", 8655, "Ticket granting server port")
 	flag.StringVar(&fsHost, "fsh", "127.0.0.1", "File server host")
 	flag.IntVar(&fsPort, "fsp", 8755, "File server port")
+	flag.StringVar(&fileService, "fss", kerb.DefaultFileService, "File server service principal")
+	flag.StringVar(&realm, "realm", kerb.DefaultRealm, "Realm of the user and of principals that name none")
+	flag.StringVar(&realmTGSs, "realm-tgs", "", "Ticket granting servers of other realms as REALM=HOST:PORT,...")
+	flag.StringVar(&etypesFlag, "etypes", encryption.FormatETypes(encryption.Supported()), "Encryption types to offer the KDC, as a comma separated list")
+	flag.StringVar(&cachePath, "cache", ccache.DefaultPath(), "Credential cache file (overrides $"+ccache.EnvVar+")")
 	flag.BoolVar(&verbose, "v", false, "Verbose logging")
 	flag.BoolVar(&help, "help", false, "Display help")
 	flag.Parse()
@@ -52,50 +75,170 @@ func main() {
 		os.Exit(0)
 	}
 
+	var err error
+	etypes, err = encryption.ParseETypes(etypesFlag)
+	if err != nil || len(etypes) == 0 {
+		log.Fatalf("Invalid -etypes %q, supported types are %s", etypesFlag, encryption.FormatETypes(encryption.Supported()))
+	}
+
 	if len(flag.Args()) == 0 {
-		log.Println("Missing requested filename!")
+		log.Println("Missing command!")
 		displayHelp()
 		os.Exit(1)
 	}
 
-	reqFile := flag.Arg(0)
-	asAddr, tgsAddr, fsAddr := buildUrls()
-
-	fmt.Println("Welcome to my Kerberos Authentication demo!")
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "kinit":
+		runKinit(args)
+	case "renew":
+		runRenew()
+	case "klist":
+		runKlist()
+	case "kdestroy":
+		runKdestroy()
+	case "passwd":
+		runPasswd()
+	case "get":
+		if len(args) == 0 {
+			log.Println("Missing requested filename!")
+			displayHelp()
+			os.Exit(1)
+		}
+		runGet(args[0])
+	default:
+		log.Printf("Unknown command %q", cmd)
+		displayHelp()
+		os.Exit(1)
+	}
+}
 
+// authenticate prompts for the user's credentials and obtains a TGT with the
+// requested options from the AS. A positive lifetime asks for a shorter TGT
+// than the AS would otherwise grant and a positive renewLifetime asks for a
+// renewable TGT. A service other than "" asks for a ticket for that service
+// instead, which the AS only issues for the password change service.
+func authenticate(asAddr string, service string, options kerb.TicketFlags, lifetime, renewLifetime time.Duration) ccache.Credential {
 	u, p, _ := utils.Credentials()
 
-	logVerbose("Requesting authentication for user " + u + " with Kerberos authentication server")
-	encTgsSessionKey, tgt := requestAuthorization(u, asAddr)
-	logVerbose("Success!")
+	client, err := kerb.ParsePrincipal(u, realm)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	userKey := encryption.DeriveSecretKey(u, p)
+	// The key's salt and parameters are only known to the AS, so the first
+	// request goes without pre-authentication to learn them
+	logVerbose("Requesting authentication for user " + client.String() + " with Kerberos authentication server")
+	encRepPart, tgt, params, err := requestAuthorization(client.String(), service, nil, options, lifetime, renewLifetime, asAddr)
+	userKey := params.StringToKey(p)
+	if errors.Is(err, kerb.ErrPreauthRequired) {
+		logVerbose("Pre-authentication required")
+		preauth, _ := encryption.EncryptWith(params.EType, userKey, kerb.KeyUsagePAEncTimestamp, kerb.PAEncTimestamp{Timestamp: time.Now()})
+		encRepPart, tgt, _, err = requestAuthorization(client.String(), service, preauth, options, lifetime, renewLifetime, asAddr)
+	}
+	if err != nil {
+		log.Fatal("Authentication Server: ", kclient.DescribeError(err))
+	}
+	logVerbose("Success!")
 
-	var tgsSessionKey []byte
-	err := encryption.Decrypt(userKey, encTgsSessionKey, &tgsSessionKey)
+	var repPart kerb.EncKDCRepPart
+	err = encryption.DecryptWith(params.EType, userKey, kerb.KeyUsageASRepPart, encRepPart, &repPart)
 	if err != nil {
 		log.Fatal("Invalid Password")
 	}
 
-	tgsAuth := generateAuth(u)
-	encTgsAuth, _ := encryption.Encrypt(tgsSessionKey, tgsAuth)
+	if service == "" {
+		return kclient.NewCredential(client.String(), ccache.TGTService, tgt, repPart)
+	}
+	if repPart.Service != service {
+		log.Fatalf("Authentication Server: expected a ticket for %s, got one for %s", service, repPart.Service)
+	}
+	return kclient.NewCredential(client.String(), service, tgt, repPart)
+}
+
+// getServiceTicket uses the TGT to obtain a ticket for service. A service in
+// another realm is reached by following the referral our TGS issues to that
+// realm's TGS. Referral tickets are kept in the cache so that later requests
+// for the same realm can skip our TGS.
+func getServiceTicket(cache *ccache.Cache, tgt ccache.Credential, service string, tgsAddr string) ccache.Credential {
+	servicePrincipal, err := kerb.ParsePrincipal(service, realm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := kerb.ParsePrincipal(tgt.Client, realm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if servicePrincipal.Realm != client.Realm {
+		referral := kerb.TGSPrincipal(servicePrincipal.Realm, client.Realm).String()
+		remoteTGT, ok := cache.Get(referral, time.Now())
+		if ok {
+			logVerbose("Using cached referral ticket for realm " + servicePrincipal.Realm)
+		} else {
+			remoteTGT = requestTicket(tgt, service, tgsAddr)
+			if remoteTGT.Service != referral {
+				log.Fatalf("Ticket Granting Server: expected a referral to realm %s, got a ticket for %s", servicePrincipal.Realm, remoteTGT.Service)
+			}
+			cache.Store(remoteTGT)
+		}
+
+		tgt = remoteTGT
+		tgsAddr = remoteTGSAddr(servicePrincipal.Realm)
+	}
 
+	st := requestTicket(tgt, service, tgsAddr)
+	if st.Service != service {
+		log.Fatalf("Ticket Granting Server: expected a ticket for %s, got one for %s", service, st.Service)
+	}
+	return st
+}
+
+// requestTicket uses the TGT to ask the TGS at tgsAddr for a ticket for
+// service. The ticket returned may be a referral for another realm's TGS.
+func requestTicket(tgt ccache.Credential, service string, tgsAddr string) ccache.Credential {
 	logVerbose("Requesting service ticket from ticket granting server")
-	encFsSessionKey, st := requestServiceTicket(encTgsAuth, tgt, tgsAddr)
+	st, err := kclient.RequestTicket(tgsAddr, tgt, service, etypes)
+	if err != nil {
+		log.Fatal("Ticket Granting Server: ", kclient.DescribeError(err))
+	}
 	logVerbose("Success!")
+	return st
+}
 
-	var fsSessionKey []byte
-	encryption.Decrypt(tgsSessionKey, encFsSessionKey, &fsSessionKey)
+// remoteTGSAddr looks up the TGS of another realm in the -realm-tgs list.
+func remoteTGSAddr(remote string) string {
+	for _, entry := range strings.Split(realmTGSs, ",") {
+		name, addr, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if found && name == remote {
+			return "http://" + addr
+		}
+	}
+	log.Fatalf("No ticket granting server known for realm %s, use -realm-tgs %s=HOST:PORT", remote, remote)
+	return ""
+}
 
-	fsAuth := generateAuth(u)
-	encFsAuth, _ := encryption.Encrypt(fsSessionKey, fsAuth)
+// renewTGT exchanges a renewable TGT for a new one with a fresh end time.
+func renewTGT(tgt ccache.Credential, tgsAddr string) (ccache.Credential, error) {
+	logVerbose("Requesting renewal of ticket-granting ticket")
+	renewed, err := kclient.RenewTGT(tgsAddr, tgt)
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+	logVerbose("Success!")
+	return renewed, nil
+}
 
-	logVerbose("Requesting file for download from file server")
-	file := requestFile(encFsAuth, st, reqFile, fsAddr)
-	fmt.Printf("Successfully authenticated via the Kerberos protocol and retrieved file %s", file)
+func saveCache(cache *ccache.Cache) {
+	if err := cache.Save(); err != nil {
+		log.Printf("Unable to save credential cache %s: %v", cache.Path(), err)
+	}
 }
 
-func requestAuthorization(username, asAddr string) ([]byte, []byte) {
+// requestAuthorization asks the AS for a TGT, or a ticket for service if it
+// is not "". Along with the reply it returns the parameters for deriving the
+// user's key, which the AS also sends when it answers that pre-authentication
+// is required. A rejected request returns the *kerb.KRBError the AS sent.
+func requestAuthorization(username string, service string, preauth []byte, options kerb.TicketFlags, lifetime, renewLifetime time.Duration, asAddr string) ([]byte, []byte, encryption.KeyParams, error) {
 	c := http.Client{
 		Timeout: time.Duration(5) * time.Second,
 	}
@@ -105,52 +248,90 @@ func requestAuthorization(username, asAddr string) ([]byte, []byte) {
 	}
 
 	req.Header.Set("X-Username", username)
+	if service != "" {
+		req.Header.Set("X-Service", service)
+	}
+	req.Header.Set("X-Preauth", hex.EncodeToString(preauth))
+	if lifetime > 0 {
+		req.Header.Set("X-Lifetime", lifetime.String())
+	}
+	if renewLifetime > 0 {
+		options |= kerb.FlagRenewable
+		req.Header.Set("X-Renewable-Lifetime", renewLifetime.String())
+	}
+	req.Header.Set("X-Kdc-Options", options.String())
+	req.Header.Set("X-Etypes", encryption.FormatETypes(etypes))
 
 	resp, err := c.Do(req)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	params, paramsErr := kerb.DecodeETypeInfo2(resp.Header.Get("X-Etype-Info2"))
+
 	if resp.StatusCode != 200 {
-		log.Fatalf("Authentication Server: HTTP request failed with status code %d", resp.StatusCode)
+		err := kerb.ReadError(resp)
+		if errors.Is(err, kerb.ErrPreauthRequired) && paramsErr != nil {
+			return nil, nil, params, errors.New("reply is missing the key parameters")
+		}
+		return nil, nil, params, err
+	}
+	if paramsErr != nil {
+		return nil, nil, params, errors.New("reply is missing the key parameters")
 	}
 
-	keyLen, _ := strconv.Atoi(resp.Header.Get("X-Key-Length"))
-	body, _ := ioutil.ReadAll(resp.Body)
-
-	return body[:keyLen], body[keyLen:]
+	repPart, ticket, err := kclient.SplitReply(resp, "authentication server")
+	return repPart, ticket, params, err
 }
 
-func requestServiceTicket(auth []byte, encTicket []byte, tgsAddr string) ([]byte, []byte) {
+// requestPasswordChange sends the new password to the AS with the ticket
+// for the password change service, and returns the AS's reply.
+func requestPasswordChange(st ccache.Credential, password string, asAddr string) (kadmin.Reply, error) {
 	c := http.Client{
 		Timeout: time.Duration(5) * time.Second,
 	}
 
-	body := append(encTicket, auth...)
+	encReq, err := encryption.EncryptWith(st.KeyType, st.SessionKey, kadmin.KeyUsagePasswdRequest, kadmin.PasswdRequest{NewPassword: password})
+	if err != nil {
+		return kadmin.Reply{}, err
+	}
+	auth := generateAuth(st.Client)
+	auth.Checksum, _ = encryption.Checksum(st.KeyType, st.SessionKey, kerb.KeyUsageAPReqChecksum, encReq)
+	encAuth, _ := encryption.EncryptWith(st.KeyType, st.SessionKey, kerb.KeyUsageAPReqAuth, auth)
 
-	req, err := http.NewRequest("GET", tgsAddr + "/ticket", bytes.NewReader(body))
+	body := append(append(append([]byte{}, st.Ticket...), encAuth...), encReq...)
+
+	req, err := http.NewRequest(http.MethodPost, asAddr+kadmin.PasswdPath, bytes.NewReader(body))
 	if err != nil {
-		log.Fatal(err)
+		return kadmin.Reply{}, err
 	}
 
-	req.Header.Set("X-Ticket-Length", strconv.Itoa(len(encTicket)))
+	req.Header.Set("X-Ticket-Length", strconv.Itoa(len(st.Ticket)))
+	req.Header.Set("X-Auth-Length", strconv.Itoa(len(encAuth)))
 
 	resp, err := c.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return kadmin.Reply{}, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		log.Fatalf("Ticket Granting Server: HTTP request failed with status code %d", resp.StatusCode)
+		return kadmin.Reply{}, kerb.ReadError(resp)
 	}
 
-	keyLen, _ := strconv.Atoi(resp.Header.Get("X-Key-Length"))
-	resBody, _ := ioutil.ReadAll(resp.Body)
+	if err := kclient.VerifyServer(resp.Header.Get("X-Ap-Rep"), auth, st.KeyType, st.SessionKey); err != nil {
+		return kadmin.Reply{}, err
+	}
 
-	return resBody[:keyLen], resBody[keyLen:]
+	resBody, _ := ioutil.ReadAll(resp.Body)
+	var reply kadmin.Reply
+	if err := encryption.DecryptWith(st.KeyType, st.SessionKey, kadmin.KeyUsagePasswdReply, resBody, &reply); err != nil {
+		return kadmin.Reply{}, errors.New("failed to decrypt reply from authentication server")
+	}
+	return reply, nil
 }
 
-func requestFile(auth []byte, encTicket []byte, reqFile string, fsAddr string) string {
+func requestFile(auth []byte, encTicket []byte, sentAuth kerb.Autheticator, keyType encryption.EType, sessionKey []byte, reqFile string, fsAddr string) string {
 	c := http.Client{
 		Timeout: time.Duration(5) * time.Second,
 	}
@@ -170,8 +351,13 @@ func requestFile(auth []byte, encTicket []byte, reqFile string, fsAddr string) s
 	}
 
 	if resp.StatusCode != 200 {
-		log.Fatalf("File Server: HTTP request failed with status code %d", resp.StatusCode)
+		log.Fatal("File Server: ", kclient.DescribeError(kerb.ReadError(resp)))
+	}
+
+	if err := kclient.VerifyServer(resp.Header.Get("X-Ap-Rep"), sentAuth, keyType, sessionKey); err != nil {
+		log.Fatal("File Server: ", err)
 	}
+	logVerbose("File server authenticated")
 
 	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
 	filename := params["filename"]
@@ -209,7 +395,13 @@ func logVerbose(msg string) {
 }
 
 func displayHelp() {
-	fmt.Println("\nUsage: kerb-client [-ash HOST] [-asp PORT] [-ash HOST] [-asp PORT] [-ash HOST] [-asp PORT] [-v verbose] [-help] filename")
+	fmt.Println("\nUsage: kerb-client [-ash HOST] [-asp PORT] [-tgsh HOST] [-tgsp PORT] [-fsh HOST] [-fsp PORT] [-fss PRINCIPAL] [-realm REALM] [-realm-tgs REALM=HOST:PORT,...] [-etypes LIST] [-cache PATH] [-v verbose] [-help] COMMAND")
 	flag.PrintDefaults()
-	fmt.Println("filename string\n\tFilename to request from the server")
+	fmt.Println("Commands:")
+	fmt.Println("  kinit [-f] [-p] [-l DURATION] [-r DURATION]\n\tObtain a ticket-granting ticket and store it in the credential cache, optionally forwardable, proxiable, valid for -l DURATION or renewable for -r DURATION")
+	fmt.Println("  renew\n\tRenew the cached ticket-granting ticket without entering a password")
+	fmt.Println("  klist\n\tList the tickets in the credential cache")
+	fmt.Println("  kdestroy\n\tDestroy the credential cache")
+	fmt.Println("  passwd\n\tChange your password, entering the current one first")
+	fmt.Println("  get filename\n\tRequest filename from the file server")
 }
\ No newline at end of file
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/ccache"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kadmin"
+	"github.com/khaugen7/kerberos-go/internal/kclient"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/utils"
+)
+
+func loadCache() *ccache.Cache {
+	cache, err := ccache.Load(cachePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cache
+}
+
+// renewThreshold is how close to expiry a renewable TGT must be before it
+// is renewed automatically.
+const renewThreshold = 10 * time.Minute
+
+// runKinit always prompts for credentials and replaces any cached TGT.
+func runKinit(args []string) {
+	fs := flag.NewFlagSet("kinit", flag.ExitOnError)
+	forwardable := fs.Bool("f", false, "Request a forwardable TGT")
+	proxiable := fs.Bool("p", false, "Request a proxiable TGT")
+	lifetime := fs.Duration("l", 0, "Request a TGT with this lifetime instead of the AS maximum")
+	renewLifetime := fs.Duration("r", 0, "Request a renewable TGT that can be renewed for this long")
+	fs.Parse(args)
+
+	var options kerb.TicketFlags
+	if *forwardable {
+		options |= kerb.FlagForwardable
+	}
+	if *proxiable {
+		options |= kerb.FlagProxiable
+	}
+
+	asAddr, _, _ := buildUrls()
+	cache := loadCache()
+
+	tgt := authenticate(asAddr, "", options, *lifetime, *renewLifetime)
+	cache.Initialize(tgt)
+	if err := cache.Save(); err != nil {
+		log.Fatalf("Unable to save credential cache %s: %v", cache.Path(), err)
+	}
+	printTGT(tgt)
+}
+
+// runRenew renews the cached TGT without asking for the password.
+func runRenew() {
+	_, tgsAddr, _ := buildUrls()
+	cache := loadCache()
+
+	tgt, ok := cache.TGT(time.Now())
+	if !ok {
+		log.Fatal("No valid ticket-granting ticket to renew, run kinit first")
+	}
+	if !tgt.Renewable(time.Now()) {
+		log.Fatal("Ticket-granting ticket is not renewable, run kinit -r to obtain one that is")
+	}
+
+	renewed, err := renewTGT(tgt, tgsAddr)
+	if err != nil {
+		log.Fatal("Ticket Granting Server: ", kclient.DescribeError(err))
+	}
+	cache.Initialize(renewed)
+	if err := cache.Save(); err != nil {
+		log.Fatalf("Unable to save credential cache %s: %v", cache.Path(), err)
+	}
+	printTGT(renewed)
+}
+
+func printTGT(tgt ccache.Credential) {
+	fmt.Printf("Ticket-granting ticket for %s valid until %s\n", tgt.Client, tgt.Validity.Format(time.RFC1123))
+	if !tgt.RenewTill.IsZero() {
+		fmt.Printf("Renewable until %s\n", tgt.RenewTill.Format(time.RFC1123))
+	}
+	fmt.Printf("Flags: %s\n", tgt.Flags)
+}
+
+// currentTGT returns a usable TGT, renewing the cached one if it is about to
+// expire and only prompting for credentials if there is none.
+func currentTGT(cache *ccache.Cache, asAddr, tgsAddr string) ccache.Credential {
+	now := time.Now()
+	tgt, ok := cache.TGT(now)
+	if !ok {
+		tgt = authenticate(asAddr, "", 0, 0, 0)
+		cache.Initialize(tgt)
+		saveCache(cache)
+		return tgt
+	}
+
+	logVerbose("Using cached ticket-granting ticket for user " + tgt.Client)
+	if tgt.Validity.Sub(now) < renewThreshold && tgt.Renewable(now) {
+		renewed, err := renewTGT(tgt, tgsAddr)
+		if err != nil {
+			logVerbose("Renewal failed: " + kclient.DescribeError(err))
+			return tgt
+		}
+		cache.Initialize(renewed)
+		saveCache(cache)
+		return renewed
+	}
+	return tgt
+}
+
+// runPasswd changes the user's password. The ticket it needs only comes
+// from the AS, so the current password is asked for even if there is a
+// cached TGT, which stays valid afterwards.
+func runPasswd() {
+	asAddr, _, _ := buildUrls()
+
+	service := kerb.QualifyPrincipal(kerb.ChangePwService, realm)
+	st := authenticate(asAddr, service, 0, 0, 0)
+	fmt.Println()
+
+	password, err := utils.NewPassword(fmt.Sprintf("Enter new password for %s: ", st.Client))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logVerbose("Sending new password to authentication server")
+	reply, err := requestPasswordChange(st, password, asAddr)
+	if err != nil {
+		log.Fatal("Authentication Server: ", kclient.DescribeError(err))
+	}
+	if reply.Status != kadmin.StatusOK {
+		log.Fatal("Password not changed: ", reply.Message)
+	}
+	fmt.Println("Password changed")
+}
+
+func runKlist() {
+	cache := loadCache()
+	if cache.Principal == "" {
+		fmt.Printf("No credentials cache found (cache: %s)\n", cache.Path())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Credentials cache: %s\n", cache.Path())
+	fmt.Printf("Principal: %s\n\n", cache.Principal)
+
+	creds := make([]ccache.Credential, 0, len(cache.Credentials))
+	for _, cred := range cache.Credentials {
+		creds = append(creds, cred)
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].Validity.Before(creds[j].Validity) })
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Expires\tRenew until\tFlags\tPrincipal\tService")
+	for _, cred := range creds {
+		expires := cred.Validity.Format("2006-01-02 15:04:05")
+		if !now.Before(cred.Validity) {
+			expires += " (expired)"
+		}
+		renewTill := "-"
+		if !cred.RenewTill.IsZero() {
+			renewTill = cred.RenewTill.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", expires, renewTill, cred.Flags.Letters(), cred.Client, cred.Service)
+	}
+	w.Flush()
+}
+
+func runKdestroy() {
+	cache := loadCache()
+	if err := cache.Destroy(); err != nil {
+		log.Fatalf("Unable to destroy credential cache %s: %v", cache.Path(), err)
+	}
+	logVerbose("Destroyed credential cache " + cache.Path())
+}
+
+// runGet downloads reqFile from the file server, using cached tickets where
+// possible and only prompting for credentials when there is no valid TGT.
+func runGet(reqFile string) {
+	asAddr, tgsAddr, fsAddr := buildUrls()
+
+	fmt.Println("Welcome to my Kerberos Authentication demo!")
+
+	cache := loadCache()
+
+	tgt := currentTGT(cache, asAddr, tgsAddr)
+
+	service := kerb.QualifyPrincipal(fileService, realm)
+	st, ok := cache.Get(service, time.Now())
+	if ok {
+		logVerbose("Using cached service ticket for " + service)
+	} else {
+		st = getServiceTicket(cache, tgt, service, tgsAddr)
+		cache.Store(st)
+		saveCache(cache)
+	}
+
+	fsAuth := generateAuth(st.Client)
+	encFsAuth, _ := encryption.EncryptWith(st.KeyType, st.SessionKey, kerb.KeyUsageAPReqAuth, fsAuth)
+
+	logVerbose("Requesting file for download from file server")
+	file := requestFile(encFsAuth, st.Ticket, fsAuth, st.KeyType, st.SessionKey, reqFile, fsAddr)
+	fmt.Printf("Successfully authenticated via the Kerberos protocol and retrieved file %s", file)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/hex"
 	"errors"
 	"path/filepath"
@@ -13,26 +13,55 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/khaugen7/kerberos-go/internal/authdb"
 	"github.com/khaugen7/kerberos-go/internal/encryption"
 	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/keytab"
+	"github.com/khaugen7/kerberos-go/internal/replay"
 	"github.com/khaugen7/kerberos-go/internal/utils"
 )
 
 var sqlitePath string
-var db *sql.DB
+var store authdb.PrincipalStore
+var keytabPath string
+var keytabs *keytab.Reloader
+var stashPath string
 var help bool
 
+var servicePrincipal string
+
+var (
+	rcachePath string
+	rcacheSize int
+	rcache     *replay.Cache
+)
+
+var (
+	realm string
+	host  string
+	port  int
+)
+
 var (
-	host string
-	port int
+	skew      time.Duration
+	clock     kerb.Clock = kerb.SystemClock{}
+	validator kerb.Validator
 )
 
 func parseFlags() {
 	flag.StringVar(&sqlitePath, "db", "", "Directory for Sqlite db")
+	flag.StringVar(&keytabPath, "keytab", "", "Keytab to read the service key from instead of the Sqlite db")
+	flag.StringVar(&realm, "realm", kerb.DefaultRealm, "Realm the service principal belongs to if it names none")
 	flag.StringVar(&host, "h", "127.0.0.1", "Server host")
 	flag.IntVar(&port, "p", 8755, "Server port")
+	flag.StringVar(&servicePrincipal, "service", kerb.DefaultFileService, "Service principal this server is registered as")
+	flag.DurationVar(&skew, "skew", kerb.DefaultSkew, "Maximum clock skew tolerated for client authenticators")
+	flag.StringVar(&rcachePath, "rcache", "", "File to persist the replay cache in (default in-memory only)")
+	flag.IntVar(&rcacheSize, "rcache-size", replay.DefaultMaxEntries, "Maximum number of authenticators held in the replay cache")
+	flag.StringVar(&stashPath, "stash", "", "Stash file holding the master key (default .k5.REALM next to the db)")
 	flag.BoolVar(&help, "help", false, "Display help")
 	flag.Parse()
 }
@@ -45,12 +74,57 @@ func main() {
 	}
 
 	addr := host + ":" + strconv.Itoa(port)
-	db = authdb.SqliteConnect(sqlitePath)
+	if keytabPath != "" {
+		var err error
+		keytabs, err = keytab.NewReloader(keytabPath)
+		if err != nil {
+			log.Fatal("Unable to read keytab:", err)
+		}
+		keytabs.ReloadOnSignal(syscall.SIGHUP)
+	} else {
+		var err error
+		if stashPath == "" {
+			stashPath = authdb.DefaultStashPath(sqlitePath, realm)
+		}
+		store, err = authdb.SqliteConnect(context.Background(), sqlitePath, authdb.StashOrPassword(stashPath, realm, func(bool) (string, error) {
+			return utils.Password("Enter the KDC master password: ")
+		}))
+		if errors.Is(err, authdb.ErrNoMasterKey) {
+			log.Fatal(err, "; start kerb-as to create one")
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	servicePrincipal = kerb.QualifyPrincipal(servicePrincipal, realm)
+	// Errors name the realm the service belongs to
+	if p, err := kerb.ParsePrincipal(servicePrincipal, realm); err == nil {
+		realm = p.Realm
+	}
+	if _, err := findService(context.Background()); errors.Is(err, authdb.ErrServiceNotFound) {
+		if keytabPath != "" {
+			log.Fatalf("Keytab %s holds no key for %s", keytabPath, servicePrincipal)
+		}
+		log.Fatalf("Service principal %s is not registered", servicePrincipal)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	validator = kerb.Validator{Clock: clock, Skew: skew}
+
+	var err error
+	rcache, err = replay.Open(rcachePath, rcacheSize)
+	if err != nil {
+		log.Fatal("Unable to open replay cache:", err)
+	}
+	defer rcache.Close()
+	stopSweeper := rcache.StartSweeper(time.Minute, func(err error) { log.Print("Replay cache sweep failed:", err) })
+	defer stopSweeper()
 
 	http.HandleFunc("/download/", handleDownload)
 
 	log.Printf("Server listening at %s", addr)
-	err := http.ListenAndServe(addr, nil)
+	err = http.ListenAndServe(addr, nil)
 
 	if errors.Is(err, http.ErrServerClosed) {
 		log.Printf("Server closed.")
@@ -63,35 +137,75 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	tickLen, _ := strconv.Atoi(r.Header.Get("X-Ticket-Length"))
 	if tickLen == 0 {
 		w.Header().Set("X-Missing-Field", "X-Ticket-Length")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, kerb.MissingField("X-Ticket-Length"))
 		return
 	}
 
 	content, _ := ioutil.ReadAll(r.Body)
+	if tickLen < 0 || tickLen > len(content) {
+		writeError(w, kerb.ErrBadRequest)
+		return
+	}
 	encTicket, encAuth := content[:tickLen], content[tickLen:]
 
-	tgsFsKey, _ := hex.DecodeString(authdb.GetSharedKey("tgs-fs", db))
+	sealed, err := kerb.OpenSealedTicket(encTicket)
+	if err != nil {
+		writeError(w, kerb.ErrBadRequest)
+		return
+	}
+	if sealed.Service != servicePrincipal {
+		log.Printf("Received ticket for %s instead of %s", sealed.Service, servicePrincipal)
+		writeError(w, kerb.ErrServiceUnknown)
+		return
+	}
 
-	var ticket kerb.Ticket
-	err := encryption.Decrypt(tgsFsKey, encTicket, &ticket)
+	// Keys are looked up for every request so that a rotated key is picked
+	// up without a restart
+	serviceKey, err := findServiceKey(r.Context(), sealed.Kvno)
+	if errors.Is(err, authdb.ErrNoKey) {
+		log.Printf("Received ticket sealed with unknown or expired key version %d", sealed.Kvno)
+		writeError(w, kerb.ErrBadKeyVersion)
+		return
+	} else if err != nil {
+		log.Print("Unable to look up service key: ", err)
+		writeError(w, kerb.ErrUnavailable)
+		return
+	}
+
+	ticket, err := sealed.Decrypt(serviceKey.Key)
 	if err != nil {
 		log.Print("Failed to decrypt ticket")
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(w, kerb.ErrBadIntegrity)
 		return
 	}
 
 	clientSessionKey := ticket.SessionKey
 
 	var auth kerb.Autheticator
-	err = encryption.Decrypt(clientSessionKey, encAuth, &auth)
+	err = encryption.DecryptWith(ticket.SessionKeyType, clientSessionKey, kerb.KeyUsageAPReqAuth, encAuth, &auth)
 	if err != nil {
 		log.Printf("Failed to decrypt client authenticator for user %s", ticket.Username)
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(w, kerb.ErrBadIntegrity)
 		return
 	}
 
-	if !kerb.ValidateClient(auth, ticket) {
-		w.WriteHeader(http.StatusUnauthorized)
+	err = validator.Validate(auth, ticket)
+	if err != nil {
+		log.Printf("Rejected authenticator for user %s: %v", ticket.Username, err)
+		writeError(w, err)
+		return
+	}
+
+	// Authenticators outside the skew window are rejected above, so the
+	// replay cache only needs to remember them for that long
+	err = rcache.Check(auth.Username, auth.Timestamp, encAuth, auth.Timestamp.Add(validator.Skew))
+	if errors.Is(err, replay.ErrReplay) {
+		log.Printf("Rejected replayed authenticator for user %s", auth.Username)
+		writeError(w, kerb.ErrReplay)
+		return
+	} else if err != nil {
+		log.Print("Replay cache error:", err)
+		writeError(w, kerb.ErrUnavailable)
 		return
 	}
 
@@ -100,7 +214,7 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	reqFile = "./files/" + reqFile
 
 	if !utils.FileExists(reqFile) {
-		w.WriteHeader(http.StatusNotFound)
+		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
@@ -110,13 +224,60 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Prove to the client that we could read its authenticator
+	apRep, err := encryption.EncryptWith(ticket.SessionKeyType, clientSessionKey, kerb.KeyUsageAPRepPart, kerb.NewAPRep(auth))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Ap-Rep", hex.EncodeToString(apRep))
 	w.Header().Set("Content-Disposition", "attachment; filename=" + filepath.Base(reqFile))
 	w.Write(b)
 }
 
+// findServiceKey returns version kvno of our long-term key, or
+// authdb.ErrNoKey if we have no such version or it has expired.
+func findServiceKey(ctx context.Context, kvno int) (kerb.ServiceKey, error) {
+	service, err := findService(ctx)
+	if errors.Is(err, authdb.ErrServiceNotFound) {
+		return kerb.ServiceKey{}, authdb.ErrNoKey
+	} else if err != nil {
+		return kerb.ServiceKey{}, err
+	}
+	key, ok := service.KeyByVersion(kvno, clock.Now())
+	if !ok {
+		return kerb.ServiceKey{}, authdb.ErrNoKey
+	}
+	return key.ServiceKey(), nil
+}
+
+// findService returns every version of our long-term key, from the keytab
+// if we have one.
+func findService(ctx context.Context) (authdb.ServicePrincipal, error) {
+	if keytabPath != "" {
+		kt, err := keytabs.Keytab()
+		if err != nil {
+			return authdb.ServicePrincipal{}, err
+		}
+		service, ok := authdb.KeytabPrincipal(servicePrincipal, kt)
+		if !ok {
+			return authdb.ServicePrincipal{}, authdb.ErrServiceNotFound
+		}
+		return service, nil
+	}
+
+	return store.GetServiceByPrincipal(ctx, servicePrincipal)
+}
+
+// writeError sends err to the client as a KRB-ERROR from our realm.
+func writeError(w http.ResponseWriter, err error) {
+	kerb.WriteError(w, err, realm, clock.Now())
+}
+
 func displayHelp() {
-	fmt.Println("\nUsage: kerb-fs [-db PATH] [-h HOST] [-p PORT] [-help]")
+	fmt.Println("\nUsage: kerb-fs [-db PATH [-stash PATH] | -keytab PATH] [-h HOST] [-p PORT] [-realm REALM] [-service PRINCIPAL] [-rcache PATH] [-rcache-size N] [-skew DURATION] [-help]")
 	flag.PrintDefaults()
 	os.Exit(0)
 }
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/hex"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -11,25 +10,57 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/khaugen7/kerberos-go/internal/authdb"
 	"github.com/khaugen7/kerberos-go/internal/encryption"
 	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/keytab"
+	"github.com/khaugen7/kerberos-go/internal/replay"
+	"github.com/khaugen7/kerberos-go/internal/utils"
 )
 
 var sqlitePath string
-var db *sql.DB
+var store authdb.PrincipalStore
+var keytabPath string
+var keytabs *keytab.Reloader
+var stashPath string
 var help bool
 
 var (
-	host string
-	port int
+	rcachePath string
+	rcacheSize int
+	rcache     *replay.Cache
+)
+
+var (
+	realm string
+	host  string
+	port  int
+)
+
+var (
+	skew             time.Duration
+	maxLifetime      time.Duration
+	maxRenewLifetime time.Duration
+	clock            kerb.Clock = kerb.SystemClock{}
+	validator        kerb.Validator
+	policy           kerb.Policy
 )
 
 func parseFlags() {
 	flag.StringVar(&sqlitePath, "db", "", "Directory for Sqlite db")
+	flag.StringVar(&keytabPath, "keytab", "", "Keytab to read keys from instead of the Sqlite db")
+	flag.StringVar(&realm, "realm", kerb.DefaultRealm, "Realm served by this KDC")
 	flag.StringVar(&host, "h", "127.0.0.1", "Server host")
 	flag.IntVar(&port, "p", 8655, "Server port")
+	flag.DurationVar(&skew, "skew", kerb.DefaultSkew, "Maximum clock skew tolerated for client authenticators")
+	flag.DurationVar(&maxLifetime, "max-life", kerb.DefaultLifetime, "Maximum lifetime granted to service tickets and renewed TGTs")
+	flag.DurationVar(&maxRenewLifetime, "max-renew", kerb.DefaultMaxRenewableLifetime, "Maximum renewable lifetime granted to referral tickets for other realms (0 disables renewal)")
+	flag.StringVar(&rcachePath, "rcache", "", "File to persist the replay cache in (default in-memory only)")
+	flag.IntVar(&rcacheSize, "rcache-size", replay.DefaultMaxEntries, "Maximum number of authenticators held in the replay cache")
+	flag.StringVar(&stashPath, "stash", "", "Stash file holding the master key (default .k5.REALM next to the db)")
 	flag.BoolVar(&help, "help", false, "Display help")
 	flag.Parse()
 }
@@ -42,12 +73,44 @@ func main() {
 	}
 	
 	addr := host + ":" + strconv.Itoa(port)
-	db = authdb.SqliteConnect(sqlitePath)
+	if keytabPath != "" {
+		var err error
+		keytabs, err = keytab.NewReloader(keytabPath)
+		if err != nil {
+			log.Fatal("Unable to read keytab:", err)
+		}
+		keytabs.ReloadOnSignal(syscall.SIGHUP)
+	} else {
+		var err error
+		if stashPath == "" {
+			stashPath = authdb.DefaultStashPath(sqlitePath, realm)
+		}
+		store, err = authdb.SqliteConnect(context.Background(), sqlitePath, authdb.StashOrPassword(stashPath, realm, func(bool) (string, error) {
+			return utils.Password("Enter the KDC master password: ")
+		}))
+		if errors.Is(err, authdb.ErrNoMasterKey) {
+			log.Fatal(err, "; start kerb-as to create one")
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+	validator = kerb.Validator{Clock: clock, Skew: skew}
+	policy = kerb.Policy{MaxLifetime: maxLifetime, MaxRenewableLifetime: maxRenewLifetime}
+
+	var err error
+	rcache, err = replay.Open(rcachePath, rcacheSize)
+	if err != nil {
+		log.Fatal("Unable to open replay cache:", err)
+	}
+	defer rcache.Close()
+	stopSweeper := rcache.StartSweeper(time.Minute, func(err error) { log.Print("Replay cache sweep failed:", err) })
+	defer stopSweeper()
 
 	http.HandleFunc("/ticket", handleTicket)
+	http.HandleFunc("/renew", handleRenew)
 
 	log.Printf("Server listening at %s", addr)
-	err := http.ListenAndServe(addr, nil)
+	err = http.ListenAndServe(addr, nil)
 
 	if errors.Is(err, http.ErrServerClosed) {
 		log.Printf("Server closed.")
@@ -57,52 +120,287 @@ func main() {
 }
 
 func handleTicket(w http.ResponseWriter, r *http.Request) {
+	service := r.Header.Get("X-Service")
+	if service == "" {
+		w.Header().Set("X-Missing-Field", "X-Service")
+		writeError(w, kerb.MissingField("X-Service"))
+		return
+	}
+	servicePrincipal, err := kerb.ParsePrincipal(service, realm)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	service = servicePrincipal.String()
+
+	options, err := kerb.ParseTicketFlags(r.Header.Get("X-Kdc-Options"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	offered, err := etypesHeader(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tgt, auth, issuer, ok := authenticateTGT(w, r)
+	if !ok {
+		return
+	}
+
+	// A service in another realm is reached through a referral ticket for
+	// that realm's TGS, sealed with the key we share with it
+	issued := service
+	if servicePrincipal.Realm != realm {
+		if issuer.Realm != realm {
+			// Only direct trust is supported, so a referral may not be
+			// used to obtain another referral
+			log.Printf("User %s from realm %s requested a ticket for realm %s", auth.Username, issuer.Realm, servicePrincipal.Realm)
+			writeError(w, kerb.ErrNoTrust)
+			return
+		}
+		issued = kerb.TGSPrincipal(servicePrincipal.Realm, realm).String()
+	}
+
+	var serviceKey authdb.KeyVersion
+	found, err := findService(r.Context(), issued)
+	if err == nil {
+		serviceKey, ok = found.CurrentKey()
+	}
+	if err != nil && !errors.Is(err, authdb.ErrServiceNotFound) {
+		log.Print("Unable to look up service key: ", err)
+		writeError(w, kerb.ErrUnavailable)
+		return
+	}
+	if err != nil || !ok {
+		log.Printf("User %s requested a ticket for unknown service %s", auth.Username, issued)
+		if issued != service {
+			writeError(w, kerb.ErrNoTrust)
+		} else {
+			writeError(w, kerb.ErrServiceUnknown)
+		}
+		return
+	}
+
+	// The session key must be usable by the service as well as the client,
+	// which we judge by the type of the key it registered
+	sessionKeyType, err := encryption.Negotiate(offered, []encryption.EType{serviceKey.EType})
+	if err != nil {
+		log.Printf("User %s offered no encryption type supported by %s", auth.Username, issued)
+		writeError(w, kerb.ErrETypeNoSupport)
+		return
+	}
+
+	now := clock.Now()
+	req := kerb.TicketRequest{Username: auth.Username, SessionKeyType: sessionKeyType, Options: options}
+	req.SetLifetimes(now, durationHeader(r, "X-Lifetime"), durationHeader(r, "X-Renewable-Lifetime"))
+
+	// Only tickets for a TGS can be renewed, since /renew only accepts
+	// tickets it can decrypt, so service tickets are never renewable
+	if !servicePrincipal.IsTGS() {
+		req.Options &^= kerb.FlagRenewable
+		req.RenewTill = time.Time{}
+	}
+
+	// The service ticket may not outlive the TGT it was derived from
+	serviceTicket, err := kerb.IssueTicket(req, now, policy, &tgt)
+	if err != nil {
+		log.Printf("Refused to issue ticket for user %s: %v", auth.Username, err)
+		writeError(w, err)
+		return
+	}
+
+	// Encrypt Service Ticket with the current version of the requested
+	// service's long-term key
+	writeReply(w, tgt, serviceTicket, issued, serviceKey.ServiceKey())
+}
+
+func handleRenew(w http.ResponseWriter, r *http.Request) {
+	tgt, auth, issuer, ok := authenticateTGT(w, r)
+	if !ok {
+		return
+	}
+
+	renewed, err := kerb.RenewTicket(tgt, clock.Now(), policy)
+	if err != nil {
+		log.Printf("Refused to renew TGT for user %s: %v", auth.Username, err)
+		writeError(w, err)
+		return
+	}
+
+	// The renewed TGT is encrypted for the same TGS as the original, with
+	// the current version of its key
+	tgs, err := tgsPrincipal(r.Context(), issuer)
+	if err != nil {
+		log.Printf("Unable to look up the key of %s: %v", issuer, err)
+		writeError(w, kerb.ErrUnavailable)
+		return
+	}
+	key, ok := tgs.CurrentKey()
+	if !ok {
+		log.Printf("Refused to renew TGT for user %s: %s has no current key", auth.Username, issuer)
+		writeError(w, kerb.ErrServiceUnknown)
+		return
+	}
+	writeReply(w, tgt, renewed, issuer.String(), key.ServiceKey())
+}
+
+// authenticateTGT decrypts the TGT and authenticator sent in the request body
+// and checks that the authenticator is valid and has not been seen before.
+// The TGT may be our own or a referral from a realm that trusts us; the TGS
+// principal it was issued for is returned alongside it. On failure it writes
+// the error response and returns false.
+func authenticateTGT(w http.ResponseWriter, r *http.Request) (kerb.Ticket, kerb.Autheticator, kerb.Principal, bool) {
+	var ticket kerb.Ticket
+	var auth kerb.Autheticator
+	var issuer kerb.Principal
+
 	tickLen, _ := strconv.Atoi(r.Header.Get("X-Ticket-Length"))
 	if tickLen == 0 {
 		w.Header().Set("X-Missing-Field", "X-Ticket-Length")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		writeError(w, kerb.MissingField("X-Ticket-Length"))
+		return ticket, auth, issuer, false
 	}
 
 	content, _ := ioutil.ReadAll(r.Body)
+	if tickLen < 0 || tickLen > len(content) {
+		writeError(w, kerb.ErrBadRequest)
+		return ticket, auth, issuer, false
+	}
 	encTicket, encAuth := content[:tickLen], content[tickLen:]
 
-	asTgsKey, _ := hex.DecodeString(authdb.GetSharedKey("as-tgs", db))
+	sealed, err := kerb.OpenSealedTicket(encTicket)
+	if err != nil {
+		writeError(w, kerb.ErrBadRequest)
+		return ticket, auth, issuer, false
+	}
 
-	var ticket kerb.Ticket
-	err := encryption.Decrypt(asTgsKey, encTicket, &ticket)
+	issuer, err = kerb.ParsePrincipal(sealed.Service, realm)
+	var tgs authdb.ServicePrincipal
+	if err == nil {
+		tgs, err = tgsPrincipal(r.Context(), issuer)
+	}
+	if errors.Is(err, kerb.ErrBadPrincipal) || errors.Is(err, authdb.ErrServiceNotFound) {
+		log.Printf("Received ticket for %s which is not a TGS we hold a key for", sealed.Service)
+		writeError(w, kerb.ErrServiceUnknown)
+		return ticket, auth, issuer, false
+	} else if err != nil {
+		log.Printf("Unable to look up the key of %s: %v", sealed.Service, err)
+		writeError(w, kerb.ErrUnavailable)
+		return ticket, auth, issuer, false
+	}
+
+	key, ok := tgs.KeyByVersion(sealed.Kvno, clock.Now())
+	if !ok {
+		log.Printf("Received ticket for %s sealed with unknown or expired key version %d", sealed.Service, sealed.Kvno)
+		writeError(w, kerb.ErrBadKeyVersion)
+		return ticket, auth, issuer, false
+	}
+
+	ticket, err = sealed.Decrypt(key.ServiceKey().Key)
 	if err != nil {
 		log.Print("Failed to decrypt ticket")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+		writeError(w, kerb.ErrBadIntegrity)
+		return ticket, auth, issuer, false
 	}
 
-	clientSessionKey := ticket.SessionKey
+	// A realm may only vouch for its own users
+	client, err := kerb.ParsePrincipal(ticket.Username, realm)
+	if err != nil || client.Realm != issuer.Realm {
+		log.Printf("Rejected ticket for %s issued by realm %s", ticket.Username, issuer.Realm)
+		writeError(w, kerb.ErrWrongRealm)
+		return ticket, auth, issuer, false
+	}
 
-	var auth kerb.Autheticator
-	err = encryption.Decrypt(clientSessionKey, encAuth, &auth)
+	err = encryption.DecryptWith(ticket.SessionKeyType, ticket.SessionKey, kerb.KeyUsageTGSReqAuth, encAuth, &auth)
 	if err != nil {
 		log.Printf("Failed to decrypt client authenticator for user %s", ticket.Username)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+		writeError(w, kerb.ErrBadIntegrity)
+		return ticket, auth, issuer, false
 	}
 
-	if !kerb.ValidateClient(auth, ticket) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	// The checksum binds the authenticator to the rest of this request
+	checksumData := kerb.TGSReqChecksumData(r.Header.Get("X-Service"), r.Header.Get("X-Kdc-Options"),
+		r.Header.Get("X-Lifetime"), r.Header.Get("X-Renewable-Lifetime"), r.Header.Get("X-Etypes"))
+	err = encryption.VerifyChecksum(ticket.SessionKeyType, ticket.SessionKey, kerb.KeyUsageTGSReqChecksum, checksumData, auth.Checksum)
+	if err != nil {
+		log.Printf("Rejected request from user %s with a bad checksum", ticket.Username)
+		writeError(w, kerb.ErrBadChecksum)
+		return ticket, auth, issuer, false
+	}
+
+	err = validator.Validate(auth, ticket)
+	if err != nil {
+		log.Printf("Rejected authenticator for user %s: %v", ticket.Username, err)
+		writeError(w, err)
+		return ticket, auth, issuer, false
+	}
+
+	// Authenticators outside the skew window are rejected above, so the
+	// replay cache only needs to remember them for that long
+	err = rcache.Check(auth.Username, auth.Timestamp, encAuth, auth.Timestamp.Add(validator.Skew))
+	if errors.Is(err, replay.ErrReplay) {
+		log.Printf("Rejected replayed authenticator for user %s", auth.Username)
+		writeError(w, kerb.ErrReplay)
+		return ticket, auth, issuer, false
+	} else if err != nil {
+		log.Print("Replay cache error:", err)
+		writeError(w, kerb.ErrUnavailable)
+		return ticket, auth, issuer, false
+	}
+
+	return ticket, auth, issuer, true
+}
+
+// tgsPrincipal returns the keys that decrypt TGTs issued for principal: the
+// AS-TGS key for our own krbtgt/REALM@REALM, or the key shared with another
+// realm for referrals it issues to us. It returns authdb.ErrServiceNotFound
+// for any other principal.
+func tgsPrincipal(ctx context.Context, principal kerb.Principal) (authdb.ServicePrincipal, error) {
+	if !principal.IsTGS() || principal.Instance != realm {
+		return authdb.ServicePrincipal{}, authdb.ErrServiceNotFound
+	}
+
+	if principal.Realm == realm && keytabPath == "" {
+		keys, err := store.FindSharedKeys(ctx, "as-tgs")
+		return authdb.ServicePrincipal{Principal: principal.String(), Keys: keys}, err
+	}
+	return findService(ctx, principal.String())
+}
+
+// findService returns the keys of a service principal, or
+// authdb.ErrServiceNotFound. They are looked up for every request, from the
+// keytab if we have one, so that rotated keys are picked up without a
+// restart. The keytab is only read again once it changes.
+func findService(ctx context.Context, principal string) (authdb.ServicePrincipal, error) {
+	if keytabPath != "" {
+		kt, err := keytabs.Keytab()
+		if err != nil {
+			return authdb.ServicePrincipal{}, err
+		}
+		service, ok := authdb.KeytabPrincipal(principal, kt)
+		if !ok {
+			return authdb.ServicePrincipal{}, authdb.ErrServiceNotFound
+		}
+		return service, nil
 	}
 
-	serviceTicket := kerb.GenerateTicket(auth.Username)
+	return store.GetServiceByPrincipal(ctx, principal)
+}
 
-	// Encrypt Service Ticket with shared key between TGS and FS
-	tgsFsKey, _ := hex.DecodeString(authdb.GetSharedKey("tgs-fs", db))
-	encServiceTicket, _ := encryption.Encrypt(tgsFsKey, serviceTicket)
+// writeReply sends the new ticket for service encrypted with ticketKey,
+// preceded by the client's part of the reply encrypted with the session key
+// of the TGT the client authenticated with.
+func writeReply(w http.ResponseWriter, tgt kerb.Ticket, ticket kerb.Ticket, service string, ticketKey kerb.ServiceKey) {
+	encTicket, _ := kerb.SealTicket(ticket, service, ticketKey)
 
-	// Encrypt client-FS session key with client-TGS session key
-	encFsSessionKey, _ := encryption.Encrypt(clientSessionKey, serviceTicket.SessionKey)
-	keyLen := strconv.Itoa(len(encFsSessionKey))
+	// Encrypt new session key and ticket expiry with client-TGS session key
+	encSessionKey, _ := encryption.EncryptWith(tgt.SessionKeyType, tgt.SessionKey, kerb.KeyUsageTGSRepPart, ticket.ReplyPart(service))
+	keyLen := strconv.Itoa(len(encSessionKey))
 
-	response := append(encFsSessionKey, encServiceTicket...)
+	response := append(encSessionKey, encTicket...)
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("X-Key-Length", keyLen)
@@ -110,8 +408,33 @@ func handleTicket(w http.ResponseWriter, r *http.Request) {
 	w.Write(response)
 }
 
+// etypesHeader parses the encryption types offered by the client. A client
+// that offers none is assumed to support them all.
+func etypesHeader(r *http.Request) ([]encryption.EType, error) {
+	header := r.Header.Get("X-Etypes")
+	if header == "" {
+		return encryption.Supported(), nil
+	}
+	return encryption.ParseETypes(header)
+}
+
+// durationHeader parses a duration sent by the client, returning zero if the
+// header is missing or invalid.
+func durationHeader(r *http.Request, name string) time.Duration {
+	d, err := time.ParseDuration(r.Header.Get(name))
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// writeError sends err to the client as a KRB-ERROR from our realm.
+func writeError(w http.ResponseWriter, err error) {
+	kerb.WriteError(w, err, realm, clock.Now())
+}
+
 func displayHelp() {
-	fmt.Println("\nUsage: kerb-tgs [-db PATH] [-h HOST] [-p PORT] [-help]")
+	fmt.Println("\nUsage: kerb-tgs [-db PATH [-stash PATH] | -keytab PATH] [-h HOST] [-p PORT] [-realm REALM] [-rcache PATH] [-rcache-size N] [-skew DURATION] [-max-life DURATION] [-max-renew DURATION] [-help]")
 	flag.PrintDefaults()
 	os.Exit(0)
 }
\ No newline at end of file
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/authdb"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/replay"
+)
+
+// useMemoryStore points the server at a fresh in-memory store and returns a
+// renewable TGT for jdoe sealed with the AS-TGS key.
+func useMemoryStore(t *testing.T) (kerb.Ticket, []byte) {
+	t.Helper()
+
+	realm = kerb.DefaultRealm
+	keytabPath = ""
+	validator = kerb.NewValidator()
+	policy = kerb.DefaultPolicy()
+	rcache = replay.NewCache(replay.DefaultMaxEntries)
+
+	memory, err := authdb.NewMemoryStore(realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = memory
+
+	now := time.Now()
+	req := kerb.TicketRequest{Username: "jdoe@" + realm}
+	req.SetLifetimes(now, 0, 24*time.Hour)
+	tgt, err := kerb.IssueTicket(req, now, policy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asTgsKey, err := authdb.CurrentSharedKey(context.Background(), store, "as-tgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encTgt, err := kerb.SealTicket(tgt, kerb.TGSPrincipal(realm, realm).String(), asTgsKey.ServiceKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tgt, encTgt
+}
+
+// tgsRequest builds a request to the TGS carrying the TGT and an
+// authenticator whose checksum covers headers.
+func tgsRequest(tgt kerb.Ticket, encTgt []byte, path string, headers map[string]string) *http.Request {
+	auth := kerb.Autheticator{Username: tgt.Username, Timestamp: time.Now()}
+	auth.Checksum, _ = encryption.Checksum(tgt.SessionKeyType, tgt.SessionKey, kerb.KeyUsageTGSReqChecksum,
+		kerb.TGSReqChecksumData(headers["X-Service"], headers["X-Kdc-Options"], headers["X-Lifetime"], headers["X-Renewable-Lifetime"], headers["X-Etypes"]))
+	encAuth, _ := encryption.EncryptWith(tgt.SessionKeyType, tgt.SessionKey, kerb.KeyUsageTGSReqAuth, auth)
+
+	r := httptest.NewRequest(http.MethodGet, path, bytes.NewReader(append(append([]byte{}, encTgt...), encAuth...)))
+	r.Header.Set("X-Ticket-Length", strconv.Itoa(len(encTgt)))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestServiceTicketsAreNotRenewable(t *testing.T) {
+	tgt, encTgt := useMemoryStore(t)
+
+	w := httptest.NewRecorder()
+	handleTicket(w, tgsRequest(tgt, encTgt, "/ticket", map[string]string{
+		"X-Service":            kerb.DefaultFileService,
+		"X-Kdc-Options":        "renewable",
+		"X-Renewable-Lifetime": "8h",
+	}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 got %d: %s", w.Code, w.Body)
+	}
+
+	keyLen, _ := strconv.Atoi(w.Header().Get("X-Key-Length"))
+	var reply kerb.EncKDCRepPart
+	if err := encryption.DecryptWith(tgt.SessionKeyType, tgt.SessionKey, kerb.KeyUsageTGSRepPart, w.Body.Bytes()[:keyLen], &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Flags.Has(kerb.FlagRenewable) || !reply.RenewTill.IsZero() {
+		t.Errorf("Expected a service ticket that is not renewable, got flags %s until %s", reply.Flags, reply.RenewTill)
+	}
+
+	// A renewable service ticket could never be renewed, as /renew only
+	// takes tickets for a TGS
+	encTicket := w.Body.Bytes()[keyLen:]
+	w = httptest.NewRecorder()
+	handleRenew(w, tgsRequest(tgt, encTicket, "/renew", nil))
+	if w.Code == http.StatusOK {
+		t.Error("Expected /renew to refuse a service ticket")
+	}
+
+	// The TGT itself still renews
+	w = httptest.NewRecorder()
+	handleRenew(w, tgsRequest(tgt, encTgt, "/renew", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the TGT to be renewed, got %d: %s", w.Code, w.Body)
+	}
+}
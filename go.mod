@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/dixonwille/wmenu v4.0.2+incompatible
 	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/crypto v0.1.0
 	golang.org/x/term v0.1.0
 )
 
@@ -12,6 +13,6 @@ require (
 	github.com/daviddengcn/go-colortext v1.0.0 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/stretchr/testify v1.8.1 // indirect
-	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
+	golang.org/x/sys v0.1.0 // indirect
 	gopkg.in/dixonwille/wlog.v2 v2.0.0 // indirect
 )
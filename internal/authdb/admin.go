@@ -0,0 +1,113 @@
+package authdb
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+)
+
+var (
+	ErrAdminNotFound  = errors.New("authdb: administrator not found")
+	ErrDuplicateAdmin = errors.New("authdb: administrator already exists")
+	ErrUnknownRole    = errors.New("authdb: unknown administrator role")
+)
+
+// AdminRole decides what an administrator may do.
+type AdminRole string
+
+const (
+	// RoleFull may do everything.
+	RoleFull AdminRole = "full"
+	// RoleReadOnly may look at principals and policies but change nothing.
+	RoleReadOnly AdminRole = "read-only"
+	// RoleHelpdesk may look up users and reset their passwords.
+	RoleHelpdesk AdminRole = "helpdesk"
+)
+
+// Roles lists every administrator role.
+var Roles = []AdminRole{RoleFull, RoleReadOnly, RoleHelpdesk}
+
+// Permission is a kind of administrative operation.
+type Permission int
+
+const (
+	// PermRead covers looking at principals, services and policies.
+	PermRead Permission = iota
+	// PermResetPassword covers setting a user's password.
+	PermResetPassword
+	// PermModify covers every other change, keys and administrators
+	// included.
+	PermModify
+)
+
+// ParseAdminRole returns the role called name.
+func ParseAdminRole(name string) (AdminRole, error) {
+	for _, r := range Roles {
+		if string(r) == strings.ToLower(name) {
+			return r, nil
+		}
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownRole, name)
+}
+
+// Allows reports whether the role grants p.
+func (r AdminRole) Allows(p Permission) bool {
+	switch r {
+	case RoleFull:
+		return true
+	case RoleReadOnly:
+		return p == PermRead
+	case RoleHelpdesk:
+		return p == PermRead || p == PermResetPassword
+	}
+	return false
+}
+
+// Covers reports whether the role grants every permission other grants.
+func (r AdminRole) Covers(other AdminRole) bool {
+	for _, p := range []Permission{PermRead, PermResetPassword, PermModify} {
+		if other.Allows(p) && !r.Allows(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Admin is an administrator account. Only a salted PBKDF2 hash of its
+// password is stored. MustChangePassword is set on accounts whose password
+// was chosen by someone else, until their owner changes it.
+type Admin struct {
+	Id                 int
+	Username           string
+	Role               AdminRole
+	Salt               string
+	Iterations         int
+	Hash               string
+	MustChangePassword bool
+}
+
+// SetPassword hashes password with a fresh random salt.
+func (a *Admin) SetPassword(password string) {
+	params := encryption.NewKeyParams()
+	a.Salt = hex.EncodeToString(params.Salt)
+	a.Iterations = params.Iterations
+	a.Hash = hex.EncodeToString(params.StringToKey(password))
+}
+
+// CheckPassword reports whether password is the administrator's password.
+func (a Admin) CheckPassword(password string) bool {
+	salt, err := hex.DecodeString(a.Salt)
+	if err != nil {
+		return false
+	}
+	hash, err := hex.DecodeString(a.Hash)
+	if err != nil {
+		return false
+	}
+	params := encryption.KeyParams{EType: encryption.DefaultEType, Salt: salt, Iterations: a.Iterations}
+	return subtle.ConstantTimeCompare(params.StringToKey(password), hash) == 1
+}
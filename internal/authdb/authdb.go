@@ -1,56 +1,140 @@
 package authdb
 
 import (
+	"context"
 	"database/sql"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
 	"github.com/khaugen7/kerberos-go/internal/utils"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
-type UserAuth struct {
-	Id        int
-	FirstName string
-	LastName  string
-	Username  string
-	Key       string
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so that helpers can run
+// inside or outside a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
-func InitializeDb(path string) *sql.DB {
+// SQLiteStore is a PrincipalStore kept in a SQLite database file. Every
+// key it stores is encrypted under the master key.
+type SQLiteStore struct {
+	db     *sql.DB
+	master kerb.ServiceKey
+}
+
+var _ PrincipalStore = (*SQLiteStore)(nil)
+
+// InitializeDb opens the database at path. A new database is created with
+// the latest schema, and any default service missing is registered in realm.
+// An existing one must already have the latest schema, see MigrateDb. The
+// master key comes from source; a database without one is given one and its
+// keys encrypted.
+func InitializeDb(ctx context.Context, path string, realm string, source MasterKeySource) (*SQLiteStore, error) {
 	dbFile := constructDbPath(path)
 	if !utils.FileExists(dbFile) {
 		log.Println("Running first time setup...")
 		file, err := os.Create(dbFile)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		file.Close()
 	}
-	db := SqliteConnect(dbFile)
+	store, err := openSqlite(ctx, dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		empty, err := isEmpty(ctx, store.db)
+		if err != nil {
+			return err
+		}
+		if empty {
+			if err := migrate(ctx, store.db); err != nil {
+				return err
+			}
+		} else if err := checkSchema(ctx, store.db); err != nil {
+			return err
+		}
 
-	createUserTable(db)
-	createKeyTable(db)
-	insertSharedKeys(db)
+		// Keys kept where older versions put them are moved before the
+		// master key encrypts them
+		if err := migrateLegacyServices(ctx, store.db, realm); err != nil {
+			return fmt.Errorf("authdb: unable to initialize database: %w", err)
+		}
+		if err := store.unlock(ctx, source, true); err != nil {
+			return err
+		}
+
+		if err := store.insertSharedKeys(ctx); err != nil {
+			return fmt.Errorf("authdb: unable to initialize database: %w", err)
+		}
+		if err := store.insertDefaultServices(ctx, realm); err != nil {
+			return fmt.Errorf("authdb: unable to initialize database: %w", err)
+		}
+		return nil
+	}()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 	log.Println("Server: Initialization complete.")
-	return db
+	return store, nil
 }
 
-func SqliteConnect(path string) *sql.DB {
+// SqliteConnect opens an existing database, which must have the latest
+// schema and a master key, the version of which source supplies.
+func SqliteConnect(ctx context.Context, path string, source MasterKeySource) (*SQLiteStore, error) {
+	store, err := openSqlite(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchema(ctx, store.db); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if err := store.unlock(ctx, source, false); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func openSqlite(ctx context.Context, path string) (*SQLiteStore, error) {
 	dbFile := constructDbPath(path)
 	if !utils.FileExists(dbFile) {
-		log.Fatal("Database file does not exist")
+		return nil, ErrNoDatabase
 	}
 
 	db, err := sql.Open("sqlite3", dbFile)
 	if err != nil {
-		log.Fatal("Unable to connect to database:", err)
+		return nil, fmt.Errorf("authdb: unable to connect to database: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("authdb: unable to connect to database: %w", err)
 	}
-	return db
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// DefaultACLPath returns where the access control list of the remote
+// administration service is kept by default: next to the database at dbPath.
+func DefaultACLPath(dbPath string) string {
+	return filepath.Join(filepath.Dir(constructDbPath(dbPath)), "kadm5.acl")
 }
 
 func constructDbPath(path string) string {
@@ -60,156 +144,637 @@ func constructDbPath(path string) string {
 	return filepath.Join(path, "kerberos.db")
 }
 
-func createUserTable(db *sql.DB) {
+func createUserTable(ctx context.Context, db dbtx) error {
 	users_table := `CREATE TABLE IF NOT EXISTS user_auth (
         id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"first_name" TEXT,
 		"last_name" TEXT,
         "username" TEXT UNIQUE,
-        "key" TEXT);`
-	query, err := db.Prepare(users_table)
+        "key" TEXT,
+        "salt" TEXT,
+        "iterations" INTEGER NOT NULL DEFAULT 0,
+        "requires_preauth" INTEGER NOT NULL DEFAULT 1);`
+	if _, err := db.ExecContext(ctx, users_table); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(ctx, db, "user_auth", "requires_preauth", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "user_auth", "salt", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "user_auth", "iterations", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Keys created before salts were stored were salted with the realm and
+	// username. Recording that salt keeps them valid if the user is renamed.
+	_, err := db.ExecContext(ctx, "UPDATE user_auth SET salt = lower(hex(? || username)), iterations = 0 WHERE salt IS NULL", encryption.RealmName)
+	return err
+}
+
+// createUserKeyTable holds every user's keys. Keys created before there was
+// more than one encryption type were kept in user_auth and are moved here.
+func createUserKeyTable(ctx context.Context, db dbtx) error {
+	user_keys_table := `CREATE TABLE IF NOT EXISTS user_keys (
+        "user_id" INTEGER NOT NULL REFERENCES user_auth(id),
+        "etype" INTEGER NOT NULL,
+        "kvno" INTEGER NOT NULL DEFAULT 1,
+        "key" TEXT,
+        PRIMARY KEY (user_id, etype));`
+	if _, err := db.ExecContext(ctx, user_keys_table); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(ctx, db, "user_keys", "kvno", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO user_keys (user_id, etype, key) SELECT id, ?, key FROM user_auth WHERE key IS NOT NULL", encryption.ETypeAES256GCM)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	_, err = query.Exec()
+	_, err = db.ExecContext(ctx, "UPDATE user_auth SET key = NULL WHERE key IS NOT NULL")
+	return err
+}
+
+// addColumnIfMissing brings tables created by older versions up to date.
+func addColumnIfMissing(ctx context.Context, db dbtx, table, column, definition string) error {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
 	}
-	query.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+definition)
+	return err
 }
 
-func createKeyTable(db *sql.DB) {
+func createKeyTable(ctx context.Context, db dbtx) error {
 	keys_table := `CREATE TABLE IF NOT EXISTS keys (
         id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"key_name" TEXT UNIQUE,
 		"key" TEXT);`
-	query, err := db.Prepare(keys_table)
-	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = query.Exec()
-	if err != nil {
-		log.Fatal(err)
+	_, err := db.ExecContext(ctx, keys_table)
+	return err
+}
+
+func createServiceTable(ctx context.Context, db dbtx) error {
+	services_table := `CREATE TABLE IF NOT EXISTS services (
+        id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"principal" TEXT UNIQUE,
+		"etype" INTEGER NOT NULL DEFAULT -1,
+		"key" TEXT);`
+	if _, err := db.ExecContext(ctx, services_table); err != nil {
+		return err
 	}
-	query.Close()
+
+	// Services registered before encryption types existed have AES-GCM keys
+	return addColumnIfMissing(ctx, db, "services", "etype", "INTEGER NOT NULL DEFAULT -1")
 }
 
-func insertSharedKeys(db *sql.DB) {
-	stmt, _ := db.Prepare("INSERT OR IGNORE INTO keys (id, key_name, key) VALUES (?, ?, ?)")
-	defer stmt.Close()
+func createPolicyTable(ctx context.Context, db dbtx) error {
+	policies_table := `CREATE TABLE IF NOT EXISTS password_policies (
+        "name" TEXT NOT NULL PRIMARY KEY,
+        "min_length" INTEGER NOT NULL DEFAULT 0,
+        "min_classes" INTEGER NOT NULL DEFAULT 0);`
+	if _, err := db.ExecContext(ctx, policies_table); err != nil {
+		return err
+	}
+	return addColumnIfMissing(ctx, db, "user_auth", "policy", "TEXT")
+}
 
-	as_tgsKey := hex.EncodeToString(encryption.GenerateRandomBytes(32))
-	tgs_fsKey := hex.EncodeToString(encryption.GenerateRandomBytes(32))
+func createAdminTable(ctx context.Context, db dbtx) error {
+	admins_table := `CREATE TABLE admins (
+        id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "username" TEXT NOT NULL UNIQUE COLLATE NOCASE,
+        "role" TEXT NOT NULL,
+        "salt" TEXT NOT NULL,
+        "iterations" INTEGER NOT NULL,
+        "hash" TEXT NOT NULL,
+        "must_change_password" INTEGER NOT NULL DEFAULT 0);`
+	_, err := db.ExecContext(ctx, admins_table)
+	return err
+}
 
-	stmt.Exec(nil, "as-tgs", as_tgsKey)
-	stmt.Exec(nil, "tgs-fs", tgs_fsKey)
+// uniqueUsernames stops two users differing only in case from being added,
+// as lookups ignore case. Databases that already have such users must have
+// them renamed first.
+func uniqueUsernames(ctx context.Context, db dbtx) error {
+	var clash string
+	err := db.QueryRowContext(ctx, "SELECT username FROM user_auth GROUP BY username COLLATE NOCASE HAVING count(*) > 1 LIMIT 1").Scan(&clash)
+	if err == nil {
+		return fmt.Errorf("more than one user is called %s ignoring case, rename all but one", clash)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "CREATE UNIQUE INDEX user_auth_username_nocase ON user_auth (username COLLATE NOCASE)")
+	return err
 }
 
-func GetSharedKey(keyName string, db *sql.DB) string {
-	stmt, _ := db.Prepare("SELECT key FROM keys WHERE key_name = ?")
-	defer stmt.Close()
+func (s *SQLiteStore) insertSharedKeys(ctx context.Context) error {
+	as_tgsKey, mkvno, err := s.sealKey(hex.EncodeToString(encryption.GenerateRandomBytes(32)))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "INSERT INTO shared_keys (key_name, kvno, etype, key, mkvno) SELECT 'as-tgs', 1, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM shared_keys WHERE key_name = 'as-tgs')", encryption.DefaultEType, as_tgsKey, mkvno)
+	if err != nil {
+		return err
+	}
 
-	var key string
-	err := stmt.QueryRow(keyName).Scan(&key)
+	// The AS makes up salts for unknown users with a secret of its own, so
+	// that the key sealing TGTs is never used for anything else
+	saltSecret, mkvno, err := s.sealKey(hex.EncodeToString(encryption.GenerateRandomBytes(32)))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	return key
+	_, err = s.db.ExecContext(ctx, "INSERT INTO shared_keys (key_name, kvno, etype, key, mkvno) SELECT 'salt-secret', 1, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM shared_keys WHERE key_name = 'salt-secret')", encryption.DefaultEType, saltSecret, mkvno)
+	return err
 }
 
-func AddUser(user UserAuth, db *sql.DB) {
-	stmt, _ := db.Prepare("INSERT INTO user_auth (id, first_name, last_name, username, key) VALUES (?, ?, ?, ?, ?)")
-	defer stmt.Close()
-	stmt.Exec(nil, user.FirstName, user.LastName, user.Username, user.Key)
+// migrateLegacyServices registers the file server in databases created
+// before the service registry existed, which keep using their tgs-fs key
+// for it.
+func migrateLegacyServices(ctx context.Context, db *sql.DB, realm string) error {
+	fileService := kerb.QualifyPrincipal(kerb.DefaultFileService, realm)
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO services (principal, key) SELECT ?, key FROM keys WHERE key_name = 'tgs-fs' AND key IS NOT NULL", fileService)
+	if err != nil {
+		return err
+	}
+	return migrateServiceKeys(ctx, db)
+}
 
-	log.Printf("Added Successfully\nUser: %s %s\nUsername: %s\n", user.FirstName, user.LastName, user.Username)
+// defaultServices are the services every realm has: the file server and
+// the remote administration and password change services.
+var defaultServices = []string{kerb.DefaultFileService, kerb.KadminService, kerb.ChangePwService}
+
+// newDefaultService returns the default service name in realm with a new
+// random key.
+func newDefaultService(name string, realm string) (ServicePrincipal, error) {
+	etype := encryption.Supported()[0]
+	key, err := encryption.GenerateKey(etype)
+	if err != nil {
+		return ServicePrincipal{}, err
+	}
+	return ServicePrincipal{
+		Principal: kerb.QualifyPrincipal(name, realm),
+		Keys:      []KeyVersion{{Kvno: 1, EType: etype, Key: hex.EncodeToString(key)}},
+	}, nil
 }
 
-func UpdateUser(idToUpdate int, newInfo UserAuth, db *sql.DB) {
-	stmt, _ := db.Prepare("UPDATE user_auth SET first_name = ?, last_name = ?, username = ?, key = ? WHERE id = ?")
-	defer stmt.Close()
-	stmt.Exec(newInfo.FirstName, newInfo.LastName, newInfo.Username, newInfo.Key, idToUpdate)
+// insertDefaultServices registers each of the default services with a new
+// key unless it is already registered.
+func (s *SQLiteStore) insertDefaultServices(ctx context.Context, realm string) error {
+	for _, name := range defaultServices {
+		_, err := s.GetServiceByPrincipal(ctx, kerb.QualifyPrincipal(name, realm))
+		if !errors.Is(err, ErrServiceNotFound) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		service, err := newDefaultService(name, realm)
+		if err != nil {
+			return err
+		}
+		if err := s.AddService(ctx, service); err != nil {
+			return err
+		}
+		log.Printf("Added Successfully\nService: %s\n", service.Principal)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) AddService(ctx context.Context, service ServicePrincipal) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "INSERT INTO services (principal) VALUES (?)", service.Principal)
+		if isUniqueViolation(err) {
+			return ErrDuplicateService
+		} else if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return s.addServiceKeys(ctx, tx, int(id), service.Keys)
+	})
+}
 
-	log.Printf("User %s updated successfully", newInfo.Username)
+func (s *SQLiteStore) DeleteService(ctx context.Context, idToDelete int) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM service_keys WHERE service_id = ?", idToDelete); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "DELETE FROM services WHERE id = ?", idToDelete)
+		return notFoundIfUnaffected(result, err, ErrServiceNotFound)
+	})
 }
 
-func DeleteUser(idToDelete int, username string, db *sql.DB) {
-	stmt, _ := db.Prepare("DELETE FROM user_auth WHERE id = ?")
-	defer stmt.Close()
-	stmt.Exec(idToDelete)
+func (s *SQLiteStore) GetServiceByPrincipal(ctx context.Context, principal string) (ServicePrincipal, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, principal FROM services WHERE principal = ?", principal)
+	if err != nil {
+		return ServicePrincipal{}, err
+	}
 
-	log.Printf("User %s deleted successfully", username)
+	services, err := s.populateServiceSlice(ctx, rows)
+	if err != nil {
+		return ServicePrincipal{}, err
+	}
+	if len(services) == 0 {
+		return ServicePrincipal{}, ErrServiceNotFound
+	}
+	return services[0], nil
 }
 
-func FindUserByUsername(username string, db *sql.DB) []UserAuth {
-	stmt, _ := db.Prepare("SELECT id, first_name, last_name, username, key FROM user_auth WHERE username = ? COLLATE NOCASE")
-	defer stmt.Close()
-	rows, err := stmt.Query(username)
+func (s *SQLiteStore) ListServices(ctx context.Context) ([]ServicePrincipal, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, principal FROM services ORDER BY principal")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return populateResultSlice(rows)
+	return s.populateServiceSlice(ctx, rows)
+}
+
+func (s *SQLiteStore) AddUser(ctx context.Context, user UserAuth) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		return s.addUser(ctx, tx, user)
+	})
 }
 
-func FindUserByFirstName(name string, db *sql.DB) []UserAuth {
-	name = "%" + name + "%"
-	stmt, _ := db.Prepare("SELECT id, first_name, last_name, username, key FROM user_auth WHERE first_name LIKE ?")
-	defer stmt.Close()
-	rows, err := stmt.Query(name)
+func (s *SQLiteStore) AddUsers(ctx context.Context, users []UserAuth) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		for i, user := range users {
+			if err := s.addUser(ctx, tx, user); err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) addUser(ctx context.Context, tx *sql.Tx, user UserAuth) error {
+	if err := checkPolicyExists(ctx, tx, user.Policy); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, "INSERT INTO user_auth (first_name, last_name, username, salt, iterations, requires_preauth, policy) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		user.FirstName, user.LastName, user.Username, user.Salt, user.Iterations, user.RequirePreauth, nullIfEmpty(user.Policy))
+	if isUniqueViolation(err) {
+		return ErrDuplicateUsername
+	} else if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return s.replaceUserKeys(ctx, tx, int(id), user.Keys)
+}
 
-	return populateResultSlice(rows)
+func (s *SQLiteStore) UpdateUser(ctx context.Context, idToUpdate int, newInfo UserAuth) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		if err := checkPolicyExists(ctx, tx, newInfo.Policy); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "UPDATE user_auth SET first_name = ?, last_name = ?, username = ?, salt = ?, iterations = ?, requires_preauth = ?, policy = ? WHERE id = ?",
+			newInfo.FirstName, newInfo.LastName, newInfo.Username, newInfo.Salt, newInfo.Iterations, newInfo.RequirePreauth, nullIfEmpty(newInfo.Policy), idToUpdate)
+		if isUniqueViolation(err) {
+			return ErrDuplicateUsername
+		}
+		if err := notFoundIfUnaffected(result, err, ErrUserNotFound); err != nil {
+			return err
+		}
+		return s.replaceUserKeys(ctx, tx, idToUpdate, newInfo.Keys)
+	})
 }
 
-func FindUserByLastName(name string, db *sql.DB) []UserAuth {
-	name = "%" + name + "%"
-	stmt, _ := db.Prepare("SELECT id, first_name, last_name, username, key FROM user_auth WHERE last_name LIKE ?")
-	defer stmt.Close()
-	rows, err := stmt.Query(name)
+func (s *SQLiteStore) DeleteUser(ctx context.Context, idToDelete int) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM user_keys WHERE user_id = ?", idToDelete); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "DELETE FROM user_auth WHERE id = ?", idToDelete)
+		return notFoundIfUnaffected(result, err, ErrUserNotFound)
+	})
+}
+
+func (s *SQLiteStore) GetUserByUsername(ctx context.Context, username string) (UserAuth, error) {
+	users, err := s.findUsers(ctx, "username = ? COLLATE NOCASE", username)
 	if err != nil {
-		log.Fatal(err)
+		return UserAuth{}, err
 	}
+	if len(users) == 0 {
+		return UserAuth{}, ErrUserNotFound
+	}
+	return users[0], nil
+}
 
-	return populateResultSlice(rows)
+func (s *SQLiteStore) FindUserByFirstName(ctx context.Context, name string) ([]UserAuth, error) {
+	return s.findUsers(ctx, "first_name LIKE ?", "%"+name+"%")
 }
 
-func FindUserByFirstAndLastName(name string, db *sql.DB) []UserAuth {
+func (s *SQLiteStore) FindUserByLastName(ctx context.Context, name string) ([]UserAuth, error) {
+	return s.findUsers(ctx, "last_name LIKE ?", "%"+name+"%")
+}
+
+func (s *SQLiteStore) FindUserByFirstAndLastName(ctx context.Context, name string) ([]UserAuth, error) {
 	names := strings.Split(name, " ")
 	if len(names) != 2 {
-		log.Print("Invalid name, please type first and last name separated by a space")
-		return nil
+		return nil, ErrInvalidName
 	}
-	first := "%" + names[0] + "%"
-	last := "%" + names[1] + "%"
-	stmt, _ := db.Prepare("SELECT id, first_name, last_name, username, key FROM user_auth WHERE first_name LIKE ? AND last_name LIKE ?")
-	defer stmt.Close()
-	rows, err := stmt.Query(first, last)
+	return s.findUsers(ctx, "first_name LIKE ? AND last_name LIKE ?", "%"+names[0]+"%", "%"+names[1]+"%")
+}
+
+func (s *SQLiteStore) ListUsers(ctx context.Context) ([]UserAuth, error) {
+	return s.findUsers(ctx, "1 = 1 ORDER BY username COLLATE NOCASE")
+}
+
+func (s *SQLiteStore) findUsers(ctx context.Context, where string, args ...any) ([]UserAuth, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, first_name, last_name, username, salt, iterations, requires_preauth, policy FROM user_auth WHERE "+where, args...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return populateResultSlice(rows)
+	return s.populateResultSlice(ctx, rows)
 }
 
-func populateResultSlice(rows *sql.Rows) []UserAuth {
+// replaceUserKeys stores keys as the user's only keys.
+func (s *SQLiteStore) replaceUserKeys(ctx context.Context, db dbtx, userId int, keys []UserKey) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM user_keys WHERE user_id = ?", userId); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		sealed, mkvno, err := s.sealKey(k.Key)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "INSERT INTO user_keys (user_id, kvno, etype, key, mkvno) VALUES (?, ?, ?, ?, ?)", userId, k.Kvno, k.EType, sealed, mkvno)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) findUserKeys(ctx context.Context, userId int) ([]UserKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT kvno, etype, key, mkvno FROM user_keys WHERE user_id = ? ORDER BY etype", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]UserKey, 0)
+	for rows.Next() {
+		k := UserKey{}
+		var stored string
+		var mkvno sql.NullInt64
+		if err := rows.Scan(&k.Kvno, &k.EType, &stored, &mkvno); err != nil {
+			return nil, err
+		}
+		if k.Key, err = s.openKey(stored, mkvno); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) populateResultSlice(ctx context.Context, rows *sql.Rows) ([]UserAuth, error) {
 	defer rows.Close()
 	users := make([]UserAuth, 0)
 
 	for rows.Next() {
 		user := UserAuth{}
-		err := rows.Scan(&user.Id, &user.FirstName, &user.LastName, &user.Username, &user.Key)
+		var policy sql.NullString
+		err := rows.Scan(&user.Id, &user.FirstName, &user.LastName, &user.Username, &user.Salt, &user.Iterations, &user.RequirePreauth, &policy)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
+		user.Policy = policy.String
 		users = append(users, user)
 	}
-	err := rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range users {
+		keys, err := s.findUserKeys(ctx, users[i].Id)
+		if err != nil {
+			return nil, err
+		}
+		users[i].Keys = keys
+	}
+	return users, nil
+}
+
+func (s *SQLiteStore) populateServiceSlice(ctx context.Context, rows *sql.Rows) ([]ServicePrincipal, error) {
+	defer rows.Close()
+	services := make([]ServicePrincipal, 0)
+
+	for rows.Next() {
+		service := ServicePrincipal{}
+		if err := rows.Scan(&service.Id, &service.Principal); err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range services {
+		keys, err := s.findServiceKeys(ctx, services[i].Id)
+		if err != nil {
+			return nil, err
+		}
+		services[i].Keys = keys
+	}
+	return services, nil
+}
+
+func (s *SQLiteStore) AddPolicy(ctx context.Context, policy PasswordPolicy) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO password_policies (name, min_length, min_classes) VALUES (?, ?, ?)",
+		policy.Name, policy.MinLength, policy.MinClasses)
+	if isUniqueViolation(err) {
+		return ErrDuplicatePolicy
+	}
+	return err
+}
+
+func (s *SQLiteStore) GetPolicy(ctx context.Context, name string) (PasswordPolicy, error) {
+	policy := PasswordPolicy{}
+	err := s.db.QueryRowContext(ctx, "SELECT name, min_length, min_classes FROM password_policies WHERE name = ?", name).
+		Scan(&policy.Name, &policy.MinLength, &policy.MinClasses)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordPolicy{}, ErrPolicyNotFound
+	}
+	return policy, err
+}
+
+func (s *SQLiteStore) ListPolicies(ctx context.Context) ([]PasswordPolicy, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, min_length, min_classes FROM password_policies ORDER BY name")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
+
+	policies := make([]PasswordPolicy, 0)
+	for rows.Next() {
+		policy := PasswordPolicy{}
+		if err := rows.Scan(&policy.Name, &policy.MinLength, &policy.MinClasses); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+func (s *SQLiteStore) DeletePolicy(ctx context.Context, name string) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		var users int
+		if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM user_auth WHERE policy = ?", name).Scan(&users); err != nil {
+			return err
+		}
+		if users > 0 {
+			return ErrPolicyInUse
+		}
+		result, err := tx.ExecContext(ctx, "DELETE FROM password_policies WHERE name = ?", name)
+		return notFoundIfUnaffected(result, err, ErrPolicyNotFound)
+	})
+}
+
+func (s *SQLiteStore) AddAdmin(ctx context.Context, admin Admin) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO admins (username, role, salt, iterations, hash, must_change_password) VALUES (?, ?, ?, ?, ?, ?)",
+		admin.Username, admin.Role, admin.Salt, admin.Iterations, admin.Hash, admin.MustChangePassword)
+	if isUniqueViolation(err) {
+		return ErrDuplicateAdmin
+	}
+	return err
+}
+
+func (s *SQLiteStore) UpdateAdmin(ctx context.Context, admin Admin) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE admins SET username = ?, role = ?, salt = ?, iterations = ?, hash = ?, must_change_password = ? WHERE id = ?",
+		admin.Username, admin.Role, admin.Salt, admin.Iterations, admin.Hash, admin.MustChangePassword, admin.Id)
+	if isUniqueViolation(err) {
+		return ErrDuplicateAdmin
+	}
+	return notFoundIfUnaffected(result, err, ErrAdminNotFound)
+}
+
+func (s *SQLiteStore) DeleteAdmin(ctx context.Context, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM admins WHERE id = ?", id)
+	return notFoundIfUnaffected(result, err, ErrAdminNotFound)
+}
+
+func (s *SQLiteStore) GetAdmin(ctx context.Context, username string) (Admin, error) {
+	admins, err := s.findAdmins(ctx, "WHERE username = ?", username)
+	if err != nil {
+		return Admin{}, err
+	}
+	if len(admins) == 0 {
+		return Admin{}, ErrAdminNotFound
+	}
+	return admins[0], nil
+}
+
+func (s *SQLiteStore) ListAdmins(ctx context.Context) ([]Admin, error) {
+	return s.findAdmins(ctx, "ORDER BY username")
+}
+
+func (s *SQLiteStore) findAdmins(ctx context.Context, clause string, args ...any) ([]Admin, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, username, role, salt, iterations, hash, must_change_password FROM admins "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	admins := make([]Admin, 0)
+	for rows.Next() {
+		a := Admin{}
+		if err := rows.Scan(&a.Id, &a.Username, &a.Role, &a.Salt, &a.Iterations, &a.Hash, &a.MustChangePassword); err != nil {
+			return nil, err
+		}
+		admins = append(admins, a)
+	}
+	return admins, rows.Err()
+}
+
+// checkPolicyExists returns ErrPolicyNotFound unless name is empty or a
+// stored policy.
+func checkPolicyExists(ctx context.Context, db dbtx, name string) error {
+	if name == "" {
+		return nil
+	}
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM password_policies WHERE name = ?)", name).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrPolicyNotFound
+	}
+	return nil
+}
+
+// nullIfEmpty stores an empty string as NULL.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds.
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// notFoundIfUnaffected passes on err, or returns notFound if the statement
+// that produced result changed no rows.
+func notFoundIfUnaffected(result sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
 
-	return users
+// isUniqueViolation reports whether err comes from inserting a row whose
+// unique or primary key column matches an existing row.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
 }
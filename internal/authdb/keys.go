@@ -0,0 +1,249 @@
+package authdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/keytab"
+)
+
+var ErrNoKey = errors.New("authdb: key does not exist")
+
+// KeyVersion is one version of a long-term key. The key with the highest
+// kvno is current and used for new tickets. Older versions are kept until
+// Expires so that tickets sealed with them can still be read.
+type KeyVersion struct {
+	Kvno    int
+	EType   encryption.EType
+	Key     string
+	Expires time.Time
+}
+
+// ServiceKey returns k in the form used to seal and open tickets.
+func (k KeyVersion) ServiceKey() kerb.ServiceKey {
+	key, _ := hex.DecodeString(k.Key)
+	return kerb.ServiceKey{Kvno: k.Kvno, EType: k.EType, Key: key}
+}
+
+// KeytabEntry returns k as the keytab entry of principal.
+func (k KeyVersion) KeytabEntry(principal string) keytab.Entry {
+	key, _ := hex.DecodeString(k.Key)
+	return keytab.Entry{Principal: principal, Kvno: k.Kvno, EType: k.EType, Key: key, Expires: k.Expires}
+}
+
+// KeytabPrincipal returns the keys of principal held in kt, in the same
+// form as those read from the database.
+func KeytabPrincipal(principal string, kt *keytab.Keytab) (ServicePrincipal, bool) {
+	entries := kt.Keys(principal)
+	if len(entries) == 0 {
+		return ServicePrincipal{}, false
+	}
+
+	keys := make([]KeyVersion, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, KeyVersion{Kvno: e.Kvno, EType: e.EType, Key: hex.EncodeToString(e.Key), Expires: e.Expires})
+	}
+	return ServicePrincipal{Principal: principal, Keys: keys}, true
+}
+
+// Usable reports whether k may still decrypt tickets at now.
+func (k KeyVersion) Usable(now time.Time) bool {
+	return k.Expires.IsZero() || now.Before(k.Expires)
+}
+
+// CurrentKey returns the key new tickets for s are sealed with.
+func (s ServicePrincipal) CurrentKey() (KeyVersion, bool) {
+	return currentKey(s.Keys)
+}
+
+// KeyByVersion returns the version kvno of the service's key if it has not
+// expired at now.
+func (s ServicePrincipal) KeyByVersion(kvno int, now time.Time) (KeyVersion, bool) {
+	return keyByVersion(s.Keys, kvno, now)
+}
+
+func currentKey(keys []KeyVersion) (KeyVersion, bool) {
+	if len(keys) == 0 {
+		return KeyVersion{}, false
+	}
+	current := keys[0]
+	for _, k := range keys[1:] {
+		if k.Kvno > current.Kvno {
+			current = k
+		}
+	}
+	return current, true
+}
+
+func keyByVersion(keys []KeyVersion, kvno int, now time.Time) (KeyVersion, bool) {
+	for _, k := range keys {
+		if k.Kvno == kvno && k.Usable(now) {
+			return k, true
+		}
+	}
+	return KeyVersion{}, false
+}
+
+func createSharedKeyTable(ctx context.Context, db dbtx) error {
+	shared_keys_table := `CREATE TABLE IF NOT EXISTS shared_keys (
+        "key_name" TEXT NOT NULL,
+        "kvno" INTEGER NOT NULL,
+        "etype" INTEGER NOT NULL DEFAULT -1,
+        "key" TEXT,
+        "expires_at" INTEGER,
+        PRIMARY KEY (key_name, kvno));`
+	if _, err := db.ExecContext(ctx, shared_keys_table); err != nil {
+		return err
+	}
+
+	// Keys from before versioning become version 1
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO shared_keys (key_name, kvno, etype, key) SELECT key_name, 1, ?, key FROM keys", encryption.ETypeAES256GCM)
+	return err
+}
+
+func createServiceKeyTable(ctx context.Context, db dbtx) error {
+	service_keys_table := `CREATE TABLE IF NOT EXISTS service_keys (
+        "service_id" INTEGER NOT NULL REFERENCES services(id),
+        "kvno" INTEGER NOT NULL,
+        "etype" INTEGER NOT NULL,
+        "key" TEXT,
+        "expires_at" INTEGER,
+        PRIMARY KEY (service_id, kvno));`
+	_, err := db.ExecContext(ctx, service_keys_table)
+	return err
+}
+
+// migrateServiceKeys moves keys stored in the services table before keys
+// were versioned into service_keys as version 1.
+func migrateServiceKeys(ctx context.Context, db dbtx) error {
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO service_keys (service_id, kvno, etype, key) SELECT id, 1, etype, key FROM services WHERE key IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE services SET key = NULL WHERE key IS NOT NULL")
+	return err
+}
+
+func (s *SQLiteStore) FindSharedKeys(ctx context.Context, keyName string) ([]KeyVersion, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT kvno, etype, key, mkvno, expires_at FROM shared_keys WHERE key_name = ?", keyName)
+	if err != nil {
+		return nil, err
+	}
+	return s.populateKeySlice(rows)
+}
+
+func (s *SQLiteStore) findServiceKeys(ctx context.Context, serviceId int) ([]KeyVersion, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT kvno, etype, key, mkvno, expires_at FROM service_keys WHERE service_id = ?", serviceId)
+	if err != nil {
+		return nil, err
+	}
+	return s.populateKeySlice(rows)
+}
+
+func (s *SQLiteStore) addServiceKeys(ctx context.Context, db dbtx, serviceId int, keys []KeyVersion) error {
+	for _, k := range keys {
+		sealed, mkvno, err := s.sealKey(k.Key)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "INSERT INTO service_keys (service_id, kvno, etype, key, mkvno, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+			serviceId, k.Kvno, k.EType, sealed, mkvno, expiresColumn(k.Expires))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) RotateSharedKey(ctx context.Context, keyName string, grace time.Duration, now time.Time) (KeyVersion, error) {
+	return s.rotateKey(ctx, now, grace, encryption.DefaultEType,
+		"SELECT coalesce(max(kvno), 0) FROM shared_keys WHERE key_name = ?",
+		"UPDATE shared_keys SET expires_at = ? WHERE key_name = ? AND expires_at IS NULL",
+		"DELETE FROM shared_keys WHERE key_name = ? AND expires_at <= ?",
+		"INSERT INTO shared_keys (key_name, kvno, etype, key, mkvno) VALUES (?, ?, ?, ?, ?)",
+		keyName)
+}
+
+func (s *SQLiteStore) RotateServiceKey(ctx context.Context, serviceId int, etype encryption.EType, grace time.Duration, now time.Time) (KeyVersion, error) {
+	return s.rotateKey(ctx, now, grace, etype,
+		"SELECT coalesce(max(kvno), 0) FROM service_keys WHERE service_id = ?",
+		"UPDATE service_keys SET expires_at = ? WHERE service_id = ? AND expires_at IS NULL",
+		"DELETE FROM service_keys WHERE service_id = ? AND expires_at <= ?",
+		"INSERT INTO service_keys (service_id, kvno, etype, key, mkvno) VALUES (?, ?, ?, ?, ?)",
+		serviceId)
+}
+
+// rotateKey runs the statements of a rotation in one transaction, so that
+// a key always has exactly one current version.
+func (s *SQLiteStore) rotateKey(ctx context.Context, now time.Time, grace time.Duration, etype encryption.EType, maxQuery, expireQuery, deleteQuery, insertQuery string, owner any) (KeyVersion, error) {
+	key, err := encryption.GenerateKey(etype)
+	if err != nil {
+		return KeyVersion{}, err
+	}
+	sealed, mkvno, err := s.sealKey(hex.EncodeToString(key))
+	if err != nil {
+		return KeyVersion{}, err
+	}
+
+	var rotated KeyVersion
+	err = inTx(ctx, s.db, func(tx *sql.Tx) error {
+		var kvno int
+		if err := tx.QueryRowContext(ctx, maxQuery, owner).Scan(&kvno); err != nil {
+			return err
+		}
+		if kvno == 0 {
+			return ErrNoKey
+		}
+
+		if _, err := tx.ExecContext(ctx, deleteQuery, owner, now.Unix()); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, expireQuery, now.Add(grace).Unix(), owner); err != nil {
+			return err
+		}
+
+		rotated = KeyVersion{Kvno: kvno + 1, EType: etype, Key: hex.EncodeToString(key)}
+		_, err := tx.ExecContext(ctx, insertQuery, owner, rotated.Kvno, rotated.EType, sealed, mkvno)
+		return err
+	})
+	if err != nil {
+		return KeyVersion{}, err
+	}
+	return rotated, nil
+}
+
+func (s *SQLiteStore) populateKeySlice(rows *sql.Rows) ([]KeyVersion, error) {
+	defer rows.Close()
+	keys := make([]KeyVersion, 0)
+
+	for rows.Next() {
+		k := KeyVersion{}
+		var stored string
+		var mkvno, expires sql.NullInt64
+		if err := rows.Scan(&k.Kvno, &k.EType, &stored, &mkvno, &expires); err != nil {
+			return nil, err
+		}
+		var err error
+		if k.Key, err = s.openKey(stored, mkvno); err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			k.Expires = time.Unix(expires.Int64, 0)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// expiresColumn stores a zero expiry, meaning never, as NULL.
+func expiresColumn(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Unix()
+}
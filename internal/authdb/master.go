@@ -0,0 +1,316 @@
+package authdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/keytab"
+	"github.com/khaugen7/kerberos-go/internal/utils"
+)
+
+var (
+	ErrNoMasterKey    = errors.New("authdb: database has no master key yet")
+	ErrWrongMasterKey = errors.New("authdb: master key does not match the database")
+)
+
+// keyUsageStoredKey is the key usage of keys encrypted under the master
+// key, from the range RFC 4120 leaves to applications.
+const keyUsageStoredKey uint32 = 1024
+
+// masterKeyCheck is encrypted under each master key and stored with it, so
+// that a wrong master key is noticed before it is used.
+const masterKeyCheck = "kerberos-go master key"
+
+// MasterKeySource supplies version kvno of the master key that encrypts the
+// keys stored in a database. A kvno of 0 asks for a master key for a
+// database that does not have one yet.
+type MasterKeySource func(kvno int) (kerb.ServiceKey, error)
+
+// MasterPrincipal names the master key of realm in stash files.
+func MasterPrincipal(realm string) string {
+	return "K/M@" + realm
+}
+
+// DefaultStashPath returns where the stash file of realm's master key is
+// kept by default: next to the database at dbPath.
+func DefaultStashPath(dbPath string, realm string) string {
+	return filepath.Join(filepath.Dir(constructDbPath(dbPath)), ".k5."+realm)
+}
+
+// DeriveMasterKey derives version kvno of realm's master key from password,
+// salted with the master key's principal so that every realm gets a
+// different key from the same password.
+func DeriveMasterKey(password string, realm string, kvno int) kerb.ServiceKey {
+	params := encryption.KeyParams{EType: encryption.DefaultEType, Salt: []byte(MasterPrincipal(realm)), Iterations: encryption.DefaultIterations}
+	return kerb.ServiceKey{Kvno: kvno, EType: params.EType, Key: params.StringToKey(password)}
+}
+
+// StashOrPassword returns a MasterKeySource that reads the master key from
+// the stash file at path. Without a stash file it derives the key from the
+// password returned by password, which is told whether the key is new. A
+// new key is written to the stash file before the database uses it.
+func StashOrPassword(path string, realm string, password func(isNew bool) (string, error)) MasterKeySource {
+	return func(kvno int) (kerb.ServiceKey, error) {
+		if utils.FileExists(path) {
+			return stashedMasterKey(path, realm, kvno)
+		}
+
+		pw, err := password(kvno == 0)
+		if err != nil {
+			return kerb.ServiceKey{}, err
+		}
+		if kvno != 0 {
+			return DeriveMasterKey(pw, realm, kvno), nil
+		}
+		key := DeriveMasterKey(pw, realm, 1)
+		return key, SaveStash(path, realm, key)
+	}
+}
+
+// stashedMasterKey returns version kvno of realm's master key from the
+// stash file at path, or its latest version if kvno is 0.
+func stashedMasterKey(path string, realm string, kvno int) (kerb.ServiceKey, error) {
+	kt, err := keytab.Load(path)
+	if err != nil {
+		return kerb.ServiceKey{}, err
+	}
+
+	var found *keytab.Entry
+	for _, e := range kt.Keys(MasterPrincipal(realm)) {
+		e := e
+		if e.Kvno == kvno || (kvno == 0 && (found == nil || e.Kvno > found.Kvno)) {
+			found = &e
+		}
+	}
+	if found == nil {
+		return kerb.ServiceKey{}, fmt.Errorf("%w: %s holds no version %d of %s", ErrWrongMasterKey, path, kvno, MasterPrincipal(realm))
+	}
+	return found.ServiceKey(), nil
+}
+
+// SaveStash writes keys to the stash file at path as the only versions of
+// realm's master key. A stash file is a keytab and may hold other keys too.
+func SaveStash(path string, realm string, keys ...kerb.ServiceKey) error {
+	kt := &keytab.Keytab{}
+	if utils.FileExists(path) {
+		var err error
+		if kt, err = keytab.Load(path); err != nil {
+			return err
+		}
+	}
+
+	entries := make([]keytab.Entry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, keytab.Entry{Kvno: k.Kvno, EType: k.EType, Key: k.Key})
+	}
+	kt.Replace(MasterPrincipal(realm), entries)
+	return kt.Save(path)
+}
+
+// MasterKey returns the master key the store's keys are encrypted under.
+func (s *SQLiteStore) MasterKey() kerb.ServiceKey {
+	return s.master
+}
+
+// unlock loads the master key the database records. A database without
+// one is given the key source returns for version 0 if create is set, and
+// its keys are encrypted under it.
+func (s *SQLiteStore) unlock(ctx context.Context, source MasterKeySource, create bool) error {
+	var kvno int
+	var etype encryption.EType
+	var check string
+	err := s.db.QueryRowContext(ctx, "SELECT kvno, etype, check_value FROM master_key ORDER BY kvno DESC LIMIT 1").Scan(&kvno, &etype, &check)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !create {
+			return ErrNoMasterKey
+		}
+		key, err := source(0)
+		if err != nil {
+			return err
+		}
+		_, err = s.ReencryptKeys(ctx, key)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	key, err := source(kvno)
+	if err != nil {
+		return err
+	}
+	if key.Kvno != kvno || key.EType != etype || !verifyMasterKey(key, check) {
+		return fmt.Errorf("%w: version %d", ErrWrongMasterKey, kvno)
+	}
+	s.master = key
+	return nil
+}
+
+// ReencryptKeys encrypts every stored key under newKey, which becomes the
+// master key, and returns how many keys it re-encrypted. Keys stored before
+// the database had a master key are encrypted for the first time. It all
+// happens in one transaction, so a failure leaves every key under the old
+// master key. newKey must have a higher version than the current one.
+func (s *SQLiteStore) ReencryptKeys(ctx context.Context, newKey kerb.ServiceKey) (int, error) {
+	if newKey.Kvno <= s.master.Kvno {
+		return 0, fmt.Errorf("authdb: new master key must have a version above %d", s.master.Kvno)
+	}
+	check, err := sealWith(newKey, []byte(masterKeyCheck))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = inTx(ctx, s.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO master_key (kvno, etype, check_value) VALUES (?, ?, ?)", newKey.Kvno, newKey.EType, check)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range []string{"user_keys", "shared_keys", "service_keys"} {
+			n, err := s.reencryptTable(ctx, tx, table, newKey)
+			if err != nil {
+				return err
+			}
+			count += n
+		}
+
+		// Keys from before versioning were copied out of the legacy table
+		if _, err := tx.ExecContext(ctx, "UPDATE keys SET key = NULL"); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM master_key WHERE kvno <> ?", newKey.Kvno)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.master = newKey
+	return count, nil
+}
+
+func (s *SQLiteStore) reencryptTable(ctx context.Context, tx *sql.Tx, table string, newKey kerb.ServiceKey) (int, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT rowid, key, mkvno FROM "+table+" WHERE mkvno IS NULL OR mkvno <> ?", newKey.Kvno)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	type storedKey struct {
+		rowid int64
+		key   string
+	}
+	keys := make([]storedKey, 0)
+	for rows.Next() {
+		var k storedKey
+		var stored string
+		var mkvno sql.NullInt64
+		if err := rows.Scan(&k.rowid, &stored, &mkvno); err != nil {
+			return 0, err
+		}
+		if k.key, err = s.openKey(stored, mkvno); err != nil {
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for _, k := range keys {
+		raw, _ := hex.DecodeString(k.key)
+		sealed, err := sealWith(newKey, raw)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET key = ?, mkvno = ? WHERE rowid = ?", sealed, newKey.Kvno, k.rowid); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// sealKey encrypts a hex encoded key under the master key for storage,
+// returning it with the master key's version.
+func (s *SQLiteStore) sealKey(key string) (string, int, error) {
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return "", 0, err
+	}
+	sealed, err := sealWith(s.master, raw)
+	return sealed, s.master.Kvno, err
+}
+
+// openKey decrypts a stored key to hex. A key without a master key version
+// was stored before the database had a master key and is not encrypted.
+func (s *SQLiteStore) openKey(stored string, mkvno sql.NullInt64) (string, error) {
+	if !mkvno.Valid {
+		return stored, nil
+	}
+	if int(mkvno.Int64) != s.master.Kvno {
+		return "", fmt.Errorf("%w: key stored under version %d, have version %d", ErrWrongMasterKey, mkvno.Int64, s.master.Kvno)
+	}
+
+	ciphertext, err := hex.DecodeString(stored)
+	if err != nil {
+		return "", err
+	}
+	e, ok := encryption.Lookup(s.master.EType)
+	if !ok {
+		return "", encryption.ErrUnknownEType
+	}
+	raw, err := e.Decrypt(s.master.Key, keyUsageStoredKey, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrWrongMasterKey, err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func sealWith(master kerb.ServiceKey, raw []byte) (string, error) {
+	e, ok := encryption.Lookup(master.EType)
+	if !ok {
+		return "", encryption.ErrUnknownEType
+	}
+	ciphertext, err := e.Encrypt(master.Key, keyUsageStoredKey, raw)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ciphertext), nil
+}
+
+func verifyMasterKey(key kerb.ServiceKey, check string) bool {
+	ciphertext, err := hex.DecodeString(check)
+	if err != nil {
+		return false
+	}
+	e, ok := encryption.Lookup(key.EType)
+	if !ok {
+		return false
+	}
+	plaintext, err := e.Decrypt(key.Key, keyUsageStoredKey, ciphertext)
+	return err == nil && string(plaintext) == masterKeyCheck
+}
+
+func createMasterKeyTable(ctx context.Context, db dbtx) error {
+	master_key_table := `CREATE TABLE master_key (
+        "kvno" INTEGER NOT NULL PRIMARY KEY,
+        "etype" INTEGER NOT NULL,
+        "check_value" TEXT NOT NULL);`
+	if _, err := db.ExecContext(ctx, master_key_table); err != nil {
+		return err
+	}
+
+	// Keys without a master key version are not encrypted yet
+	for _, table := range []string{"user_keys", "shared_keys", "service_keys"} {
+		if _, err := db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN mkvno INTEGER"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
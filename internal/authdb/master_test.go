@@ -0,0 +1,224 @@
+package authdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+	"github.com/khaugen7/kerberos-go/internal/keytab"
+)
+
+// passwordSource derives every version of the master key from password.
+func passwordSource(password string) MasterKeySource {
+	return func(kvno int) (kerb.ServiceKey, error) {
+		if kvno == 0 {
+			kvno = 1
+		}
+		return DeriveMasterKey(password, kerb.DefaultRealm, kvno), nil
+	}
+}
+
+// noPassword fails the test if the master key is not found in the stash.
+func noPassword(t *testing.T) func(bool) (string, error) {
+	return func(bool) (string, error) {
+		t.Error("Asked for a password with a stash file")
+		return "", errors.New("no password")
+	}
+}
+
+// checkStoredKeys fails the test unless every key in table is encrypted
+// under version mkvno of the master key, and none is stored in the clear.
+func checkStoredKeys(t *testing.T, db *sql.DB, table string, mkvno int, plaintext ...string) int {
+	t.Helper()
+	rows, err := db.Query("SELECT key, mkvno FROM " + table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var key string
+		var version sql.NullInt64
+		if err := rows.Scan(&key, &version); err != nil {
+			t.Fatal(err)
+		}
+		if !version.Valid || int(version.Int64) != mkvno {
+			t.Errorf("Expected %s keys under master key %d, got %v", table, mkvno, version)
+		}
+		for _, p := range plaintext {
+			if key == p {
+				t.Errorf("Key %s stored in the clear in %s", p, table)
+			}
+		}
+		count++
+	}
+	return count
+}
+
+// checkKeysReadable fails the test unless the keys of the version 0
+// database read back through the store.
+func checkKeysReadable(t *testing.T, store *SQLiteStore) {
+	t.Helper()
+	ctx := context.Background()
+	user, err := store.GetUserByUsername(ctx, "jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := user.Key(encryption.ETypeAES256GCM); string(key) != "\xaa\xbb\xcc" {
+		t.Errorf("Expected jdoe's key aabbcc, got %x", key)
+	}
+	service, err := store.GetServiceByPrincipal(ctx, kerb.QualifyPrincipal(kerb.DefaultFileService, kerb.DefaultRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Keys) != 1 || service.Keys[0].Key != "445566" {
+		t.Errorf("Expected the file server's key 445566, got %+v", service.Keys)
+	}
+	if key, err := CurrentSharedKey(ctx, store, "as-tgs"); err != nil || key.Key != "112233" {
+		t.Errorf("Expected the as-tgs key 112233, got %+v, %v", key, err)
+	}
+}
+
+func TestReencryptKeys(t *testing.T) {
+	ctx := context.Background()
+	path := newV0Database(t)
+	if _, err := MigrateDb(ctx, path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A database without a master key has its keys encrypted when opened
+	store, err := InitializeDb(ctx, path, kerb.DefaultRealm, passwordSource("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store.Close() }()
+	total := 0
+	for _, table := range []string{"user_keys", "shared_keys", "service_keys"} {
+		total += checkStoredKeys(t, store.db, table, 1, "aabbcc", "112233", "445566")
+	}
+	var legacy int
+	if err := store.db.QueryRow("SELECT count(*) FROM keys WHERE key IS NOT NULL").Scan(&legacy); err != nil || legacy != 0 {
+		t.Errorf("Expected no keys left in the legacy table, got %d, %v", legacy, err)
+	}
+	checkKeysReadable(t, store)
+
+	// A new master key takes over every key
+	n, err := store.ReencryptKeys(ctx, DeriveMasterKey("second", kerb.DefaultRealm, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != total {
+		t.Errorf("Expected %d keys re-encrypted, got %d", total, n)
+	}
+	for _, table := range []string{"user_keys", "shared_keys", "service_keys"} {
+		checkStoredKeys(t, store.db, table, 2, "aabbcc", "112233", "445566")
+	}
+	var versions int
+	if err := store.db.QueryRow("SELECT count(*) FROM master_key WHERE kvno <> 2").Scan(&versions); err != nil || versions != 0 {
+		t.Errorf("Expected only master key 2 recorded, got %d others, %v", versions, err)
+	}
+	checkKeysReadable(t, store)
+
+	if _, err := store.ReencryptKeys(ctx, DeriveMasterKey("third", kerb.DefaultRealm, 2)); err == nil {
+		t.Error("Expected a master key without a higher version to be refused")
+	}
+
+	store.Close()
+	if store, err = SqliteConnect(ctx, path, passwordSource("second")); err != nil {
+		t.Fatalf("Unable to open with the new master key: %v", err)
+	}
+	checkKeysReadable(t, store)
+}
+
+func TestUnlockRejectsWrongMasterKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stash := filepath.Join(dir, ".k5."+kerb.DefaultRealm)
+	store, err := InitializeDb(ctx, dir, kerb.DefaultRealm, StashOrPassword(stash, kerb.DefaultRealm, func(bool) (string, error) {
+		return "right", nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if _, err := SqliteConnect(ctx, dir, passwordSource("wrong")); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("Expected ErrWrongMasterKey for a wrong password, got %v", err)
+	}
+
+	other := filepath.Join(dir, "other-stash")
+	if err := SaveStash(other, kerb.DefaultRealm, DeriveMasterKey("wrong", kerb.DefaultRealm, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SqliteConnect(ctx, dir, StashOrPassword(other, kerb.DefaultRealm, noPassword(t))); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("Expected ErrWrongMasterKey for a wrong stash, got %v", err)
+	}
+
+	if err := SaveStash(other, kerb.DefaultRealm, DeriveMasterKey("right", kerb.DefaultRealm, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SqliteConnect(ctx, dir, StashOrPassword(other, kerb.DefaultRealm, noPassword(t))); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("Expected ErrWrongMasterKey for a stash without the version, got %v", err)
+	}
+
+	store, err = SqliteConnect(ctx, dir, StashOrPassword(stash, kerb.DefaultRealm, noPassword(t)))
+	if err != nil {
+		t.Fatalf("Unable to open with the stash: %v", err)
+	}
+	store.Close()
+}
+
+func TestStashRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".k5."+kerb.DefaultRealm)
+
+	// Without a stash a new master key comes from a password and is stashed
+	asked := false
+	source := StashOrPassword(path, kerb.DefaultRealm, func(isNew bool) (string, error) {
+		asked = true
+		if !isNew {
+			t.Error("Expected to be asked for a new password")
+		}
+		return "secret", nil
+	})
+	key, err := source(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DeriveMasterKey("secret", kerb.DefaultRealm, 1)
+	if !asked || key.Kvno != 1 || string(key.Key) != string(want.Key) {
+		t.Errorf("Expected the key derived from the password, got %+v", key)
+	}
+
+	source = StashOrPassword(path, kerb.DefaultRealm, noPassword(t))
+	if key, err = source(1); err != nil || string(key.Key) != string(want.Key) {
+		t.Errorf("Expected the stashed key, got %+v, %v", key, err)
+	}
+
+	// Saving replaces the master key's versions and keeps other keys
+	kt, err := keytab.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt.Replace("fs/localhost@"+kerb.DefaultRealm, []keytab.Entry{{Kvno: 1, EType: encryption.DefaultEType, Key: []byte("service key")}})
+	if err := kt.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	second := DeriveMasterKey("another", kerb.DefaultRealm, 2)
+	if err := SaveStash(path, kerb.DefaultRealm, want, second); err != nil {
+		t.Fatal(err)
+	}
+	if key, err = source(0); err != nil || key.Kvno != 2 || string(key.Key) != string(second.Key) {
+		t.Errorf("Expected the latest stashed version, got %+v, %v", key, err)
+	}
+	if key, err = source(1); err != nil || string(key.Key) != string(want.Key) {
+		t.Errorf("Expected version 1 still stashed, got %+v, %v", key, err)
+	}
+	if kt, err = keytab.Load(path); err != nil || len(kt.Keys("fs/localhost@"+kerb.DefaultRealm)) != 1 {
+		t.Errorf("Expected the service key kept in the stash, got %v", err)
+	}
+}
@@ -0,0 +1,436 @@
+package authdb
+
+import (
+	"context"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+)
+
+// MemoryStore is a PrincipalStore that keeps everything in memory, for
+// tests and for embedding the KDC in another program. Its contents are lost
+// when the program exits.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	users         map[int]UserAuth
+	services      map[int]ServicePrincipal
+	sharedKeys    map[string][]KeyVersion
+	policies      map[string]PasswordPolicy
+	admins        map[int]Admin
+	nextUserId    int
+	nextServiceId int
+	nextAdminId   int
+}
+
+var _ PrincipalStore = (*MemoryStore)(nil)
+
+// NewMemoryStore returns a store holding what InitializeDb puts in a new
+// database: random shared keys and the default services registered in
+// realm.
+func NewMemoryStore(realm string) (*MemoryStore, error) {
+	s := &MemoryStore{
+		users:         make(map[int]UserAuth),
+		services:      make(map[int]ServicePrincipal),
+		sharedKeys:    make(map[string][]KeyVersion),
+		policies:      make(map[string]PasswordPolicy),
+		admins:        make(map[int]Admin),
+		nextUserId:    1,
+		nextServiceId: 1,
+		nextAdminId:   1,
+	}
+
+	asTgsKey, err := encryption.GenerateKey(encryption.DefaultEType)
+	if err != nil {
+		return nil, err
+	}
+	s.sharedKeys["as-tgs"] = []KeyVersion{{Kvno: 1, EType: encryption.DefaultEType, Key: hex.EncodeToString(asTgsKey)}}
+	saltSecret, err := encryption.GenerateKey(encryption.DefaultEType)
+	if err != nil {
+		return nil, err
+	}
+	s.sharedKeys["salt-secret"] = []KeyVersion{{Kvno: 1, EType: encryption.DefaultEType, Key: hex.EncodeToString(saltSecret)}}
+
+	for _, name := range defaultServices {
+		service, err := newDefaultService(name, realm)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.AddService(context.Background(), service); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) AddUser(ctx context.Context, user UserAuth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUser(0, user); err != nil {
+		return err
+	}
+	user.Id = s.nextUserId
+	s.nextUserId++
+	s.users[user.Id] = copyUser(user)
+	return nil
+}
+
+func (s *MemoryStore) AddUsers(ctx context.Context, users []UserAuth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := make([]int, 0, len(users))
+	for i, user := range users {
+		if err := s.checkUser(0, user); err != nil {
+			for _, id := range added {
+				delete(s.users, id)
+			}
+			return &BatchError{Index: i, Err: err}
+		}
+		user.Id = s.nextUserId
+		s.nextUserId++
+		s.users[user.Id] = copyUser(user)
+		added = append(added, user.Id)
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateUser(ctx context.Context, idToUpdate int, newInfo UserAuth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[idToUpdate]; !ok {
+		return ErrUserNotFound
+	}
+	if err := s.checkUser(idToUpdate, newInfo); err != nil {
+		return err
+	}
+	newInfo.Id = idToUpdate
+	s.users[idToUpdate] = copyUser(newInfo)
+	return nil
+}
+
+// checkUser returns the error storing user under id would cause.
+func (s *MemoryStore) checkUser(id int, user UserAuth) error {
+	if _, ok := s.policies[user.Policy]; user.Policy != "" && !ok {
+		return ErrPolicyNotFound
+	}
+	for _, u := range s.users {
+		if u.Id != id && strings.EqualFold(u.Username, user.Username) {
+			return ErrDuplicateUsername
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, idToDelete int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[idToDelete]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, idToDelete)
+	return nil
+}
+
+func (s *MemoryStore) GetUserByUsername(ctx context.Context, username string) (UserAuth, error) {
+	users := s.findUsers(func(u UserAuth) bool { return strings.EqualFold(u.Username, username) })
+	if len(users) == 0 {
+		return UserAuth{}, ErrUserNotFound
+	}
+	return users[0], nil
+}
+
+func (s *MemoryStore) FindUserByFirstName(ctx context.Context, name string) ([]UserAuth, error) {
+	return s.findUsers(func(u UserAuth) bool { return containsFold(u.FirstName, name) }), nil
+}
+
+func (s *MemoryStore) FindUserByLastName(ctx context.Context, name string) ([]UserAuth, error) {
+	return s.findUsers(func(u UserAuth) bool { return containsFold(u.LastName, name) }), nil
+}
+
+func (s *MemoryStore) FindUserByFirstAndLastName(ctx context.Context, name string) ([]UserAuth, error) {
+	names := strings.Split(name, " ")
+	if len(names) != 2 {
+		return nil, ErrInvalidName
+	}
+	return s.findUsers(func(u UserAuth) bool {
+		return containsFold(u.FirstName, names[0]) && containsFold(u.LastName, names[1])
+	}), nil
+}
+
+func (s *MemoryStore) ListUsers(ctx context.Context) ([]UserAuth, error) {
+	users := s.findUsers(func(UserAuth) bool { return true })
+	sort.Slice(users, func(i, j int) bool { return strings.ToLower(users[i].Username) < strings.ToLower(users[j].Username) })
+	return users, nil
+}
+
+// findUsers returns the users matching match in the order they were added.
+func (s *MemoryStore) findUsers(match func(UserAuth) bool) []UserAuth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]UserAuth, 0)
+	for _, u := range s.users {
+		if match(u) {
+			users = append(users, copyUser(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users
+}
+
+func (s *MemoryStore) AddService(ctx context.Context, service ServicePrincipal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.services {
+		if existing.Principal == service.Principal {
+			return ErrDuplicateService
+		}
+	}
+	service.Id = s.nextServiceId
+	s.nextServiceId++
+	s.services[service.Id] = copyService(service)
+	return nil
+}
+
+func (s *MemoryStore) DeleteService(ctx context.Context, idToDelete int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.services[idToDelete]; !ok {
+		return ErrServiceNotFound
+	}
+	delete(s.services, idToDelete)
+	return nil
+}
+
+func (s *MemoryStore) GetServiceByPrincipal(ctx context.Context, principal string) (ServicePrincipal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, service := range s.services {
+		if service.Principal == principal {
+			return copyService(service), nil
+		}
+	}
+	return ServicePrincipal{}, ErrServiceNotFound
+}
+
+func (s *MemoryStore) ListServices(ctx context.Context) ([]ServicePrincipal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	services := make([]ServicePrincipal, 0, len(s.services))
+	for _, service := range s.services {
+		services = append(services, copyService(service))
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Principal < services[j].Principal })
+	return services, nil
+}
+
+func (s *MemoryStore) FindSharedKeys(ctx context.Context, keyName string) ([]KeyVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]KeyVersion{}, s.sharedKeys[keyName]...), nil
+}
+
+func (s *MemoryStore) RotateSharedKey(ctx context.Context, keyName string, grace time.Duration, now time.Time) (KeyVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, rotated, err := rotateKeyVersions(s.sharedKeys[keyName], encryption.DefaultEType, grace, now)
+	if err != nil {
+		return KeyVersion{}, err
+	}
+	s.sharedKeys[keyName] = keys
+	return rotated, nil
+}
+
+func (s *MemoryStore) RotateServiceKey(ctx context.Context, serviceId int, etype encryption.EType, grace time.Duration, now time.Time) (KeyVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	service := s.services[serviceId]
+	keys, rotated, err := rotateKeyVersions(service.Keys, etype, grace, now)
+	if err != nil {
+		return KeyVersion{}, err
+	}
+	service.Keys = keys
+	s.services[serviceId] = service
+	return rotated, nil
+}
+
+// rotateKeyVersions returns keys after rotating them as RotateSharedKey
+// describes, along with the new version.
+func rotateKeyVersions(keys []KeyVersion, etype encryption.EType, grace time.Duration, now time.Time) ([]KeyVersion, KeyVersion, error) {
+	current, ok := currentKey(keys)
+	if !ok {
+		return nil, KeyVersion{}, ErrNoKey
+	}
+	key, err := encryption.GenerateKey(etype)
+	if err != nil {
+		return nil, KeyVersion{}, err
+	}
+
+	rotated := make([]KeyVersion, 0, len(keys)+1)
+	for _, k := range keys {
+		if !k.Usable(now) {
+			continue
+		}
+		if k.Expires.IsZero() {
+			k.Expires = now.Add(grace)
+		}
+		rotated = append(rotated, k)
+	}
+	next := KeyVersion{Kvno: current.Kvno + 1, EType: etype, Key: hex.EncodeToString(key)}
+	return append(rotated, next), next, nil
+}
+
+func (s *MemoryStore) AddPolicy(ctx context.Context, policy PasswordPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.policies[policy.Name]; ok {
+		return ErrDuplicatePolicy
+	}
+	s.policies[policy.Name] = policy
+	return nil
+}
+
+func (s *MemoryStore) GetPolicy(ctx context.Context, name string) (PasswordPolicy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	policy, ok := s.policies[name]
+	if !ok {
+		return PasswordPolicy{}, ErrPolicyNotFound
+	}
+	return policy, nil
+}
+
+func (s *MemoryStore) ListPolicies(ctx context.Context) ([]PasswordPolicy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	policies := make([]PasswordPolicy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies, nil
+}
+
+func (s *MemoryStore) DeletePolicy(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.policies[name]; !ok {
+		return ErrPolicyNotFound
+	}
+	for _, u := range s.users {
+		if u.Policy == name {
+			return ErrPolicyInUse
+		}
+	}
+	delete(s.policies, name)
+	return nil
+}
+
+func (s *MemoryStore) AddAdmin(ctx context.Context, admin Admin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.adminTaken(0, admin.Username) {
+		return ErrDuplicateAdmin
+	}
+	admin.Id = s.nextAdminId
+	s.nextAdminId++
+	s.admins[admin.Id] = admin
+	return nil
+}
+
+func (s *MemoryStore) UpdateAdmin(ctx context.Context, admin Admin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.admins[admin.Id]; !ok {
+		return ErrAdminNotFound
+	}
+	if s.adminTaken(admin.Id, admin.Username) {
+		return ErrDuplicateAdmin
+	}
+	s.admins[admin.Id] = admin
+	return nil
+}
+
+func (s *MemoryStore) adminTaken(id int, username string) bool {
+	for _, a := range s.admins {
+		if a.Id != id && strings.EqualFold(a.Username, username) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) DeleteAdmin(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.admins[id]; !ok {
+		return ErrAdminNotFound
+	}
+	delete(s.admins, id)
+	return nil
+}
+
+func (s *MemoryStore) GetAdmin(ctx context.Context, username string) (Admin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, a := range s.admins {
+		if strings.EqualFold(a.Username, username) {
+			return a, nil
+		}
+	}
+	return Admin{}, ErrAdminNotFound
+}
+
+func (s *MemoryStore) ListAdmins(ctx context.Context) ([]Admin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	admins := make([]Admin, 0, len(s.admins))
+	for _, a := range s.admins {
+		admins = append(admins, a)
+	}
+	sort.Slice(admins, func(i, j int) bool { return admins[i].Username < admins[j].Username })
+	return admins, nil
+}
+
+// copyUser and copyService copy the keys as well, so that callers cannot
+// change what is stored through the slices they are given.
+func copyUser(u UserAuth) UserAuth {
+	u.Keys = append([]UserKey{}, u.Keys...)
+	return u
+}
+
+func copyService(s ServicePrincipal) ServicePrincipal {
+	s.Keys = append([]KeyVersion{}, s.Keys...)
+	return s
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
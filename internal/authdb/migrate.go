@@ -0,0 +1,172 @@
+package authdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrMigrationRequired = errors.New("authdb: database schema is out of date")
+	ErrSchemaTooNew      = errors.New("authdb: database schema is newer than this program")
+)
+
+// Migration is one step in the evolution of the database schema.
+type Migration struct {
+	Version     int
+	Description string
+	apply       func(context.Context, dbtx) error
+}
+
+// migrations brings a database from any earlier version to the latest, in
+// order. A released step must never change: evolve the schema by appending a
+// new one. Databases created before the schema was versioned are at version
+// 0 but may already have some of the first steps' tables and columns, so
+// those steps only add what is missing.
+var migrations = []Migration{
+	{1, "Create the user table", createUserTable},
+	{2, "Create the user key table, moving keys out of the user table", createUserKeyTable},
+	{3, "Create the legacy key table", createKeyTable},
+	{4, "Create the versioned shared key table", createSharedKeyTable},
+	{5, "Create the service table", createServiceTable},
+	{6, "Create the versioned service key table", createServiceKeyTable},
+	{7, "Create the password policy table and assign users a policy", createPolicyTable},
+	{8, "Create the master key table and record which master key encrypts each key", createMasterKeyTable},
+	{9, "Create the administrator table", createAdminTable},
+	{10, "Make usernames unique ignoring case", uniqueUsernames},
+}
+
+// MigrationPlan describes the migration of a database from Current to the
+// latest version by applying Steps. Backup is the copy of the database made
+// first, if any.
+type MigrationPlan struct {
+	Current int
+	Latest  int
+	Steps   []Migration
+	Backup  string
+}
+
+// MigrateDb brings the database at path to the latest schema. Unless dryRun
+// is set, the database is first copied to a backup file next to it, then
+// each step is applied in a transaction of its own, so that a failed step
+// leaves the database at the previous version. Servers may keep running
+// while it migrates. The returned plan lists the steps applied, or that
+// would be applied for a dry run.
+func MigrateDb(ctx context.Context, path string, dryRun bool) (MigrationPlan, error) {
+	store, err := openSqlite(ctx, path)
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+	defer store.Close()
+
+	current, err := schemaVersion(ctx, store.db)
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+	plan := MigrationPlan{Current: current, Latest: latestVersion(), Steps: pendingMigrations(current)}
+	if current > plan.Latest {
+		return plan, fmt.Errorf("%w: version %d, expected %d", ErrSchemaTooNew, current, plan.Latest)
+	}
+	if dryRun || len(plan.Steps) == 0 {
+		return plan, nil
+	}
+
+	empty, err := isEmpty(ctx, store.db)
+	if err != nil {
+		return plan, err
+	}
+	if !empty {
+		plan.Backup = fmt.Sprintf("%s.v%d-%s.bak", constructDbPath(path), current, time.Now().Format("20060102150405"))
+		// VACUUM INTO takes a consistent copy even while servers use the
+		// database
+		if _, err := store.db.ExecContext(ctx, "VACUUM INTO ?", plan.Backup); err != nil {
+			return plan, fmt.Errorf("authdb: unable to back up database: %w", err)
+		}
+	}
+	return plan, migrate(ctx, store.db)
+}
+
+// migrate applies every migration the database has not had yet. Each step
+// claims its version before changing anything, so that of two processes
+// migrating at once only one applies it.
+func migrate(ctx context.Context, db *sql.DB) error {
+	schema_version_table := `CREATE TABLE IF NOT EXISTS schema_version (
+        "version" INTEGER NOT NULL PRIMARY KEY,
+        "description" TEXT NOT NULL,
+        "applied_at" INTEGER NOT NULL);`
+	if _, err := db.ExecContext(ctx, schema_version_table); err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, m := range pendingMigrations(current) {
+		err := inTx(ctx, db, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+				m.Version, m.Description, time.Now().Unix())
+			if isUniqueViolation(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			return m.apply(ctx, tx)
+		})
+		if err != nil {
+			return fmt.Errorf("authdb: migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+	}
+	return nil
+}
+
+// checkSchema returns an error unless the database has the latest schema.
+func checkSchema(ctx context.Context, db dbtx) error {
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if latest := latestVersion(); current < latest {
+		return fmt.Errorf("%w: version %d, expected %d", ErrMigrationRequired, current, latest)
+	} else if current > latest {
+		return fmt.Errorf("%w: version %d, expected %d", ErrSchemaTooNew, current, latest)
+	}
+	return nil
+}
+
+// schemaVersion returns the version of the database's schema, 0 if it
+// predates versioning.
+func schemaVersion(ctx context.Context, db dbtx) (int, error) {
+	var versioned bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version')").Scan(&versioned)
+	if err != nil || !versioned {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, "SELECT coalesce(max(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// isEmpty reports whether the database has no tables at all.
+func isEmpty(ctx context.Context, db dbtx) (bool, error) {
+	var tables int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables)
+	return tables == 0, err
+}
+
+func pendingMigrations(current int) []Migration {
+	pending := make([]Migration, 0)
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+func latestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
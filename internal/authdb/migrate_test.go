@@ -0,0 +1,270 @@
+package authdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/khaugen7/kerberos-go/internal/utils"
+)
+
+// newV0Database creates a database as the first release did, before the
+// schema was versioned, and returns its path.
+func newV0Database(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kerberos.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range []string{
+		`CREATE TABLE user_auth (
+        id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "first_name" TEXT,
+        "last_name" TEXT,
+        "username" TEXT UNIQUE,
+        "key" TEXT);`,
+		`CREATE TABLE keys (
+        id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "key_name" TEXT UNIQUE,
+        "key" TEXT);`,
+		`INSERT INTO user_auth (first_name, last_name, username, key) VALUES ('John', 'Doe', 'jdoe', 'aabbcc')`,
+		`INSERT INTO keys (key_name, key) VALUES ('as-tgs', '112233'), ('tgs-fs', '445566')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// schemaOf returns the SQL of every table and index in the database at path.
+func schemaOf(t *testing.T, path string) []string {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT coalesce(sql, '') FROM sqlite_master ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	schema := make([]string, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		schema = append(schema, s)
+	}
+	return schema
+}
+
+func versionOf(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	version, err := schemaVersion(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("Expected migration %d to have version %d, got %d", i, i+1, m.Version)
+		}
+	}
+}
+
+func TestMigrateDbDryRun(t *testing.T) {
+	ctx := context.Background()
+	path := newV0Database(t)
+	before := schemaOf(t, path)
+
+	plan, err := MigrateDb(ctx, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Current != 0 || plan.Latest != latestVersion() || plan.Backup != "" {
+		t.Errorf("Unexpected plan %+v", plan)
+	}
+	if len(plan.Steps) != len(migrations) {
+		t.Fatalf("Expected %d steps, got %d", len(migrations), len(plan.Steps))
+	}
+	for i, m := range plan.Steps {
+		if m.Version != migrations[i].Version {
+			t.Errorf("Expected step %d to be version %d, got %d", i, migrations[i].Version, m.Version)
+		}
+	}
+
+	if after := schemaOf(t, path); !reflect.DeepEqual(before, after) {
+		t.Errorf("Dry run changed the schema:\n%v\n%v", before, after)
+	}
+	if backups, _ := filepath.Glob(path + ".*.bak"); len(backups) != 0 {
+		t.Errorf("Dry run made backups %v", backups)
+	}
+}
+
+func TestMigrateDb(t *testing.T) {
+	ctx := context.Background()
+	path := newV0Database(t)
+
+	plan, err := MigrateDb(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != len(migrations) {
+		t.Errorf("Expected %d steps, got %d", len(migrations), len(plan.Steps))
+	}
+	if version := versionOf(t, path); version != latestVersion() {
+		t.Errorf("Expected version %d after migrating, got %d", latestVersion(), version)
+	}
+
+	// Each step is recorded in order
+	store, err := openSqlite(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	rows, err := store.db.QueryContext(ctx, "SELECT version FROM schema_version ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := make([]int, 0)
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		applied = append(applied, v)
+	}
+	rows.Close()
+	for i, v := range applied {
+		if v != i+1 {
+			t.Errorf("Expected step %d applied in position %d, got %v", i+1, i, applied)
+			break
+		}
+	}
+	if err := checkSchema(ctx, store.db); err != nil {
+		t.Errorf("Migrated database rejected: %v", err)
+	}
+
+	// The data moves with the schema
+	var key string
+	err = store.db.QueryRowContext(ctx, "SELECT k.key FROM user_keys k JOIN user_auth u ON u.id = k.user_id WHERE u.username = 'jdoe'").Scan(&key)
+	if err != nil || key != "aabbcc" {
+		t.Errorf("Expected jdoe's key in user_keys, got %q, %v", key, err)
+	}
+	if err := store.db.QueryRowContext(ctx, "SELECT key FROM shared_keys WHERE key_name = 'as-tgs' AND kvno = 1").Scan(&key); err != nil || key != "112233" {
+		t.Errorf("Expected the as-tgs key in shared_keys, got %q, %v", key, err)
+	}
+
+	// The backup is the database as it was
+	if plan.Backup == "" || !utils.FileExists(plan.Backup) {
+		t.Fatalf("Expected a backup, got %q", plan.Backup)
+	}
+	if version := versionOf(t, plan.Backup); version != 0 {
+		t.Errorf("Expected the backup at version 0, got %d", version)
+	}
+	if !reflect.DeepEqual(schemaOf(t, plan.Backup), schemaOf(t, newV0Database(t))) {
+		t.Error("Backup does not have the schema the database had")
+	}
+
+	// Nothing is left to do
+	plan, err = MigrateDb(ctx, path, false)
+	if err != nil || len(plan.Steps) != 0 || plan.Backup != "" {
+		t.Errorf("Expected nothing to migrate, got %+v, %v", plan, err)
+	}
+}
+
+func TestMigrateDbStepsAreTransactions(t *testing.T) {
+	ctx := context.Background()
+	path := newV0Database(t)
+
+	failure := errors.New("step failed")
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(append([]Migration{}, saved...), Migration{latestVersion() + 1, "Fail halfway", func(ctx context.Context, db dbtx) error {
+		if _, err := db.ExecContext(ctx, "CREATE TABLE half_done (id INTEGER)"); err != nil {
+			return err
+		}
+		return failure
+	}})
+
+	if _, err := MigrateDb(ctx, path, false); !errors.Is(err, failure) {
+		t.Fatalf("Expected the failing step's error, got %v", err)
+	}
+	if version := versionOf(t, path); version != len(saved) {
+		t.Errorf("Expected the database left at version %d, got %d", len(saved), version)
+	}
+	for _, s := range schemaOf(t, path) {
+		if s == "CREATE TABLE half_done (id INTEGER)" {
+			t.Error("Failed step was not rolled back")
+		}
+	}
+}
+
+func TestMigrateDbRefusesUsernamesClashing(t *testing.T) {
+	ctx := context.Background()
+	path := newV0Database(t)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO user_auth (first_name, last_name, username) VALUES ('Jane', 'Doe', 'JDoe')")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateDb(ctx, path, false); err == nil {
+		t.Fatal("Expected migrating usernames that differ only in case to fail")
+	}
+	if version := versionOf(t, path); version != latestVersion()-1 {
+		t.Errorf("Expected the database left at version %d, got %d", latestVersion()-1, version)
+	}
+}
+
+func TestCheckSchemaRejectsUnmigrated(t *testing.T) {
+	ctx := context.Background()
+	path := newV0Database(t)
+
+	if _, err := SqliteConnect(ctx, path, nil); !errors.Is(err, ErrMigrationRequired) {
+		t.Errorf("Expected ErrMigrationRequired from SqliteConnect, got %v", err)
+	}
+	if _, err := InitializeDb(ctx, path, "EXAMPLE.COM", nil); !errors.Is(err, ErrMigrationRequired) {
+		t.Errorf("Expected ErrMigrationRequired from InitializeDb, got %v", err)
+	}
+
+	if _, err := MigrateDb(ctx, path, false); err != nil {
+		t.Fatal(err)
+	}
+	store, err := openSqlite(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.db.ExecContext(ctx, "INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'From the future', 0)", latestVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchema(ctx, store.db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+	if _, err := MigrateDb(ctx, path, true); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected MigrateDb to refuse a newer database, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package authdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultPolicy is the password policy given to new users, if it exists.
+const DefaultPolicy = "default"
+
+var ErrPasswordRejected = errors.New("authdb: password rejected by policy")
+
+// PasswordPolicy sets the rules a user's new passwords must follow.
+// MinClasses counts the kinds of character a password must mix, out of
+// lower case letters, upper case letters, digits and everything else.
+type PasswordPolicy struct {
+	Name       string
+	MinLength  int
+	MinClasses int
+}
+
+// Check returns ErrPasswordRejected, with the reason, if password breaks p.
+func (p PasswordPolicy) Check(password string) error {
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		return fmt.Errorf("%w %s: it must be at least %d characters long", ErrPasswordRejected, p.Name, p.MinLength)
+	}
+	if n := characterClasses(password); n < p.MinClasses {
+		return fmt.Errorf("%w %s: it must mix at least %d kinds of character", ErrPasswordRejected, p.Name, p.MinClasses)
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	n := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			n++
+		}
+	}
+	return n
+}
+
+// CheckPassword checks password against the policy of user, if they have one.
+func CheckPassword(ctx context.Context, store PrincipalStore, user UserAuth, password string) error {
+	if user.Policy == "" {
+		return nil
+	}
+	policy, err := store.GetPolicy(ctx, user.Policy)
+	if err != nil {
+		return err
+	}
+	return policy.Check(password)
+}
@@ -0,0 +1,215 @@
+package authdb
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+)
+
+var (
+	ErrNoDatabase        = errors.New("authdb: database file does not exist")
+	ErrUserNotFound      = errors.New("authdb: user not found")
+	ErrDuplicateUsername = errors.New("authdb: username already exists")
+	ErrServiceNotFound   = errors.New("authdb: service principal not found")
+	ErrDuplicateService  = errors.New("authdb: service principal already exists")
+	ErrInvalidName       = errors.New("authdb: expected a first and last name separated by a space")
+	ErrPolicyNotFound    = errors.New("authdb: password policy not found")
+	ErrDuplicatePolicy   = errors.New("authdb: password policy already exists")
+	ErrPolicyInUse       = errors.New("authdb: password policy is assigned to users")
+)
+
+// PrincipalStore holds the KDC's principals, their keys, the password
+// policies that apply to them and the administrators who manage them.
+// SQLiteStore keeps them in a database file and MemoryStore in memory.
+// Implementations are safe for concurrent use and report missing or
+// duplicate entries with the errors above.
+type PrincipalStore interface {
+	// AddUser stores a new user with their keys. It returns
+	// ErrDuplicateUsername if the username is taken and ErrPolicyNotFound
+	// if the user is given a policy that does not exist.
+	AddUser(ctx context.Context, user UserAuth) error
+	// AddUsers stores new users as AddUser does, in a single transaction.
+	// If any of them cannot be added none are, and the *BatchError returned
+	// says which one and why.
+	AddUsers(ctx context.Context, users []UserAuth) error
+	// UpdateUser replaces the stored details and keys of a user, with the
+	// same errors as AddUser and ErrUserNotFound.
+	UpdateUser(ctx context.Context, id int, user UserAuth) error
+	// DeleteUser removes a user and all of their keys.
+	DeleteUser(ctx context.Context, id int) error
+	// GetUserByUsername returns the user with username, ignoring case, or
+	// ErrUserNotFound.
+	GetUserByUsername(ctx context.Context, username string) (UserAuth, error)
+	// FindUserByFirstName, FindUserByLastName and FindUserByFirstAndLastName
+	// return the users whose names contain the given ones, ignoring case.
+	// The last takes both names separated by a space.
+	FindUserByFirstName(ctx context.Context, name string) ([]UserAuth, error)
+	FindUserByLastName(ctx context.Context, name string) ([]UserAuth, error)
+	FindUserByFirstAndLastName(ctx context.Context, name string) ([]UserAuth, error)
+	// ListUsers returns every user, ordered by username.
+	ListUsers(ctx context.Context) ([]UserAuth, error)
+
+	// AddService registers a service principal with its keys. It returns
+	// ErrDuplicateService if the principal is already registered.
+	AddService(ctx context.Context, service ServicePrincipal) error
+	// DeleteService removes a service principal and all of its keys.
+	DeleteService(ctx context.Context, id int) error
+	// GetServiceByPrincipal returns the service registered as principal, or
+	// ErrServiceNotFound.
+	GetServiceByPrincipal(ctx context.Context, principal string) (ServicePrincipal, error)
+	// ListServices returns every service, ordered by principal.
+	ListServices(ctx context.Context) ([]ServicePrincipal, error)
+
+	// FindSharedKeys returns every version of a key shared between the
+	// KDC's servers, such as the as-tgs key that seals TGTs.
+	FindSharedKeys(ctx context.Context, keyName string) ([]KeyVersion, error)
+	// RotateSharedKey gives a shared key a new random version. The versions
+	// in use until now remain usable for grace, and versions whose grace
+	// period is already over are removed. It returns ErrNoKey if the key
+	// does not exist.
+	RotateSharedKey(ctx context.Context, keyName string, grace time.Duration, now time.Time) (KeyVersion, error)
+	// RotateServiceKey gives a service a new random key of type etype, as
+	// RotateSharedKey does for shared keys.
+	RotateServiceKey(ctx context.Context, id int, etype encryption.EType, grace time.Duration, now time.Time) (KeyVersion, error)
+
+	// AddPolicy stores a new password policy. It returns ErrDuplicatePolicy
+	// if one with the same name exists.
+	AddPolicy(ctx context.Context, policy PasswordPolicy) error
+	// GetPolicy returns the password policy called name, or
+	// ErrPolicyNotFound.
+	GetPolicy(ctx context.Context, name string) (PasswordPolicy, error)
+	// ListPolicies returns every password policy, ordered by name.
+	ListPolicies(ctx context.Context) ([]PasswordPolicy, error)
+	// DeletePolicy removes a password policy. It returns ErrPolicyInUse if
+	// any user is assigned to it.
+	DeletePolicy(ctx context.Context, name string) error
+
+	// AddAdmin stores a new administrator account. It returns
+	// ErrDuplicateAdmin if the username is taken, ignoring case.
+	AddAdmin(ctx context.Context, admin Admin) error
+	// UpdateAdmin replaces the stored account with admin's Id, with the same
+	// errors as AddAdmin and ErrAdminNotFound.
+	UpdateAdmin(ctx context.Context, admin Admin) error
+	// DeleteAdmin removes an administrator account.
+	DeleteAdmin(ctx context.Context, id int) error
+	// GetAdmin returns the administrator with username, ignoring case, or
+	// ErrAdminNotFound.
+	GetAdmin(ctx context.Context, username string) (Admin, error)
+	// ListAdmins returns every administrator, ordered by username.
+	ListAdmins(ctx context.Context) ([]Admin, error)
+
+	Close() error
+}
+
+// BatchError reports the entry of a batch operation that failed, by its
+// index, and the error it failed with.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("authdb: entry %d: %v", e.Index+1, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+type ServicePrincipal struct {
+	Id        int
+	Principal string
+	Keys      []KeyVersion
+}
+
+type UserAuth struct {
+	Id             int
+	FirstName      string
+	LastName       string
+	Username       string
+	Keys           []UserKey
+	Salt           string
+	Iterations     int
+	RequirePreauth bool
+	// Policy names the password policy new passwords must satisfy, if any
+	Policy string
+}
+
+// UserKey is one of a user's long-term keys. A user has a key for each
+// encryption type, all derived from the same password and salt and sharing
+// a kvno that goes up every time the password is set.
+type UserKey struct {
+	Kvno  int
+	EType encryption.EType
+	Key   string
+}
+
+// KeyParams returns the parameters the user's keys were derived with, for
+// the given encryption type.
+func (u UserAuth) KeyParams(etype encryption.EType) encryption.KeyParams {
+	salt, _ := hex.DecodeString(u.Salt)
+	return encryption.KeyParams{EType: etype, Salt: salt, Iterations: u.Iterations}
+}
+
+// ETypes lists the encryption types the user has keys for.
+func (u UserAuth) ETypes() []encryption.EType {
+	etypes := make([]encryption.EType, len(u.Keys))
+	for i, k := range u.Keys {
+		etypes[i] = k.EType
+	}
+	return etypes
+}
+
+// Key returns the user's key for etype.
+func (u UserAuth) Key(etype encryption.EType) ([]byte, bool) {
+	for _, k := range u.Keys {
+		if k.EType == etype {
+			key, err := hex.DecodeString(k.Key)
+			return key, err == nil
+		}
+	}
+	return nil, false
+}
+
+// Kvno returns the version of the user's keys.
+func (u UserAuth) Kvno() int {
+	kvno := 0
+	for _, k := range u.Keys {
+		if k.Kvno > kvno {
+			kvno = k.Kvno
+		}
+	}
+	return kvno
+}
+
+// SetPassword derives new keys for the user from password with a fresh
+// random salt, one for every supported encryption type, under the next kvno.
+func (u *UserAuth) SetPassword(password string) {
+	params := encryption.NewKeyParams()
+	kvno := u.Kvno() + 1
+	u.Keys = make([]UserKey, 0)
+	for _, etype := range encryption.Supported() {
+		key := params.WithEType(etype).StringToKey(password)
+		u.Keys = append(u.Keys, UserKey{Kvno: kvno, EType: etype, Key: hex.EncodeToString(key)})
+	}
+	u.Salt = hex.EncodeToString(params.Salt)
+	u.Iterations = params.Iterations
+}
+
+// CurrentSharedKey returns the current version of a shared key, or ErrNoKey
+// if the key does not exist.
+func CurrentSharedKey(ctx context.Context, store PrincipalStore, keyName string) (KeyVersion, error) {
+	keys, err := store.FindSharedKeys(ctx, keyName)
+	if err != nil {
+		return KeyVersion{}, err
+	}
+	key, ok := currentKey(keys)
+	if !ok {
+		return KeyVersion{}, fmt.Errorf("%w: %s", ErrNoKey, keyName)
+	}
+	return key, nil
+}
@@ -0,0 +1,212 @@
+package authdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+// forEachStore runs test against a new SQLiteStore and a new MemoryStore,
+// each set up as for realm kerb.DefaultRealm.
+func forEachStore(t *testing.T, test func(t *testing.T, store PrincipalStore)) {
+	t.Run("SQLiteStore", func(t *testing.T) {
+		store, err := InitializeDb(context.Background(), t.TempDir(), kerb.DefaultRealm, passwordSource("master"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		test(t, store)
+	})
+	t.Run("MemoryStore", func(t *testing.T) {
+		store, err := NewMemoryStore(kerb.DefaultRealm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, store)
+	})
+}
+
+// newUser returns a user with a fixed key, as deriving one is slow.
+func newUser(username string) UserAuth {
+	return UserAuth{
+		FirstName:      "John",
+		LastName:       "Doe",
+		Username:       username,
+		Keys:           []UserKey{{Kvno: 1, EType: encryption.DefaultEType, Key: "00112233"}},
+		Salt:           "aabb",
+		Iterations:     1,
+		RequirePreauth: true,
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store PrincipalStore) {
+		ctx := context.Background()
+		if err := store.AddUser(ctx, newUser("jdoe")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddUser(ctx, newUser("asmith")); err != nil {
+			t.Fatal(err)
+		}
+		other, err := store.GetUserByUsername(ctx, "asmith")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Username = "jdoe"
+		if err := store.UpdateUser(ctx, other.Id, other); !errors.Is(err, ErrDuplicateUsername) {
+			t.Errorf("Expected ErrDuplicateUsername renaming onto a user, got %v", err)
+		}
+
+		if _, err := store.GetUserByUsername(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound from GetUserByUsername, got %v", err)
+		}
+		if err := store.UpdateUser(ctx, 999, newUser("nobody")); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound from UpdateUser, got %v", err)
+		}
+		if err := store.DeleteUser(ctx, 999); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound from DeleteUser, got %v", err)
+		}
+
+		if err := store.AddUser(ctx, newUser("jdoe")); !errors.Is(err, ErrDuplicateUsername) {
+			t.Errorf("Expected ErrDuplicateUsername from AddUser, got %v", err)
+		}
+		err = store.AddUsers(ctx, []UserAuth{newUser("bjones"), newUser("jdoe")})
+		var batchErr *BatchError
+		if !errors.Is(err, ErrDuplicateUsername) || !errors.As(err, &batchErr) || batchErr.Index != 1 {
+			t.Errorf("Expected ErrDuplicateUsername for entry 2 from AddUsers, got %v", err)
+		}
+
+		now := time.Now()
+		if _, err := store.RotateSharedKey(ctx, "missing", time.Hour, now); !errors.Is(err, ErrNoKey) {
+			t.Errorf("Expected ErrNoKey from RotateSharedKey, got %v", err)
+		}
+		if _, err := store.RotateServiceKey(ctx, 999, encryption.DefaultEType, time.Hour, now); !errors.Is(err, ErrNoKey) {
+			t.Errorf("Expected ErrNoKey from RotateServiceKey, got %v", err)
+		}
+		if _, err := CurrentSharedKey(ctx, store, "missing"); !errors.Is(err, ErrNoKey) {
+			t.Errorf("Expected ErrNoKey from CurrentSharedKey, got %v", err)
+		}
+	})
+}
+
+func TestStoreConformance(t *testing.T) {
+	fileService := kerb.QualifyPrincipal(kerb.DefaultFileService, kerb.DefaultRealm)
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, store PrincipalStore)
+	}{
+		{"DuplicateUser", func(t *testing.T, ctx context.Context, store PrincipalStore) {
+			if err := store.AddUser(ctx, newUser("jdoe")); err != nil {
+				t.Fatal(err)
+			}
+			for _, username := range []string{"jdoe", "JDoe"} {
+				if err := store.AddUser(ctx, newUser(username)); !errors.Is(err, ErrDuplicateUsername) {
+					t.Errorf("Expected ErrDuplicateUsername adding %s, got %v", username, err)
+				}
+			}
+		}},
+		{"DuplicateService", func(t *testing.T, ctx context.Context, store PrincipalStore) {
+			service := ServicePrincipal{Principal: fileService, Keys: []KeyVersion{{Kvno: 1, EType: encryption.DefaultEType, Key: "00112233"}}}
+			if err := store.AddService(ctx, service); !errors.Is(err, ErrDuplicateService) {
+				t.Errorf("Expected ErrDuplicateService, got %v", err)
+			}
+		}},
+		{"DuplicatePolicy", func(t *testing.T, ctx context.Context, store PrincipalStore) {
+			if err := store.AddPolicy(ctx, PasswordPolicy{Name: "strict", MinLength: 12}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddPolicy(ctx, PasswordPolicy{Name: "strict"}); !errors.Is(err, ErrDuplicatePolicy) {
+				t.Errorf("Expected ErrDuplicatePolicy, got %v", err)
+			}
+		}},
+		{"DuplicateAdmin", func(t *testing.T, ctx context.Context, store PrincipalStore) {
+			if err := store.AddAdmin(ctx, Admin{Username: "root", Role: RoleFull, Salt: "aa", Iterations: 1, Hash: "bb"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddAdmin(ctx, Admin{Username: "ROOT", Role: RoleHelpdesk, Salt: "aa", Iterations: 1, Hash: "bb"}); !errors.Is(err, ErrDuplicateAdmin) {
+				t.Errorf("Expected ErrDuplicateAdmin, got %v", err)
+			}
+		}},
+		{"LookupIgnoresCase", func(t *testing.T, ctx context.Context, store PrincipalStore) {
+			if err := store.AddUser(ctx, newUser("jdoe")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddAdmin(ctx, Admin{Username: "root", Role: RoleFull, Salt: "aa", Iterations: 1, Hash: "bb"}); err != nil {
+				t.Fatal(err)
+			}
+			if user, err := store.GetUserByUsername(ctx, "JDOE"); err != nil || user.Username != "jdoe" {
+				t.Errorf("Expected jdoe, got %+v, %v", user, err)
+			}
+			if admin, err := store.GetAdmin(ctx, "Root"); err != nil || admin.Username != "root" {
+				t.Errorf("Expected root, got %+v, %v", admin, err)
+			}
+			for name, find := range map[string]func() ([]UserAuth, error){
+				"FindUserByFirstName":        func() ([]UserAuth, error) { return store.FindUserByFirstName(ctx, "JOHN") },
+				"FindUserByLastName":         func() ([]UserAuth, error) { return store.FindUserByLastName(ctx, "doe") },
+				"FindUserByFirstAndLastName": func() ([]UserAuth, error) { return store.FindUserByFirstAndLastName(ctx, "john DOE") },
+			} {
+				if users, err := find(); err != nil || len(users) != 1 || users[0].Username != "jdoe" {
+					t.Errorf("Expected %s to find jdoe, got %+v, %v", name, users, err)
+				}
+			}
+		}},
+		{"NotFound", func(t *testing.T, ctx context.Context, store PrincipalStore) {
+			if _, err := store.GetServiceByPrincipal(ctx, "missing@"+kerb.DefaultRealm); !errors.Is(err, ErrServiceNotFound) {
+				t.Errorf("Expected ErrServiceNotFound, got %v", err)
+			}
+			if _, err := store.GetPolicy(ctx, "missing"); !errors.Is(err, ErrPolicyNotFound) {
+				t.Errorf("Expected ErrPolicyNotFound, got %v", err)
+			}
+			if _, err := store.GetAdmin(ctx, "missing"); !errors.Is(err, ErrAdminNotFound) {
+				t.Errorf("Expected ErrAdminNotFound, got %v", err)
+			}
+		}},
+		{"AddUsersRollsBack", func(t *testing.T, ctx context.Context, store PrincipalStore) {
+			if err := store.AddUser(ctx, newUser("jdoe")); err != nil {
+				t.Fatal(err)
+			}
+			missingPolicy := newUser("carol")
+			missingPolicy.Policy = "missing"
+			batches := []struct {
+				users []UserAuth
+				index int
+				err   error
+			}{
+				{[]UserAuth{newUser("bjones"), newUser("asmith"), newUser("jdoe")}, 2, ErrDuplicateUsername},
+				{[]UserAuth{newUser("bjones"), newUser("bjones")}, 1, ErrDuplicateUsername},
+				{[]UserAuth{newUser("bjones"), missingPolicy}, 1, ErrPolicyNotFound},
+			}
+			for _, b := range batches {
+				err := store.AddUsers(ctx, b.users)
+				var batchErr *BatchError
+				if !errors.As(err, &batchErr) || batchErr.Index != b.index || !errors.Is(err, b.err) {
+					t.Errorf("Expected a *BatchError for entry %d wrapping %v, got %v", b.index+1, b.err, err)
+				}
+				users, err := store.ListUsers(ctx)
+				if err != nil || len(users) != 1 || users[0].Username != "jdoe" {
+					t.Errorf("Expected only jdoe after a failed batch, got %+v, %v", users, err)
+				}
+			}
+
+			if err := store.AddUsers(ctx, []UserAuth{newUser("bjones"), newUser("asmith")}); err != nil {
+				t.Fatal(err)
+			}
+			if users, err := store.ListUsers(ctx); err != nil || len(users) != 3 {
+				t.Errorf("Expected 3 users, got %+v, %v", users, err)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store PrincipalStore) {
+				test.run(t, context.Background(), store)
+			})
+		})
+	}
+}
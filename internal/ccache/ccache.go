@@ -0,0 +1,188 @@
+// Package ccache stores a client's Kerberos tickets on disk so that later
+// invocations can reuse them instead of asking for the password again.
+package ccache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+// EnvVar names the environment variable that overrides the cache location.
+const EnvVar = "KERB_CCACHE"
+
+// TGTService is the service name under which the ticket-granting ticket is
+// stored.
+const TGTService = "krbtgt"
+
+// ErrNotPrivate is returned for a cache file that another user could have
+// written or can read.
+var ErrNotPrivate = errors.New("ccache: cache file is not private to this user")
+
+// Credential is a ticket together with the session key needed to use it.
+// The ticket itself is encrypted for the service and is opaque to the client.
+// KeyType is the encryption type of the session key.
+type Credential struct {
+	Client     string
+	Service    string
+	Ticket     []byte
+	SessionKey []byte
+	KeyType    encryption.EType
+	Validity   time.Time
+	RenewTill  time.Time
+	Flags      kerb.TicketFlags
+}
+
+// Renewable reports whether the credential can still be renewed at now.
+func (c Credential) Renewable(now time.Time) bool {
+	return !c.RenewTill.IsZero() && now.Before(c.RenewTill) && now.Before(c.Validity)
+}
+
+// Cache holds the credentials of a single client principal.
+type Cache struct {
+	Principal   string
+	Credentials map[string]Credential
+
+	path string
+}
+
+// DefaultPath returns the cache location named by EnvVar, or a per-user file
+// in the system temporary directory.
+func DefaultPath() string {
+	if path := os.Getenv(EnvVar); path != "" {
+		return path
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("kerb_cc_%d", os.Getuid()))
+}
+
+// Load reads the cache at path. A missing file yields an empty cache. As
+// the default path is in a shared directory, a file that is not a regular
+// file owned by the current user with mode 0600 is refused with
+// ErrNotPrivate, since another user may have planted it.
+func Load(path string) (*Cache, error) {
+	c := &Cache{Credentials: make(map[string]Credential), path: path}
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPrivate(info); err != nil {
+		return nil, fmt.Errorf("%w: %s %v", ErrNotPrivate, path, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("ccache: %s is corrupt: %w", path, err)
+	}
+	if c.Credentials == nil {
+		c.Credentials = make(map[string]Credential)
+	}
+	return c, nil
+}
+
+// checkPrivate returns why the file described by info is not private to
+// the current user, if it is not.
+func checkPrivate(info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return errors.New("is not a regular file")
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("has no owner")
+	}
+	if int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("is owned by uid %d", stat.Uid)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		return fmt.Errorf("has mode %04o rather than 0600", perm)
+	}
+	return nil
+}
+
+// Path returns the file backing the cache.
+func (c *Cache) Path() string {
+	return c.path
+}
+
+// Save writes the cache to disk, readable and writable by the owner only.
+func (c *Cache) Save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// Destroy removes every credential and deletes the cache file.
+func (c *Cache) Destroy() error {
+	c.Principal = ""
+	c.Credentials = make(map[string]Credential)
+
+	err := os.Remove(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Initialize discards any credentials belonging to another principal and
+// stores the client's new TGT.
+func (c *Cache) Initialize(tgt Credential) {
+	if c.Principal != tgt.Client {
+		c.Credentials = make(map[string]Credential)
+	}
+	c.Principal = tgt.Client
+	tgt.Service = TGTService
+	c.Credentials[TGTService] = tgt
+}
+
+// Store adds or replaces the credential for cred.Service.
+func (c *Cache) Store(cred Credential) {
+	c.Credentials[cred.Service] = cred
+}
+
+// TGT returns the cached ticket-granting ticket if it is still valid at now.
+func (c *Cache) TGT(now time.Time) (Credential, bool) {
+	return c.Get(TGTService, now)
+}
+
+// Get returns the cached credential for service if it is still valid at now.
+func (c *Cache) Get(service string, now time.Time) (Credential, bool) {
+	cred, ok := c.Credentials[service]
+	if !ok || !now.Before(cred.Validity) {
+		return Credential{}, false
+	}
+	return cred, true
+}
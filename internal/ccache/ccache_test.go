@@ -0,0 +1,137 @@
+package ccache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func testCredential(client, service string, validity time.Time) Credential {
+	return Credential{
+		Client:     client,
+		Service:    service,
+		Ticket:     []byte("encrypted ticket"),
+		SessionKey: []byte("session key"),
+		Validity:   validity,
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cc")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Initialize(testCredential("jdoe42", "", now.Add(time.Hour)))
+	c.Store(testCredential("jdoe42", "fs", now.Add(time.Hour)))
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected cache permissions 0600, got %o", perm)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Principal != "jdoe42" {
+		t.Errorf("Expected principal jdoe42, got %s", loaded.Principal)
+	}
+	tgt, ok := loaded.TGT(now)
+	if !ok || string(tgt.SessionKey) != "session key" {
+		t.Errorf("TGT not restored: %v", tgt)
+	}
+	if _, ok := loaded.Get("fs", now); !ok {
+		t.Error("Service ticket not restored")
+	}
+}
+
+func TestExpiredCredentials(t *testing.T) {
+	c, _ := Load(filepath.Join(t.TempDir(), "cc"))
+	c.Initialize(testCredential("jdoe42", "", now.Add(time.Minute)))
+
+	if _, ok := c.TGT(now); !ok {
+		t.Error("Valid TGT not returned")
+	}
+	if _, ok := c.TGT(now.Add(time.Minute)); ok {
+		t.Error("Expired TGT returned")
+	}
+	if _, ok := c.Get("fs", now); ok {
+		t.Error("Missing service ticket returned")
+	}
+}
+
+func TestInitializeReplacesOtherPrincipal(t *testing.T) {
+	c, _ := Load(filepath.Join(t.TempDir(), "cc"))
+	c.Initialize(testCredential("jdoe42", "", now.Add(time.Hour)))
+	c.Store(testCredential("jdoe42", "fs", now.Add(time.Hour)))
+
+	c.Initialize(testCredential("asmith", "", now.Add(time.Hour)))
+	if _, ok := c.Get("fs", now); ok {
+		t.Error("Service ticket of previous principal kept")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cc")
+	c, _ := Load(path)
+	c.Initialize(testCredential("jdoe42", "", now.Add(time.Hour)))
+	c.Save()
+
+	if err := c.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Cache file still exists")
+	}
+	if err := c.Destroy(); err != nil {
+		t.Errorf("Destroying an empty cache failed: %v", err)
+	}
+}
+
+func TestLoadRefusesFilesNotPrivate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cc")
+	c, _ := Load(path)
+	c.Initialize(testCredential("jdoe42", "", now.Add(time.Hour)))
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(link); !errors.Is(err, ErrNotPrivate) {
+		t.Errorf("Expected a symlink to be refused, got %v", err)
+	}
+
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); !errors.Is(err, ErrNotPrivate) {
+		t.Errorf("Expected a file others can read to be refused, got %v", err)
+	}
+	os.Chmod(path, 0600)
+
+	// Only root can give a file away
+	if os.Getuid() == 0 {
+		if err := os.Chown(path, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); !errors.Is(err, ErrNotPrivate) {
+			t.Errorf("Expected a file owned by another user to be refused, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// aeadEnctype is an encryption type built on an AEAD cipher with a 256 bit
+// key. The ciphertext is a random nonce followed by the sealed data, and the
+// key usage is authenticated as additional data.
+type aeadEnctype struct {
+	etype   EType
+	name    string
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+func (e aeadEnctype) EType() EType { return e.etype }
+func (e aeadEnctype) Name() string { return e.name }
+func (e aeadEnctype) KeySize() int { return 32 }
+
+func (e aeadEnctype) GenerateKey() []byte {
+	return GenerateRandomBytes(e.KeySize())
+}
+
+// StringToKey is PBKDF2-HMAC-SHA256, or a single SHA-256 for keys created
+// before salts were stored. Every type but AES-GCM, which predates the
+// others, then derives its own key from the result so that the same
+// password never gives two types the same key.
+func (e aeadEnctype) StringToKey(password string, salt []byte, iterations int) []byte {
+	var key []byte
+	if iterations == 0 {
+		h := sha256.Sum256(append(append([]byte{}, salt...), password...))
+		key = h[:]
+	} else {
+		key = pbkdf2.Key([]byte(password), salt, iterations, 32, sha256.New)
+	}
+	if e.etype == ETypeAES256GCM {
+		return key
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(e.name))
+	return mac.Sum(nil)
+}
+
+func (e aeadEnctype) Encrypt(key []byte, usage uint32, plaintext []byte) ([]byte, error) {
+	aead, err := e.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, usageBytes(usage)), nil
+}
+
+func (e aeadEnctype) Decrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	aead, err := e.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, ErrInvalidCiphertext
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	return aead.Open(nil, nonce, ciphertext, usageBytes(usage))
+}
+
+// Checksum is HMAC-SHA256 under a key derived for the usage.
+func (e aeadEnctype) Checksum(key []byte, usage uint32, data []byte) ([]byte, error) {
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("checksum"))
+	derive.Write(usageBytes(usage))
+
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func usageBytes(usage uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, usage)
+	return b
+}
@@ -0,0 +1,211 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// defaultCTSIterations is the RFC 3962 iteration count used when none is
+// given.
+const defaultCTSIterations = 4096
+
+const hmacSHA196Size = 12
+
+// aesCTSEnctype is aes256-cts-hmac-sha1-96 from RFC 3962, built with the
+// RFC 3961 simplified profile: keys for encryption, integrity and checksums
+// are derived from the base key and the usage, data is encrypted with AES in
+// CBC mode with ciphertext stealing behind a random confounder, and protected
+// by a truncated HMAC-SHA1.
+type aesCTSEnctype struct{}
+
+func (aesCTSEnctype) EType() EType { return ETypeAES256CTSHMACSHA196 }
+func (aesCTSEnctype) Name() string { return "aes256-cts-hmac-sha1-96" }
+func (aesCTSEnctype) KeySize() int { return 32 }
+
+func (e aesCTSEnctype) GenerateKey() []byte {
+	return GenerateRandomBytes(e.KeySize())
+}
+
+func (e aesCTSEnctype) StringToKey(password string, salt []byte, iterations int) []byte {
+	if iterations == 0 {
+		iterations = defaultCTSIterations
+	}
+	tkey := pbkdf2.Key([]byte(password), salt, iterations, e.KeySize(), sha1.New)
+	return deriveKey(tkey, []byte("kerberos"))
+}
+
+func (e aesCTSEnctype) Encrypt(key []byte, usage uint32, plaintext []byte) ([]byte, error) {
+	ke := deriveKey(key, usageConstant(usage, 0xAA))
+	ki := deriveKey(key, usageConstant(usage, 0x55))
+
+	data := append(GenerateRandomBytes(aes.BlockSize), plaintext...)
+	ciphertext, err := encryptCTS(ke, data)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha1.New, ki)
+	mac.Write(data)
+	return append(ciphertext, mac.Sum(nil)[:hmacSHA196Size]...), nil
+}
+
+func (e aesCTSEnctype) Decrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize+hmacSHA196Size {
+		return nil, ErrInvalidCiphertext
+	}
+	ke := deriveKey(key, usageConstant(usage, 0xAA))
+	ki := deriveKey(key, usageConstant(usage, 0x55))
+
+	split := len(ciphertext) - hmacSHA196Size
+	data, err := decryptCTS(ke, ciphertext[:split])
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha1.New, ki)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil)[:hmacSHA196Size], ciphertext[split:]) {
+		return nil, ErrInvalidCiphertext
+	}
+	return data[aes.BlockSize:], nil
+}
+
+func (e aesCTSEnctype) Checksum(key []byte, usage uint32, data []byte) ([]byte, error) {
+	kc := deriveKey(key, usageConstant(usage, 0x99))
+	mac := hmac.New(sha1.New, kc)
+	mac.Write(data)
+	return mac.Sum(nil)[:hmacSHA196Size], nil
+}
+
+func usageConstant(usage uint32, kind byte) []byte {
+	return append(usageBytes(usage), kind)
+}
+
+// deriveKey is DK from RFC 3961: AES applied repeatedly to the constant
+// n-folded to the block size, until there are enough bytes for a key.
+func deriveKey(key, constant []byte) []byte {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	block := nfold(constant, aes.BlockSize)
+	derived := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(derived) < len(key) {
+		next := make([]byte, aes.BlockSize)
+		c.Encrypt(next, block)
+		derived = append(derived, next...)
+		block = next
+	}
+	return derived[:len(key)]
+}
+
+// nfold stretches or shrinks in to n bytes as described in RFC 3961
+// section 5.1.
+func nfold(in []byte, n int) []byte {
+	inBytes := len(in)
+	lcm := n * inBytes / gcd(n, inBytes)
+
+	out := make([]byte, n)
+	carry := 0
+	for i := lcm - 1; i >= 0; i-- {
+		msbit := ((inBytes << 3) - 1 +
+			((inBytes<<3)+13)*(i/inBytes) +
+			((inBytes - i%inBytes) << 3)) % (inBytes << 3)
+		hi := int(in[(inBytes-1-(msbit>>3))%inBytes])
+		lo := int(in[(inBytes-(msbit>>3))%inBytes])
+		carry += ((hi<<8 | lo) >> ((msbit & 7) + 1)) & 0xff
+		carry += int(out[i%n])
+		out[i%n] = byte(carry)
+		carry >>= 8
+	}
+	for i := n - 1; carry != 0 && i >= 0; i-- {
+		carry += int(out[i])
+		out[i] = byte(carry)
+		carry >>= 8
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// encryptCTS encrypts data of at least one block with AES-CBC and a zero IV,
+// stealing ciphertext from the second to last block so the output is as long
+// as the input. The last two blocks are swapped as in RFC 3962.
+func encryptCTS(key, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aes.BlockSize {
+		return nil, ErrInvalidCiphertext
+	}
+
+	padded := make([]byte, (len(data)+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, data)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(c, make([]byte, aes.BlockSize)).CryptBlocks(out, padded)
+	if len(out) == aes.BlockSize {
+		return out, nil
+	}
+
+	last := len(out) - aes.BlockSize
+	secondLast := last - aes.BlockSize
+	tail := len(data) - last
+	result := append([]byte{}, out[:secondLast]...)
+	result = append(result, out[last:]...)
+	return append(result, out[secondLast:secondLast+tail]...), nil
+}
+
+func decryptCTS(key, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aes.BlockSize {
+		return nil, ErrInvalidCiphertext
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if len(data) == aes.BlockSize {
+		out := make([]byte, aes.BlockSize)
+		cipher.NewCBCDecrypter(c, iv).CryptBlocks(out, data)
+		return out, nil
+	}
+
+	blocks := (len(data) + aes.BlockSize - 1) / aes.BlockSize
+	secondLast := (blocks - 2) * aes.BlockSize
+	last := secondLast + aes.BlockSize
+	tail := len(data) - last
+
+	out := make([]byte, len(data))
+	if secondLast > 0 {
+		cipher.NewCBCDecrypter(c, iv).CryptBlocks(out[:secondLast], data[:secondLast])
+		iv = data[secondLast-aes.BlockSize : secondLast]
+	}
+
+	// The block sent second to last is the real last block; decrypting it
+	// gives the last plaintext XORed with the stolen ciphertext, and the
+	// bytes of the real second to last block that were not sent
+	d := make([]byte, aes.BlockSize)
+	c.Decrypt(d, data[secondLast:last])
+	prev := append(append([]byte{}, data[last:]...), d[tail:]...)
+	for i := 0; i < tail; i++ {
+		out[last+i] = d[i] ^ data[last+i]
+	}
+
+	c.Decrypt(d, prev)
+	for i := 0; i < aes.BlockSize; i++ {
+		out[secondLast+i] = d[i] ^ iv[i]
+	}
+	return out, nil
+}
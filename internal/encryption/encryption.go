@@ -4,23 +4,22 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 )
 
+// RealmName salted every key before keys had their own salt. It is kept to
+// derive keys created back then.
 const RealmName = "@KERBEROS"
 
+var ErrInvalidCiphertext = errors.New("encryption: invalid ciphertext")
+
+// DeriveSecretKey derives a key the way it was done before keys had their
+// own salt. New keys use NewKeyParams instead.
 func DeriveSecretKey(username, password string) []byte {
-	saltedPass := []byte(RealmName + username + password)
-	h := sha256.New()
-	_, err := h.Write(saltedPass)
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
-	return h.Sum(nil)
+	return LegacyKeyParams(username).StringToKey(password)
 }
 
 func GenerateRandomBytes(n int) []byte {
@@ -73,7 +72,7 @@ func Decrypt(key []byte, ciphertext []byte, p any) error {
 	nonceSize := gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
 		log.Println("Invalid ciphertext")
-		return err
+		return ErrInvalidCiphertext
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
@@ -90,3 +89,41 @@ func Decrypt(key []byte, ciphertext []byte, p any) error {
 	}
 	return nil
 }
+
+// EncryptWith marshals data and encrypts it under key with the given
+// encryption type and key usage.
+func EncryptWith(etype EType, key []byte, usage uint32, data any) ([]byte, error) {
+	e, ok := enctypeFor(etype)
+	if !ok {
+		return nil, ErrUnknownEType
+	}
+
+	byteData, err := json.Marshal(data)
+	if err != nil {
+		log.Println("Failed to marshal data", err)
+		return nil, err
+	}
+
+	return e.Encrypt(key, usage, byteData)
+}
+
+// DecryptWith is the inverse of EncryptWith.
+func DecryptWith(etype EType, key []byte, usage uint32, ciphertext []byte, p any) error {
+	e, ok := enctypeFor(etype)
+	if !ok {
+		return ErrUnknownEType
+	}
+
+	data, err := e.Decrypt(key, usage, ciphertext)
+	if err != nil {
+		log.Println("Failed to decode data")
+		return err
+	}
+
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		log.Println("Failed to unmarshal data")
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package encryption
 
 import (
+	"bytes"
 	"encoding/hex"
 	"reflect"
 	"testing"
@@ -84,3 +85,137 @@ func TestDecrypt(t *testing.T) {
 		}
 	}
 }
+
+func TestStringToKey(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vector from RFC 7914
+	params := KeyParams{Salt: []byte("salt"), Iterations: 1}
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	if output := hex.EncodeToString(params.StringToKey("passwd")); output != expected {
+		t.Errorf("Output %s not equal to expected %s", output, expected)
+	}
+
+	legacy := LegacyKeyParams("jdoe42").StringToKey("mypass123")
+	if !reflect.DeepEqual(legacy, DeriveSecretKey("jdoe42", "mypass123")) {
+		t.Error("Legacy parameters do not reproduce DeriveSecretKey")
+	}
+
+	first, second := NewKeyParams(), NewKeyParams()
+	if len(first.Salt) != SaltSize || first.Iterations != DefaultIterations {
+		t.Errorf("Unexpected new parameters %v", first)
+	}
+	if reflect.DeepEqual(first.Salt, second.Salt) {
+		t.Error("Two principals were given the same salt")
+	}
+}
+
+func TestAESCTSVectors(t *testing.T) {
+	// Test vectors from RFC 3962 appendix B
+	if output := hex.EncodeToString(nfold([]byte("kerberos"), 16)); output != "6b65726265726f737b9b5b2b93132b93" {
+		t.Errorf("n-fold output %s is wrong", output)
+	}
+
+	e, _ := Lookup(ETypeAES256CTSHMACSHA196)
+	s2kTests := []struct {
+		iterations int
+		expected   string
+	}{
+		{1, "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+		{2, "a2e16d16b36069c135d5e9d2e25f896102685618b95914b467c67622225824ff"},
+	}
+	for _, test := range s2kTests {
+		output := hex.EncodeToString(e.StringToKey("password", []byte("ATHENA.MIT.EDUraeburn"), test.iterations))
+		if output != test.expected {
+			t.Errorf("string-to-key with %d iterations gave %s, expected %s", test.iterations, output, test.expected)
+		}
+	}
+
+	key := []byte("chicken teriyaki")
+	plaintext, _ := hex.DecodeString("4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c")
+	ctsTests := []struct {
+		length   int
+		expected string
+	}{
+		{17, "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{31, "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{32, "39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+	}
+	for _, test := range ctsTests {
+		ciphertext, _ := encryptCTS(key, plaintext[:test.length])
+		if output := hex.EncodeToString(ciphertext); output != test.expected {
+			t.Errorf("CTS of %d bytes gave %s, expected %s", test.length, output, test.expected)
+		}
+		decrypted, _ := decryptCTS(key, ciphertext)
+		if !reflect.DeepEqual(decrypted, plaintext[:test.length]) {
+			t.Errorf("CTS of %d bytes did not decrypt to the plaintext", test.length)
+		}
+	}
+}
+
+func TestEnctypes(t *testing.T) {
+	for _, etype := range Supported() {
+		e, _ := Lookup(etype)
+		key := e.GenerateKey()
+		for _, length := range []int{0, 1, 16, 17, 40} {
+			plaintext := GenerateRandomBytes(length)
+			ciphertext, err := e.Encrypt(key, 3, plaintext)
+			if err != nil {
+				t.Fatalf("%s: %v", etype, err)
+			}
+			if output, err := e.Decrypt(key, 3, ciphertext); err != nil || !bytes.Equal(output, plaintext) {
+				t.Errorf("%s: %d bytes did not round trip: %v", etype, length, err)
+			}
+			if _, err := e.Decrypt(key, 4, ciphertext); err == nil {
+				t.Errorf("%s: ciphertext accepted for another key usage", etype)
+			}
+		}
+
+		if err := VerifyChecksum(etype, key, 6, []byte("data"), mustChecksum(t, etype, key, 6, []byte("data"))); err != nil {
+			t.Errorf("%s: checksum did not verify: %v", etype, err)
+		}
+		if err := VerifyChecksum(etype, key, 6, []byte("date"), mustChecksum(t, etype, key, 6, []byte("data"))); err == nil {
+			t.Errorf("%s: checksum verified for other data", etype)
+		}
+	}
+
+	params := NewKeyParams()
+	gcm := params.StringToKey("pw")
+	chacha := params.WithEType(ETypeChaCha20Poly1305).StringToKey("pw")
+	if reflect.DeepEqual(gcm, chacha) {
+		t.Error("Two encryption types derived the same key from a password")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		offered, available []EType
+		expected           EType
+		err                error
+	}{
+		{Supported(), Supported(), ETypeAES256GCM, nil},
+		{[]EType{ETypeAES256CTSHMACSHA196, ETypeChaCha20Poly1305}, Supported(), ETypeChaCha20Poly1305, nil},
+		{Supported(), []EType{ETypeAES256CTSHMACSHA196}, ETypeAES256CTSHMACSHA196, nil},
+		{[]EType{ETypeAES256GCM}, []EType{ETypeAES256CTSHMACSHA196}, 0, ErrNoCommonEType},
+	}
+	for _, test := range tests {
+		etype, err := Negotiate(test.offered, test.available)
+		if etype != test.expected || err != test.err {
+			t.Errorf("Negotiate(%v, %v) = %v, %v, expected %v, %v", test.offered, test.available, etype, err, test.expected, test.err)
+		}
+	}
+
+	etypes, err := ParseETypes("chacha20-poly1305, 18")
+	if err != nil || FormatETypes(etypes) != "chacha20-poly1305,aes256-cts-hmac-sha1-96" {
+		t.Errorf("ParseETypes gave %v, %v", etypes, err)
+	}
+	if _, err := ParseETypes("des-cbc-crc"); err == nil {
+		t.Error("ParseETypes accepted an unknown type")
+	}
+}
+
+func mustChecksum(t *testing.T, etype EType, key []byte, usage uint32, data []byte) []byte {
+	checksum, err := Checksum(etype, key, usage, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checksum
+}
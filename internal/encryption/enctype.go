@@ -0,0 +1,200 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EType identifies an encryption type. Types defined by an RFC use their
+// number from the IANA Kerberos registry, the others use negative numbers,
+// which RFC 3961 reserves for local use.
+type EType int32
+
+const (
+	ETypeAES256CTSHMACSHA196 EType = 18
+	ETypeAES256GCM           EType = -1
+	ETypeChaCha20Poly1305    EType = -2
+)
+
+// DefaultEType is used where no encryption type has been negotiated, such as
+// for the key shared by the AS and TGS.
+const DefaultEType = ETypeAES256GCM
+
+var (
+	ErrUnknownEType  = errors.New("encryption: unknown encryption type")
+	ErrNoCommonEType = errors.New("encryption: no common encryption type")
+	ErrBadChecksum   = errors.New("encryption: checksum mismatch")
+)
+
+// Enctype is an encryption type as in RFC 3961: a way of deriving keys and of
+// encrypting and checksumming data under them. The key usage number keeps
+// ciphertexts and checksums made for one purpose from being accepted for
+// another.
+type Enctype interface {
+	EType() EType
+	Name() string
+	KeySize() int
+
+	// GenerateKey returns a new random key.
+	GenerateKey() []byte
+	// StringToKey derives a key from a password.
+	StringToKey(password string, salt []byte, iterations int) []byte
+
+	Encrypt(key []byte, usage uint32, plaintext []byte) ([]byte, error)
+	Decrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error)
+	Checksum(key []byte, usage uint32, data []byte) ([]byte, error)
+}
+
+// enctypes holds the registered types, strongest first.
+var enctypes []Enctype
+
+// Register adds e to the registry with a lower preference than every type
+// registered before it.
+func Register(e Enctype) {
+	if _, ok := Lookup(e.EType()); ok {
+		panic(fmt.Sprintf("encryption: %s registered twice", e.Name()))
+	}
+	enctypes = append(enctypes, e)
+}
+
+func init() {
+	Register(aeadEnctype{etype: ETypeAES256GCM, name: "aes256-gcm", newAEAD: newAESGCM})
+	Register(aeadEnctype{etype: ETypeChaCha20Poly1305, name: "chacha20-poly1305", newAEAD: newChaCha20Poly1305})
+	Register(aesCTSEnctype{})
+}
+
+// Lookup returns the registered implementation of etype.
+func Lookup(etype EType) (Enctype, bool) {
+	for _, e := range enctypes {
+		if e.EType() == etype {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// enctypeFor is Lookup for places where a zero EType, from data written
+// before encryption types were recorded, means DefaultEType.
+func enctypeFor(etype EType) (Enctype, bool) {
+	if etype == 0 {
+		etype = DefaultEType
+	}
+	return Lookup(etype)
+}
+
+// Supported lists every registered type, strongest first.
+func Supported() []EType {
+	etypes := make([]EType, len(enctypes))
+	for i, e := range enctypes {
+		etypes[i] = e.EType()
+	}
+	return etypes
+}
+
+// Negotiate picks the strongest registered type that appears in every one of
+// the lists given, such as the types a client offers and those a principal
+// has keys for.
+func Negotiate(lists ...[]EType) (EType, error) {
+	for _, e := range enctypes {
+		common := true
+		for _, list := range lists {
+			if !containsEType(list, e.EType()) {
+				common = false
+				break
+			}
+		}
+		if common {
+			return e.EType(), nil
+		}
+	}
+	return 0, ErrNoCommonEType
+}
+
+func containsEType(list []EType, etype EType) bool {
+	for _, e := range list {
+		if e == etype {
+			return true
+		}
+	}
+	return false
+}
+
+func (e EType) String() string {
+	if enctype, ok := Lookup(e); ok {
+		return enctype.Name()
+	}
+	return strconv.Itoa(int(e))
+}
+
+// ParseETypes reads a comma separated list of type names or numbers.
+func ParseETypes(s string) ([]EType, error) {
+	etypes := make([]EType, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		etype, err := parseEType(name)
+		if err != nil {
+			return nil, err
+		}
+		etypes = append(etypes, etype)
+	}
+	return etypes, nil
+}
+
+func parseEType(name string) (EType, error) {
+	for _, e := range enctypes {
+		if e.Name() == name {
+			return e.EType(), nil
+		}
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if _, ok := Lookup(EType(n)); ok {
+			return EType(n), nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownEType, name)
+}
+
+// FormatETypes is the inverse of ParseETypes.
+func FormatETypes(etypes []EType) string {
+	names := make([]string, len(etypes))
+	for i, e := range etypes {
+		names[i] = e.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// GenerateKey returns a new random key for etype.
+func GenerateKey(etype EType) ([]byte, error) {
+	e, ok := enctypeFor(etype)
+	if !ok {
+		return nil, ErrUnknownEType
+	}
+	return e.GenerateKey(), nil
+}
+
+// Checksum computes a keyed checksum of data.
+func Checksum(etype EType, key []byte, usage uint32, data []byte) ([]byte, error) {
+	e, ok := enctypeFor(etype)
+	if !ok {
+		return nil, ErrUnknownEType
+	}
+	return e.Checksum(key, usage, data)
+}
+
+// VerifyChecksum checks a checksum made by Checksum.
+func VerifyChecksum(etype EType, key []byte, usage uint32, data, checksum []byte) error {
+	expected, err := Checksum(etype, key, usage, data)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, checksum) {
+		return ErrBadChecksum
+	}
+	return nil
+}
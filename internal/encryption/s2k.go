@@ -0,0 +1,47 @@
+package encryption
+
+// DefaultIterations is the PBKDF2 iteration count given to new keys.
+const DefaultIterations = 310000
+
+// SaltSize is the length of the random salt given to each principal.
+const SaltSize = 16
+
+// KeyParams are the string-to-key parameters of a principal: what the client
+// needs besides the password to derive the same key as the KDC. They play
+// the part of an RFC 4120 ETYPE-INFO2 entry.
+//
+// An Iterations of zero selects the single SHA-256 used before salts were
+// stored, in which case Salt is RealmName followed by the username the key
+// was created under.
+type KeyParams struct {
+	EType      EType
+	Salt       []byte
+	Iterations int
+}
+
+// NewKeyParams returns a fresh random salt with DefaultIterations for the
+// default encryption type.
+func NewKeyParams() KeyParams {
+	return KeyParams{EType: DefaultEType, Salt: GenerateRandomBytes(SaltSize), Iterations: DefaultIterations}
+}
+
+// LegacyKeyParams returns the parameters of a key created by DeriveSecretKey.
+func LegacyKeyParams(username string) KeyParams {
+	return KeyParams{EType: DefaultEType, Salt: []byte(RealmName + username)}
+}
+
+// WithEType returns the same salt and iterations for another encryption type.
+func (p KeyParams) WithEType(etype EType) KeyParams {
+	p.EType = etype
+	return p
+}
+
+// StringToKey derives a key for p.EType from password. Parameters without an
+// encryption type are for the default one.
+func (p KeyParams) StringToKey(password string) []byte {
+	e, ok := enctypeFor(p.EType)
+	if !ok {
+		return nil
+	}
+	return e.StringToKey(password, p.Salt, p.Iterations)
+}
@@ -0,0 +1,142 @@
+// Package kadmin defines the messages of the remote administration protocol
+// spoken between kerb-admin and the kadmin endpoint of the AS.
+//
+// A request is sent like an AP-REQ to a service: a ticket for
+// kerb.KadminService and an authenticator, followed by the Request encrypted
+// under the ticket's session key. The authenticator's checksum covers the
+// encrypted request, so that it cannot be paired with another. The reply is
+// the Reply encrypted under the same session key, with an AP-REP in the
+// X-Ap-Rep header proving that the AS decrypted the ticket.
+//
+// Password changes are sent the same way to PasswdPath, with a ticket for
+// kerb.ChangePwService and a PasswdRequest, and are answered with a Reply.
+// The ticket must have the INITIAL flag, which only tickets issued by the AS
+// have, so that a stolen TGT cannot be used to change the password.
+package kadmin
+
+// Path is where the AS serves the protocol.
+const Path = "/kadmin"
+
+// PasswdPath is where the AS serves password changes.
+const PasswdPath = "/kpasswd"
+
+// Key usages of the encrypted requests and replies, from the range RFC 4120
+// leaves to applications.
+const (
+	KeyUsageRequest       uint32 = 1025
+	KeyUsageReply         uint32 = 1026
+	KeyUsagePasswdRequest uint32 = 1027
+	KeyUsagePasswdReply   uint32 = 1028
+)
+
+// Op is an operation on a user.
+type Op string
+
+const (
+	OpAdd         Op = "add"
+	OpModify      Op = "modify"
+	OpDelete      Op = "delete"
+	OpList        Op = "list"
+	OpGet         Op = "get"
+	OpSetPassword Op = "set-password"
+)
+
+// Request asks for Op to be applied to the user called Username. Add and
+// modify only set the fields that are not nil; a modified Policy of "" removes
+// the user's policy. Password is the password of a new user, or the one
+// set-password gives the user.
+type Request struct {
+	Op             Op
+	Username       string
+	FirstName      *string
+	LastName       *string
+	Rename         *string
+	Policy         *string
+	RequirePreauth *bool
+	Password       string
+}
+
+// Status says whether a request succeeded, and if not why.
+type Status string
+
+const (
+	StatusOK       Status = "ok"
+	StatusDenied   Status = "denied"
+	StatusNotFound Status = "not-found"
+	StatusExists   Status = "exists"
+	StatusRejected Status = "rejected"
+	StatusInvalid  Status = "invalid"
+	StatusError    Status = "error"
+)
+
+// Exit codes of kerb-as admin and kerb-admin, so that scripts can tell
+// failures apart without parsing messages.
+const (
+	ExitOK       = 0
+	ExitError    = 1
+	ExitUsage    = 2
+	ExitNotFound = 3
+	ExitExists   = 4
+	ExitDenied   = 5
+	ExitRejected = 6
+	ExitInvalid  = 7
+)
+
+// statusExitCodes pairs each status with the exit code for it.
+var statusExitCodes = []struct {
+	status Status
+	code   int
+}{
+	{StatusOK, ExitOK},
+	{StatusDenied, ExitDenied},
+	{StatusNotFound, ExitNotFound},
+	{StatusExists, ExitExists},
+	{StatusRejected, ExitRejected},
+	{StatusInvalid, ExitUsage},
+}
+
+// ExitCode returns the exit code for a request that ended with s.
+func (s Status) ExitCode() int {
+	for _, e := range statusExitCodes {
+		if e.status == s {
+			return e.code
+		}
+	}
+	return ExitError
+}
+
+// StatusOf returns the status reported for a request that failed with exit
+// code code.
+func StatusOf(code int) Status {
+	for _, e := range statusExitCodes {
+		if e.code == code {
+			return e.status
+		}
+	}
+	return StatusError
+}
+
+// PasswdRequest asks for the password of the ticket's client to be changed
+// to NewPassword.
+type PasswdRequest struct {
+	NewPassword string
+}
+
+// Reply answers a request with the users it listed or changed, or with
+// a message explaining why it failed. Keys are never sent.
+type Reply struct {
+	Status  Status
+	Message string
+	Users   []User
+}
+
+// User is what the protocol shows of a user.
+type User struct {
+	Username       string   `json:"username"`
+	FirstName      string   `json:"first_name"`
+	LastName       string   `json:"last_name"`
+	RequirePreauth bool     `json:"requires_preauth"`
+	Policy         string   `json:"policy"`
+	Kvno           int      `json:"kvno"`
+	ETypes         []string `json:"etypes"`
+}
@@ -0,0 +1,171 @@
+// Package kclient holds the client side of the exchanges with the KDC and
+// services that kerb-client and kerb-admin share: asking the TGS for
+// tickets, checking a service's AP-REP and explaining the errors the
+// servers send.
+package kclient
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/ccache"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+// RequestTicket uses the TGT to ask the TGS at tgsAddr for a ticket for
+// service, offering etypes for its session key. The ticket returned may be
+// a referral for another realm's TGS, so callers must check its Service. A
+// rejected request returns the *kerb.KRBError the TGS sent.
+func RequestTicket(tgsAddr string, tgt ccache.Credential, service string, etypes []encryption.EType) (ccache.Credential, error) {
+	offered := encryption.FormatETypes(etypes)
+	encAuth, err := tgsAuthenticator(tgt, kerb.TGSReqChecksumData(service, "", "", "", offered))
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+
+	req, err := http.NewRequest("GET", tgsAddr+"/ticket", bytes.NewReader(append(append([]byte{}, tgt.Ticket...), encAuth...)))
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+	req.Header.Set("X-Ticket-Length", strconv.Itoa(len(tgt.Ticket)))
+	req.Header.Set("X-Service", service)
+	req.Header.Set("X-Etypes", offered)
+
+	return tgsExchange(req, tgt)
+}
+
+// RenewTGT exchanges a renewable TGT for a new one with a fresh end time.
+func RenewTGT(tgsAddr string, tgt ccache.Credential) (ccache.Credential, error) {
+	encAuth, err := tgsAuthenticator(tgt, kerb.TGSReqChecksumData("", "", "", "", ""))
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+
+	req, err := http.NewRequest("GET", tgsAddr+"/renew", bytes.NewReader(append(append([]byte{}, tgt.Ticket...), encAuth...)))
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+	req.Header.Set("X-Ticket-Length", strconv.Itoa(len(tgt.Ticket)))
+
+	renewed, err := tgsExchange(req, tgt)
+	renewed.Service = ccache.TGTService
+	return renewed, err
+}
+
+// tgsAuthenticator encrypts an authenticator for a TGS request under the
+// TGT's session key, with a checksum over the request's other fields.
+func tgsAuthenticator(tgt ccache.Credential, checksumData []byte) ([]byte, error) {
+	auth := kerb.Autheticator{Username: tgt.Client, Timestamp: time.Now()}
+	var err error
+	if auth.Checksum, err = encryption.Checksum(tgt.KeyType, tgt.SessionKey, kerb.KeyUsageTGSReqChecksum, checksumData); err != nil {
+		return nil, err
+	}
+	return encryption.EncryptWith(tgt.KeyType, tgt.SessionKey, kerb.KeyUsageTGSReqAuth, auth)
+}
+
+// tgsExchange sends req to the TGS and decrypts its reply with the TGT's
+// session key.
+func tgsExchange(req *http.Request, tgt ccache.Credential) (ccache.Credential, error) {
+	c := http.Client{Timeout: time.Duration(5) * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return ccache.Credential{}, kerb.ReadError(resp)
+	}
+
+	encRepPart, ticket, err := SplitReply(resp, "ticket granting server")
+	if err != nil {
+		return ccache.Credential{}, err
+	}
+	var repPart kerb.EncKDCRepPart
+	if err := encryption.DecryptWith(tgt.KeyType, tgt.SessionKey, kerb.KeyUsageTGSRepPart, encRepPart, &repPart); err != nil {
+		return ccache.Credential{}, errors.New("failed to decrypt reply from ticket granting server")
+	}
+	return NewCredential(tgt.Client, repPart.Service, ticket, repPart), nil
+}
+
+// SplitReply splits the body of a KDC reply into the encrypted reply part,
+// whose length X-Key-Length gives, and the ticket that follows it.
+func SplitReply(resp *http.Response, server string) ([]byte, []byte, error) {
+	keyLen, _ := strconv.Atoi(resp.Header.Get("X-Key-Length"))
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyLen <= 0 || keyLen > len(body) {
+		return nil, nil, errors.New("malformed reply from " + server)
+	}
+	return body[:keyLen], body[keyLen:], nil
+}
+
+// NewCredential makes the credential for a ticket issued to client for
+// service with the decrypted reply part.
+func NewCredential(client, service string, ticket []byte, repPart kerb.EncKDCRepPart) ccache.Credential {
+	return ccache.Credential{
+		Client:     client,
+		Service:    service,
+		Ticket:     ticket,
+		SessionKey: repPart.SessionKey,
+		KeyType:    repPart.SessionKeyType,
+		Validity:   repPart.Validity,
+		RenewTill:  repPart.RenewTill,
+		Flags:      repPart.Flags,
+	}
+}
+
+// VerifyServer checks the AP-REP proof a service returned in its X-Ap-Rep
+// header. A missing or malformed proof is treated the same as a wrong one.
+func VerifyServer(encodedRep string, sentAuth kerb.Autheticator, keyType encryption.EType, sessionKey []byte) error {
+	encRep, err := hex.DecodeString(encodedRep)
+	if err != nil || len(encRep) == 0 {
+		return kerb.ErrMutualAuthFailed
+	}
+
+	var rep kerb.APRep
+	if err := encryption.DecryptWith(keyType, sessionKey, kerb.KeyUsageAPRepPart, encRep, &rep); err != nil {
+		return kerb.ErrMutualAuthFailed
+	}
+	return kerb.VerifyAPRep(rep, sentAuth)
+}
+
+// DescribeError explains an error returned by one of the servers, with
+// advice for the errors a user can do something about.
+func DescribeError(err error) string {
+	var krbErr *kerb.KRBError
+	if !errors.As(err, &krbErr) {
+		return err.Error()
+	}
+
+	var msg string
+	switch krbErr.Code {
+	case kerb.ErrCodePreauthFailed:
+		msg = "Invalid username or password"
+	case kerb.ErrCodeSkew:
+		msg = fmt.Sprintf("Clock skew too great: the server's clock reads %s but ours reads %s", krbErr.ServerTime.Format(time.RFC1123), time.Now().UTC().Format(time.RFC1123))
+	case kerb.ErrCodeTicketExpired:
+		msg = "Ticket expired, run kerb-client kinit to obtain a new one"
+	case kerb.ErrCodeBadKeyVersion:
+		msg = "The service's key has changed since the ticket was issued, run kerb-client kdestroy and try again"
+	case kerb.ErrCodeRepeat:
+		msg = "Request rejected as a replay of an earlier one"
+	case kerb.ErrCodeBadIntegrity, kerb.ErrCodeModified:
+		msg = "The server could not verify the request, the ticket may be corrupt or meant for another service"
+	case kerb.ErrCodeServiceUnknown:
+		msg = "Service principal unknown"
+	case kerb.ErrCodePolicy:
+		msg = "Request denied by policy: " + krbErr.Text
+	default:
+		msg = krbErr.Text
+	}
+	return fmt.Sprintf("%s (%s from realm %s)", msg, krbErr.Code, krbErr.Realm)
+}
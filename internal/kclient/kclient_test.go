@@ -0,0 +1,107 @@
+package kclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/ccache"
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+func testTGT(t *testing.T) ccache.Credential {
+	t.Helper()
+	key, err := encryption.GenerateKey(encryption.DefaultEType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ccache.Credential{
+		Client:     "jdoe@KERBEROS",
+		Service:    ccache.TGTService,
+		Ticket:     []byte("tgt"),
+		SessionKey: key,
+		KeyType:    encryption.DefaultEType,
+		Validity:   time.Now().Add(time.Hour),
+	}
+}
+
+// tgsReply answers with a ticket for service sealed under the TGT's session
+// key, its length in X-Key-Length made longer than the body if malformed.
+func tgsReply(t *testing.T, tgt ccache.Credential, service string, malformed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repPart := kerb.EncKDCRepPart{Service: service, SessionKey: []byte("session"), SessionKeyType: encryption.DefaultEType, Validity: time.Now().Add(time.Hour)}
+		encRepPart, err := encryption.EncryptWith(tgt.KeyType, tgt.SessionKey, kerb.KeyUsageTGSRepPart, repPart)
+		if err != nil {
+			t.Error(err)
+		}
+		keyLen := len(encRepPart)
+		if malformed {
+			keyLen += 100
+		}
+		w.Header().Set("X-Key-Length", strconv.Itoa(keyLen))
+		w.Write(append(encRepPart, "service ticket"...))
+	}
+}
+
+func TestRequestTicket(t *testing.T) {
+	tgt := testTGT(t)
+	server := httptest.NewServer(tgsReply(t, tgt, "fs/localhost@KERBEROS", false))
+	defer server.Close()
+
+	st, err := RequestTicket(server.URL, tgt, "fs/localhost@KERBEROS", encryption.Supported())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Client != tgt.Client || st.Service != "fs/localhost@KERBEROS" || string(st.Ticket) != "service ticket" || string(st.SessionKey) != "session" {
+		t.Errorf("Unexpected credential %+v", st)
+	}
+
+	renewed, err := RenewTGT(server.URL, tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Service != ccache.TGTService {
+		t.Errorf("Expected a renewed TGT got a ticket for %s", renewed.Service)
+	}
+}
+
+func TestRequestTicketErrors(t *testing.T) {
+	tgt := testTGT(t)
+
+	malformed := httptest.NewServer(tgsReply(t, tgt, "fs/localhost@KERBEROS", true))
+	defer malformed.Close()
+	if _, err := RequestTicket(malformed.URL, tgt, "fs/localhost@KERBEROS", encryption.Supported()); err == nil {
+		t.Error("Expected a malformed reply to be refused")
+	}
+
+	other := testTGT(t)
+	if _, err := RequestTicket(malformed.URL, other, "fs/localhost@KERBEROS", encryption.Supported()); err == nil {
+		t.Error("Expected a reply under another session key to be refused")
+	}
+
+	refused := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kerb.WriteError(w, kerb.ErrServiceUnknown, "KERBEROS", time.Now())
+	}))
+	defer refused.Close()
+	_, err := RequestTicket(refused.URL, tgt, "nobody@KERBEROS", encryption.Supported())
+	if !errors.Is(err, kerb.ErrServiceUnknown) {
+		t.Errorf("Expected %v got %v", kerb.ErrServiceUnknown, err)
+	}
+	if msg := DescribeError(err); msg != "Service principal unknown (KDC_ERR_S_PRINCIPAL_UNKNOWN from realm KERBEROS)" {
+		t.Errorf("Unexpected description %q", msg)
+	}
+}
+
+func TestVerifyServerRefusesMissingProof(t *testing.T) {
+	tgt := testTGT(t)
+	auth := kerb.Autheticator{Username: tgt.Client, Timestamp: time.Now()}
+	for _, rep := range []string{"", "not hex", "00ff"} {
+		if err := VerifyServer(rep, auth, tgt.KeyType, tgt.SessionKey); !errors.Is(err, kerb.ErrMutualAuthFailed) {
+			t.Errorf("%q: expected %v got %v", rep, kerb.ErrMutualAuthFailed, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package kerb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TicketFlags records how a ticket was obtained and what it may be used for.
+// Bit positions follow the ticket flags of RFC 4120 section 5.3. The same
+// type carries the options a client requests from the AS or TGS.
+type TicketFlags uint32
+
+const (
+	FlagForwardable TicketFlags = 1 << 1
+	FlagForwarded   TicketFlags = 1 << 2
+	FlagProxiable   TicketFlags = 1 << 3
+	FlagProxy       TicketFlags = 1 << 4
+	FlagRenewable   TicketFlags = 1 << 8
+	FlagInitial     TicketFlags = 1 << 9
+	FlagPreAuthent  TicketFlags = 1 << 10
+)
+
+// requestable are the flags a client may ask for.
+const requestable = FlagForwardable | FlagProxiable | FlagRenewable
+
+var flagNames = []struct {
+	flag   TicketFlags
+	name   string
+	letter string
+}{
+	{FlagForwardable, "forwardable", "F"},
+	{FlagForwarded, "forwarded", "f"},
+	{FlagProxiable, "proxiable", "P"},
+	{FlagProxy, "proxy", "p"},
+	{FlagRenewable, "renewable", "R"},
+	{FlagInitial, "initial", "I"},
+	{FlagPreAuthent, "pre-authent", "A"},
+}
+
+// Has reports whether every flag in want is set.
+func (f TicketFlags) Has(want TicketFlags) bool {
+	return f&want == want
+}
+
+// String lists the flags by name, separated by commas.
+func (f TicketFlags) String() string {
+	names := make([]string, 0)
+	for _, n := range flagNames {
+		if f.Has(n.flag) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Letters abbreviates the flags the way MIT klist -f does.
+func (f TicketFlags) Letters() string {
+	letters := ""
+	for _, n := range flagNames {
+		if f.Has(n.flag) {
+			letters += n.letter
+		}
+	}
+	return letters
+}
+
+// ParseTicketFlags reads a comma separated list of flag names as produced by
+// String.
+func ParseTicketFlags(s string) (TicketFlags, error) {
+	var flags TicketFlags
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, n := range flagNames {
+			if n.name == name {
+				flags |= n.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("kerb: unknown ticket flag %q", name)
+		}
+	}
+	return flags, nil
+}
+
+// InitialFlags computes the flags of a TGT issued by the AS. Only options the
+// client may request are honoured, and the ticket is renewable only if a
+// renew-till time was granted.
+func InitialFlags(requested TicketFlags, preauthenticated bool, renewable bool) TicketFlags {
+	flags := FlagInitial | requested&(FlagForwardable|FlagProxiable)
+	if preauthenticated {
+		flags |= FlagPreAuthent
+	}
+	if renewable {
+		flags |= FlagRenewable
+	}
+	return flags
+}
+
+// DeriveFlags computes the flags of a ticket issued by the TGS from the TGT
+// presented. Forwardable, proxiable and renewable are granted only when both
+// requested and present on the TGT. How the client originally authenticated
+// and whether its TGT was forwarded carry over, but INITIAL never does
+// because the new ticket was not issued by the AS.
+func DeriveFlags(tgt TicketFlags, requested TicketFlags) TicketFlags {
+	flags := tgt & requested & requestable
+	flags |= tgt & (FlagPreAuthent | FlagForwarded | FlagProxy)
+	return flags
+}
@@ -0,0 +1,168 @@
+package kerb
+
+import (
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+)
+
+// DefaultLifetime is how long a newly issued ticket is valid for.
+const DefaultLifetime = time.Hour * 1
+
+// DefaultMaxRenewableLifetime is the longest a ticket may be renewed for.
+const DefaultMaxRenewableLifetime = time.Hour * 24 * 7
+
+// DefaultKeyGracePeriod is how long a rotated key keeps decrypting tickets.
+// It outlasts any ticket issued under the default lifetime.
+const DefaultKeyGracePeriod = time.Hour * 24
+
+// Policy limits the lifetimes a KDC will grant. A MaxRenewableLifetime of
+// zero disables renewable tickets.
+type Policy struct {
+	MaxLifetime          time.Duration
+	MaxRenewableLifetime time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{MaxLifetime: DefaultLifetime, MaxRenewableLifetime: DefaultMaxRenewableLifetime}
+}
+
+// TicketRequest describes the ticket a client asked for. A zero StartTime
+// means now, a zero EndTime asks for the longest lifetime policy allows and
+// a zero RenewTill with the renewable option set asks for the longest
+// renewable lifetime. Preauthenticated only applies to tickets issued by
+// the AS. SessionKeyType is the negotiated type of the new session key.
+type TicketRequest struct {
+	Username         string
+	SessionKeyType   encryption.EType
+	StartTime        time.Time
+	EndTime          time.Time
+	RenewTill        time.Time
+	Options          TicketFlags
+	Preauthenticated bool
+}
+
+// SetLifetimes requests an end time lifetime after now and, if renewLifetime
+// is positive, a renewable ticket until renewLifetime after now. Non-positive
+// durations leave the policy defaults in place.
+func (req *TicketRequest) SetLifetimes(now time.Time, lifetime, renewLifetime time.Duration) {
+	if lifetime > 0 {
+		req.EndTime = now.Add(lifetime)
+	}
+	if renewLifetime > 0 {
+		req.RenewTill = now.Add(renewLifetime)
+		req.Options |= FlagRenewable
+	}
+}
+
+// IssueTicket works out the times and flags of a new ticket and gives it a
+// fresh session key. With a nil parent the ticket is an initial ticket from
+// the AS, limited only by policy. Otherwise it is derived from the parent
+// TGT and never outlives it: its end time is capped at the parent's end
+// time, and it is only renewable if the parent is, until no later than the
+// parent's renew-till time.
+func IssueTicket(req TicketRequest, now time.Time, policy Policy, parent *Ticket) (Ticket, error) {
+	if parent != nil && !now.Before(parent.Validity) {
+		return Ticket{}, ErrTicketExpired
+	}
+
+	start := now
+	if req.StartTime.After(now) {
+		return Ticket{}, ErrCannotPostdate
+	}
+
+	end := start.Add(policy.MaxLifetime)
+	if !req.EndTime.IsZero() && req.EndTime.Before(end) {
+		end = req.EndTime
+	}
+	if parent != nil && parent.Validity.Before(end) {
+		end = parent.Validity
+	}
+	if !end.After(start) {
+		return Ticket{}, ErrNeverValid
+	}
+
+	var flags TicketFlags
+	if parent == nil {
+		flags = InitialFlags(req.Options, req.Preauthenticated, false)
+	} else {
+		flags = DeriveFlags(parent.Flags, req.Options) &^ FlagRenewable
+	}
+
+	var renewTill time.Time
+	wantsRenewable := req.Options.Has(FlagRenewable) || !req.RenewTill.IsZero()
+	parentRenewable := parent == nil || parent.Flags.Has(FlagRenewable)
+	if wantsRenewable && parentRenewable && policy.MaxRenewableLifetime > 0 {
+		renewTill = start.Add(policy.MaxRenewableLifetime)
+		if !req.RenewTill.IsZero() && req.RenewTill.Before(renewTill) {
+			renewTill = req.RenewTill
+		}
+		if parent != nil && parent.RenewTill.Before(renewTill) {
+			renewTill = parent.RenewTill
+		}
+
+		// Renewing could never extend the ticket, so don't offer it
+		if renewTill.After(end) {
+			flags |= FlagRenewable
+		} else {
+			renewTill = time.Time{}
+		}
+	}
+
+	etype := req.SessionKeyType
+	if etype == 0 {
+		etype = encryption.DefaultEType
+	}
+	sessionKey, err := encryption.GenerateKey(etype)
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	return Ticket{
+		Username:       req.Username,
+		SessionKey:     sessionKey,
+		SessionKeyType: etype,
+		StartTime:      start,
+		Validity:       end,
+		RenewTill:      renewTill,
+		Flags:          flags,
+	}, nil
+}
+
+// Renewable reports whether the ticket may still be renewed at now. As in
+// RFC 4120 a ticket must be renewed before it expires.
+func (t Ticket) Renewable(now time.Time) bool {
+	return t.Flags.Has(FlagRenewable) && now.Before(t.RenewTill) && now.Before(t.Validity)
+}
+
+// RenewTicket reissues ticket with a fresh session key of the same type and
+// a new end time as far away as policy allows, never extending past the
+// ticket's renew-till time. The renewed ticket keeps the original's flags except INITIAL.
+func RenewTicket(ticket Ticket, now time.Time, policy Policy) (Ticket, error) {
+	if ticket.RenewTill.IsZero() || !ticket.Flags.Has(FlagRenewable) {
+		return Ticket{}, ErrNotRenewable
+	}
+	if !ticket.Renewable(now) {
+		return Ticket{}, ErrTicketExpired
+	}
+
+	end := now.Add(policy.MaxLifetime)
+	if end.After(ticket.RenewTill) {
+		end = ticket.RenewTill
+	}
+
+	sessionKey, err := encryption.GenerateKey(ticket.SessionKeyType)
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	return Ticket{
+		Username:       ticket.Username,
+		SessionKey:     sessionKey,
+		SessionKeyType: ticket.SessionKeyType,
+		StartTime:      now,
+		Validity:       end,
+		RenewTill:      ticket.RenewTill,
+		Flags:          ticket.Flags &^ FlagInitial,
+	}, nil
+}
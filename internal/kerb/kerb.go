@@ -1,33 +1,245 @@
 package kerb
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/khaugen7/kerberos-go/internal/encryption"
 )
 
+// DefaultSkew is the largest difference tolerated between an authenticator's
+// timestamp and the server's clock.
+const DefaultSkew = 5 * time.Minute
+
+// DefaultFileService is the principal the file server is registered under
+// in the KDC's realm during first time setup.
+const DefaultFileService = "fs/localhost"
+
+// KadminService is the principal of the remote administration service the
+// AS offers, registered in the KDC's realm during first time setup.
+const KadminService = "kadmin/admin"
+
+// ChangePwService is the principal of the password change service the AS
+// offers. Its tickets are only issued by the AS, to a user who has just
+// entered their password, and are valid for ChangePwLifetime.
+const ChangePwService = "kadmin/changepw"
+
+// ChangePwLifetime is the longest a ticket for ChangePwService is valid.
+const ChangePwLifetime = 5 * time.Minute
+
+// MsgTypeAPRep is the RFC 4120 message type of an AP-REP.
+const MsgTypeAPRep = 15
+
+// Key usage numbers from RFC 4120 section 7.5.1. Each message is encrypted
+// or checksummed with its own usage so it cannot be passed off as another.
+const (
+	KeyUsagePAEncTimestamp uint32 = 1
+	KeyUsageTicket         uint32 = 2
+	KeyUsageASRepPart      uint32 = 3
+	KeyUsageTGSReqChecksum uint32 = 6
+	KeyUsageTGSReqAuth     uint32 = 7
+	KeyUsageTGSRepPart     uint32 = 8
+	KeyUsageAPReqChecksum  uint32 = 10
+	KeyUsageAPReqAuth      uint32 = 11
+	KeyUsageAPRepPart      uint32 = 12
+)
+
+var (
+	ErrPrincipalMismatch = errors.New("kerb: authenticator does not match ticket")
+	ErrTicketExpired     = errors.New("kerb: ticket expired")
+	ErrClockSkew         = errors.New("kerb: clock skew too great")
+	ErrMutualAuthFailed  = errors.New("kerb: server failed mutual authentication")
+	ErrPreauthRequired   = errors.New("kerb: pre-authentication required")
+	ErrPreauthFailed     = errors.New("kerb: pre-authentication failed")
+	ErrServiceUnknown    = errors.New("kerb: service principal unknown")
+	ErrNotRenewable      = errors.New("kerb: ticket is not renewable")
+	ErrCannotPostdate    = errors.New("kerb: postdated tickets are not supported")
+	ErrNeverValid        = errors.New("kerb: requested ticket would never be valid")
+	ErrBadChecksum       = errors.New("kerb: request checksum does not match")
+	ErrETypeNoSupport    = errors.New("kerb: no encryption type in common")
+	ErrBadKeyVersion     = errors.New("kerb: specified version of key is not available")
+	ErrBadIntegrity      = errors.New("kerb: integrity check on decrypted field failed")
+	ErrReplay            = errors.New("kerb: request is a replay")
+	ErrPolicy            = errors.New("kerb: KDC policy rejects request")
+	ErrBadRequest        = errors.New("kerb: malformed request")
+	ErrUnavailable       = errors.New("kerb: service temporarily unavailable")
+)
+
+// Ticket is issued by the AS and TGS. Username is the client's full
+// principal, including its realm. The ticket is valid from StartTime until
+// Validity, its end time. A renewable ticket may be renewed until RenewTill.
+// SessionKeyType is the encryption type the session key is used with.
 type Ticket struct {
-	Username   string
-	SessionKey []byte
-	Validity   time.Time
+	Username       string
+	SessionKey     []byte
+	SessionKeyType encryption.EType
+	StartTime      time.Time
+	Validity       time.Time
+	RenewTill      time.Time
+	Flags          TicketFlags
 }
 
+// Autheticator proves that the client holds a ticket's session key. In a TGS
+// request Checksum covers the request itself, see TGSReqChecksumData.
 type Autheticator struct {
 	Username  string
 	Timestamp time.Time
+	Checksum  []byte
+}
+
+// EncKDCRepPart is the part of an AS or TGS reply that the client can
+// decrypt. It carries the session key for the new ticket along with the
+// ticket's expiry so the client knows how long it may cache it. Service is
+// the principal the ticket was issued for, which for a cross-realm referral
+// is another realm's TGS rather than the service the client asked for.
+type EncKDCRepPart struct {
+	Service        string
+	SessionKey     []byte
+	SessionKeyType encryption.EType
+	StartTime      time.Time
+	Validity       time.Time
+	RenewTill      time.Time
+	Flags          TicketFlags
+}
+
+// PAEncTimestamp is sent to the AS encrypted under the user's long-term key
+// to prove knowledge of the password before a TGT is issued.
+type PAEncTimestamp struct {
+	Timestamp time.Time
+}
+
+// APRep is returned by a service to prove that it holds the service key: only
+// a server able to decrypt the ticket learns the session key needed to echo
+// back the client's authenticator timestamp. MsgType stops an impostor from
+// simply reflecting the client's own encrypted authenticator back at it.
+type APRep struct {
+	MsgType   int
+	Timestamp time.Time
+}
+
+// Clock supplies the current time so that servers can be tested against a
+// fixed point in time.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock reads the time from the operating system.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Validator checks authenticators against the tickets they accompany.
+type Validator struct {
+	Clock Clock
+	Skew  time.Duration
+}
+
+// NewValidator returns a Validator using the system clock and DefaultSkew.
+func NewValidator() Validator {
+	return Validator{Clock: SystemClock{}, Skew: DefaultSkew}
+}
+
+// ReplyPart returns the client's view of ticket issued for service.
+func (t Ticket) ReplyPart(service string) EncKDCRepPart {
+	return EncKDCRepPart{
+		Service:        service,
+		SessionKey:     t.SessionKey,
+		SessionKeyType: t.SessionKeyType,
+		StartTime:      t.StartTime,
+		Validity:       t.Validity,
+		RenewTill:      t.RenewTill,
+		Flags:          t.Flags,
+	}
+}
+
+// TGSReqChecksumData returns the parts of a TGS request that the
+// authenticator checksum protects, taken from its headers, so that a captured
+// TGT and authenticator cannot be replayed with different options.
+func TGSReqChecksumData(service, options, lifetime, renewLifetime, etypes string) []byte {
+	return []byte(strings.Join([]string{service, options, lifetime, renewLifetime, etypes}, "\n"))
 }
 
 func GenerateTicket(username string) Ticket {
-	k := encryption.GenerateRandomBytes(32)
-	v := time.Now().Add(time.Hour * 1)
+	return GenerateTicketAt(username, time.Now())
+}
+
+// GenerateTicketAt issues a ticket valid for one hour from now.
+func GenerateTicketAt(username string, now time.Time) Ticket {
+	ticket, _ := IssueTicket(TicketRequest{Username: username}, now, DefaultPolicy(), nil)
+	return ticket
+}
+
+// Validate reports why auth is not acceptable for ticket, or nil if it is.
+// The authenticator must name the ticket's user, the ticket must not have
+// expired and the authenticator's timestamp must lie within Skew of the
+// validator's clock in either direction.
+func (v Validator) Validate(auth Autheticator, ticket Ticket) error {
+	now := v.Clock.Now()
 
-	return Ticket{
-		Username:   username,
-		SessionKey: k,
-		Validity:   v,
+	if auth.Username != ticket.Username {
+		return ErrPrincipalMismatch
 	}
+	if !now.Before(ticket.Validity) || !auth.Timestamp.Before(ticket.Validity) {
+		return ErrTicketExpired
+	}
+	return v.ValidateTimestamp(auth.Timestamp)
+}
+
+// ValidateTimestamp returns ErrClockSkew if ts lies further than Skew from
+// the validator's clock.
+func (v Validator) ValidateTimestamp(ts time.Time) error {
+	if skew := v.Clock.Now().Sub(ts); skew > v.Skew || skew < -v.Skew {
+		return ErrClockSkew
+	}
+	return nil
+}
+
+// ValidatePreauth checks a PA-ENC-TIMESTAMP that has already been decrypted
+// with the user's key.
+func (v Validator) ValidatePreauth(pa PAEncTimestamp) error {
+	if pa.Timestamp.IsZero() {
+		return ErrPreauthFailed
+	}
+	return v.ValidateTimestamp(pa.Timestamp)
+}
+
+// NewAPRep builds the mutual authentication reply for auth.
+func NewAPRep(auth Autheticator) APRep {
+	return APRep{MsgType: MsgTypeAPRep, Timestamp: auth.Timestamp}
+}
+
+// VerifyAPRep checks that rep echoes the authenticator the client sent.
+func VerifyAPRep(rep APRep, auth Autheticator) error {
+	if rep.MsgType != MsgTypeAPRep || !rep.Timestamp.Equal(auth.Timestamp) {
+		return ErrMutualAuthFailed
+	}
+	return nil
 }
 
 func ValidateClient(auth Autheticator, ticket Ticket) bool {
-	return auth.Username == ticket.Username && auth.Timestamp.Before(ticket.Validity)
-}
\ No newline at end of file
+	return NewValidator().Validate(auth, ticket) == nil
+}
+
+// EncodeETypeInfo2 encodes the key parameters of a principal for the
+// X-Etype-Info2 header, which the AS sends in place of the PA-ETYPE-INFO2
+// padata of RFC 4120 so the client can derive the principal's key.
+func EncodeETypeInfo2(params encryption.KeyParams) string {
+	b, _ := json.Marshal(params)
+	return hex.EncodeToString(b)
+}
+
+// DecodeETypeInfo2 reverses EncodeETypeInfo2.
+func DecodeETypeInfo2(s string) (encryption.KeyParams, error) {
+	var params encryption.KeyParams
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return params, err
+	}
+	err = json.Unmarshal(b, &params)
+	return params, err
+}
@@ -1,8 +1,15 @@
 package kerb
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
 )
 
 type kerbTest struct {
@@ -11,11 +18,11 @@ type kerbTest struct {
 	expected bool
 }
 
-var auth1 = Autheticator{"username", time.Now()}
-var auth2 = Autheticator{"baduser", time.Now()}
-var auth3 = Autheticator{"username", time.Now().Add(time.Hour * 2)}
+var auth1 = Autheticator{Username: "username", Timestamp: time.Now()}
+var auth2 = Autheticator{Username: "baduser", Timestamp: time.Now()}
+var auth3 = Autheticator{Username: "username", Timestamp: time.Now().Add(time.Hour * 2)}
 
-var ticket = Ticket{"username", []byte("somekey"), time.Now().Add(time.Hour * 1)}
+var ticket = Ticket{Username: "username", SessionKey: []byte("somekey"), Validity: time.Now().Add(time.Hour * 1)}
 var genTicket = GenerateTicket("username")
 
 var kerbTests = []kerbTest{
@@ -34,3 +41,456 @@ func TestValidation(t *testing.T) {
 		}
 	}
 }
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+type validateTest struct {
+	name     string
+	auth     Autheticator
+	expected error
+}
+
+func TestValidateClockSkew(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	v := Validator{Clock: fixedClock(now), Skew: 5 * time.Minute}
+	ticket := Ticket{Username: "username", SessionKey: []byte("somekey"), Validity: now.Add(time.Hour)}
+
+	tests := []validateTest{
+		{"current", Autheticator{Username: "username", Timestamp: now}, nil},
+		{"edge of past window", Autheticator{Username: "username", Timestamp: now.Add(-5 * time.Minute)}, nil},
+		{"edge of future window", Autheticator{Username: "username", Timestamp: now.Add(5 * time.Minute)}, nil},
+		{"too old", Autheticator{Username: "username", Timestamp: now.Add(-5*time.Minute - time.Second)}, ErrClockSkew},
+		{"in the future", Autheticator{Username: "username", Timestamp: now.Add(5*time.Minute + time.Second)}, ErrClockSkew},
+		{"days old", Autheticator{Username: "username", Timestamp: now.Add(-72 * time.Hour)}, ErrClockSkew},
+		{"wrong user", Autheticator{Username: "baduser", Timestamp: now}, ErrPrincipalMismatch},
+	}
+
+	for _, test := range tests {
+		if actual := v.Validate(test.auth, ticket); actual != test.expected {
+			t.Errorf("%s: Expected %v got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestValidateExpiredTicket(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	v := Validator{Clock: fixedClock(now), Skew: DefaultSkew}
+	ticket := GenerateTicketAt("username", now.Add(-2*time.Hour))
+
+	if err := v.Validate(Autheticator{Username: "username", Timestamp: now}, ticket); err != ErrTicketExpired {
+		t.Errorf("Expected %v got %v", ErrTicketExpired, err)
+	}
+}
+
+func TestVerifyAPRep(t *testing.T) {
+	auth := Autheticator{Username: "username", Timestamp: time.Date(2022, 11, 1, 12, 0, 0, 123456789, time.UTC)}
+
+	if err := VerifyAPRep(NewAPRep(auth), auth); err != nil {
+		t.Errorf("Valid AP-REP rejected: %v", err)
+	}
+	if err := VerifyAPRep(APRep{MsgTypeAPRep, auth.Timestamp.Add(time.Second)}, auth); err != ErrMutualAuthFailed {
+		t.Errorf("Expected %v for wrong timestamp, got %v", ErrMutualAuthFailed, err)
+	}
+	// A reflected authenticator decodes into an APRep without a message type
+	if err := VerifyAPRep(APRep{Timestamp: auth.Timestamp}, auth); err != ErrMutualAuthFailed {
+		t.Errorf("Expected %v for reflected authenticator, got %v", ErrMutualAuthFailed, err)
+	}
+}
+
+func TestValidatePreauth(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	v := Validator{Clock: fixedClock(now), Skew: DefaultSkew}
+
+	if err := v.ValidatePreauth(PAEncTimestamp{now.Add(-time.Minute)}); err != nil {
+		t.Errorf("Current timestamp rejected: %v", err)
+	}
+	if err := v.ValidatePreauth(PAEncTimestamp{now.Add(-time.Hour)}); err != ErrClockSkew {
+		t.Errorf("Expected %v got %v", ErrClockSkew, err)
+	}
+	if err := v.ValidatePreauth(PAEncTimestamp{}); err != ErrPreauthFailed {
+		t.Errorf("Expected %v got %v", ErrPreauthFailed, err)
+	}
+}
+
+func TestQualifyPrincipal(t *testing.T) {
+	if actual := QualifyPrincipal("fs/host1", DefaultRealm); actual != "fs/host1@KERBEROS" {
+		t.Errorf("Expected fs/host1@KERBEROS got %s", actual)
+	}
+	if actual := QualifyPrincipal("http/api@OTHER", DefaultRealm); actual != "http/api@OTHER" {
+		t.Errorf("Expected http/api@OTHER got %s", actual)
+	}
+}
+
+func TestParsePrincipal(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Principal
+	}{
+		{"jdoe", Principal{Name: "jdoe", Realm: "STAGING"}},
+		{"jdoe@PROD", Principal{Name: "jdoe", Realm: "PROD"}},
+		{"fs/host1", Principal{Name: "fs", Instance: "host1", Realm: "STAGING"}},
+		{"krbtgt/PROD@STAGING", Principal{Name: "krbtgt", Instance: "PROD", Realm: "STAGING"}},
+	}
+	for _, test := range tests {
+		actual, err := ParsePrincipal(test.input, "STAGING")
+		if err != nil || actual != test.expected {
+			t.Errorf("Parsing %s: expected %v got %v (%v)", test.input, test.expected, actual, err)
+		}
+	}
+
+	for _, bad := range []string{"", "@PROD", "jdoe@", "fs/", "/host1", "a/b/c", "jdoe@PROD@TEST"} {
+		if _, err := ParsePrincipal(bad, "STAGING"); err != ErrBadPrincipal {
+			t.Errorf("Expected %v parsing %q got %v", ErrBadPrincipal, bad, err)
+		}
+	}
+
+	p, _ := ParsePrincipal("fs/host1", "STAGING")
+	if p.String() != "fs/host1@STAGING" || p.NameString() != "fs/host1" {
+		t.Errorf("Unexpected names %s and %s", p, p.NameString())
+	}
+}
+
+func TestTGSPrincipal(t *testing.T) {
+	local := TGSPrincipal("PROD", "PROD")
+	if local.String() != "krbtgt/PROD@PROD" || !local.IsTGS() {
+		t.Errorf("Unexpected local TGS principal %s", local)
+	}
+	if cross := TGSPrincipal("PROD", "STAGING"); cross.String() != "krbtgt/PROD@STAGING" {
+		t.Errorf("Unexpected cross-realm principal %s", cross)
+	}
+	if p, _ := ParsePrincipal("krbtgt@PROD", "PROD"); p.IsTGS() {
+		t.Error("krbtgt without an instance treated as a TGS")
+	}
+}
+
+func TestSealTicket(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sealed, err := SealTicket(ticket, "fs/host1@KERBEROS", ServiceKey{Kvno: 3, EType: encryption.ETypeChaCha20Poly1305, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenSealedTicket(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Service != "fs/host1@KERBEROS" || opened.Kvno != 3 || opened.EType != encryption.ETypeChaCha20Poly1305 {
+		t.Errorf("Expected service fs/host1@KERBEROS kvno 3 with chacha20-poly1305 got %s kvno %d with %s", opened.Service, opened.Kvno, opened.EType)
+	}
+	decrypted, err := opened.Decrypt(key)
+	if err != nil || decrypted.Username != ticket.Username {
+		t.Errorf("Ticket not recovered: %v (%v)", decrypted, err)
+	}
+
+	if _, err := opened.Decrypt([]byte("fedcba9876543210fedcba9876543210")); err == nil {
+		t.Error("Ticket decrypted with the wrong key")
+	}
+	if _, err := OpenSealedTicket([]byte("garbage")); err == nil {
+		t.Error("Garbage accepted as a sealed ticket")
+	}
+}
+
+func TestSessionKeyType(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	req := TicketRequest{Username: "username", SessionKeyType: encryption.ETypeAES256CTSHMACSHA196}
+	req.SetLifetimes(now, 0, 90*time.Minute)
+	tgt, err := IssueTicket(req, now, DefaultPolicy(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tgt.SessionKeyType != encryption.ETypeAES256CTSHMACSHA196 || len(tgt.SessionKey) != 32 {
+		t.Errorf("Unexpected session key type %s", tgt.SessionKeyType)
+	}
+
+	renewed, err := RenewTicket(tgt, now.Add(time.Minute), DefaultPolicy())
+	if err != nil || renewed.SessionKeyType != tgt.SessionKeyType {
+		t.Errorf("Renewed ticket has session key type %s (%v)", renewed.SessionKeyType, err)
+	}
+
+	if tgt, _ := IssueTicket(TicketRequest{Username: "username"}, now, DefaultPolicy(), nil); tgt.SessionKeyType != encryption.DefaultEType {
+		t.Errorf("Expected default session key type got %s", tgt.SessionKeyType)
+	}
+}
+
+func TestRenewTicket(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	req := TicketRequest{Username: "username"}
+	req.SetLifetimes(now, 0, 90*time.Minute)
+	tgt, err := IssueTicket(req, now, DefaultPolicy(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tgt.RenewTill.Equal(now.Add(90 * time.Minute)) {
+		t.Errorf("Expected renew-till %v got %v", now.Add(90*time.Minute), tgt.RenewTill)
+	}
+
+	renewed, err := RenewTicket(tgt, now.Add(50*time.Minute), DefaultPolicy())
+	if err != nil {
+		t.Fatalf("Renewal failed: %v", err)
+	}
+	if !renewed.Validity.Equal(now.Add(90 * time.Minute)) {
+		t.Errorf("Renewed ticket not capped at renew-till: %v", renewed.Validity)
+	}
+	if string(renewed.SessionKey) == string(tgt.SessionKey) {
+		t.Error("Renewed ticket reused the session key")
+	}
+
+	if _, err := RenewTicket(tgt, now.Add(2*time.Hour), DefaultPolicy()); err != ErrTicketExpired {
+		t.Errorf("Expected %v renewing an expired ticket, got %v", ErrTicketExpired, err)
+	}
+	if _, err := RenewTicket(GenerateTicketAt("username", now), now, DefaultPolicy()); err != ErrNotRenewable {
+		t.Errorf("Expected %v got %v", ErrNotRenewable, err)
+	}
+}
+
+func TestTicketFlags(t *testing.T) {
+	flags, err := ParseTicketFlags("forwardable,renewable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != FlagForwardable|FlagRenewable {
+		t.Errorf("Parsed unexpected flags %b", flags)
+	}
+	if s := flags.String(); s != "forwardable,renewable" {
+		t.Errorf("Expected forwardable,renewable got %s", s)
+	}
+	if _, err := ParseTicketFlags("forwardable,bogus"); err == nil {
+		t.Error("Unknown flag accepted")
+	}
+	if flags, _ := ParseTicketFlags(""); flags != 0 {
+		t.Errorf("Expected no flags got %s", flags)
+	}
+}
+
+func TestInitialFlags(t *testing.T) {
+	// INITIAL and PRE-AUTHENT cannot simply be requested
+	flags := InitialFlags(FlagForwardable|FlagInitial|FlagPreAuthent, false, false)
+	if flags != FlagInitial|FlagForwardable {
+		t.Errorf("Expected %s got %s", FlagInitial|FlagForwardable, flags)
+	}
+
+	flags = InitialFlags(0, true, true)
+	if flags != FlagInitial|FlagPreAuthent|FlagRenewable {
+		t.Errorf("Expected %s got %s", FlagInitial|FlagPreAuthent|FlagRenewable, flags)
+	}
+}
+
+func TestDeriveFlags(t *testing.T) {
+	tgt := FlagInitial | FlagPreAuthent | FlagForwardable | FlagRenewable
+
+	if flags := DeriveFlags(tgt, 0); flags != FlagPreAuthent {
+		t.Errorf("Expected %s got %s", FlagPreAuthent, flags)
+	}
+	if flags := DeriveFlags(tgt, FlagForwardable|FlagProxiable); flags != FlagPreAuthent|FlagForwardable {
+		t.Errorf("Expected %s got %s", FlagPreAuthent|FlagForwardable, flags)
+	}
+	if flags := DeriveFlags(FlagForwarded, FlagForwardable); flags != FlagForwarded {
+		t.Errorf("Expected %s got %s", FlagForwarded, flags)
+	}
+}
+
+func TestRenewedTicketIsNotInitial(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	req := TicketRequest{Username: "username", Preauthenticated: true}
+	req.SetLifetimes(now, 0, 2*time.Hour)
+	tgt, err := IssueTicket(req, now, DefaultPolicy(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tgt.Flags != FlagInitial|FlagPreAuthent|FlagRenewable {
+		t.Errorf("Expected %s got %s", FlagInitial|FlagPreAuthent|FlagRenewable, tgt.Flags)
+	}
+
+	renewed, err := RenewTicket(tgt, now.Add(time.Minute), DefaultPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Flags != FlagRenewable|FlagPreAuthent {
+		t.Errorf("Expected %s got %s", FlagRenewable|FlagPreAuthent, renewed.Flags)
+	}
+}
+
+// issueTGT returns a renewable TGT issued at now that expires after lifetime
+// and may be renewed for renewLifetime.
+func issueTGT(t *testing.T, now time.Time, lifetime, renewLifetime time.Duration) Ticket {
+	t.Helper()
+	req := TicketRequest{Username: "username"}
+	req.SetLifetimes(now, lifetime, renewLifetime)
+	tgt, err := IssueTicket(req, now, DefaultPolicy(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tgt
+}
+
+func TestIssueTicketPolicy(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	policy := Policy{MaxLifetime: 2 * time.Hour, MaxRenewableLifetime: 24 * time.Hour}
+
+	// No requested times yields the policy maximum
+	ticket, err := IssueTicket(TicketRequest{Username: "username"}, now, policy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ticket.StartTime.Equal(now) || !ticket.Validity.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("Expected %v - %v got %v - %v", now, now.Add(2*time.Hour), ticket.StartTime, ticket.Validity)
+	}
+	if ticket.Flags.Has(FlagRenewable) || !ticket.RenewTill.IsZero() {
+		t.Error("Ticket renewable without asking")
+	}
+
+	// Requests beyond the policy are capped, shorter ones honoured
+	req := TicketRequest{Username: "username"}
+	req.SetLifetimes(now, 10*time.Hour, 30*24*time.Hour)
+	ticket, _ = IssueTicket(req, now, policy, nil)
+	if !ticket.Validity.Equal(now.Add(2*time.Hour)) || !ticket.RenewTill.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("Lifetimes not capped by policy: %v, %v", ticket.Validity, ticket.RenewTill)
+	}
+	req = TicketRequest{Username: "username"}
+	req.SetLifetimes(now, 30*time.Minute, 0)
+	ticket, _ = IssueTicket(req, now, policy, nil)
+	if !ticket.Validity.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("Requested end time not honoured: %v", ticket.Validity)
+	}
+
+	// Renewal disabled by policy
+	req = TicketRequest{Username: "username"}
+	req.SetLifetimes(now, 0, 24*time.Hour)
+	ticket, _ = IssueTicket(req, now, Policy{MaxLifetime: time.Hour}, nil)
+	if ticket.Flags.Has(FlagRenewable) || !ticket.RenewTill.IsZero() {
+		t.Error("Ticket renewable although policy forbids it")
+	}
+
+	// A renew-till no later than the end time is pointless
+	req = TicketRequest{Username: "username"}
+	req.SetLifetimes(now, 0, 30*time.Minute)
+	ticket, _ = IssueTicket(req, now, policy, nil)
+	if ticket.Flags.Has(FlagRenewable) || !ticket.RenewTill.IsZero() {
+		t.Error("Ticket renewable until before it expires")
+	}
+
+	if _, err := IssueTicket(TicketRequest{Username: "username", StartTime: now.Add(time.Hour)}, now, policy, nil); err != ErrCannotPostdate {
+		t.Errorf("Expected %v got %v", ErrCannotPostdate, err)
+	}
+	if _, err := IssueTicket(TicketRequest{Username: "username", EndTime: now}, now, policy, nil); err != ErrNeverValid {
+		t.Errorf("Expected %v got %v", ErrNeverValid, err)
+	}
+}
+
+func TestServiceTicketBoundedByTGT(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	tgt := issueTGT(t, now, 0, 0)
+
+	// A TGT with 30 seconds left only buys a 30 second service ticket
+	later := tgt.Validity.Add(-30 * time.Second)
+	ticket, err := IssueTicket(TicketRequest{Username: "username"}, later, DefaultPolicy(), &tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ticket.Validity.Equal(tgt.Validity) {
+		t.Errorf("Expected service ticket to end with TGT at %v got %v", tgt.Validity, ticket.Validity)
+	}
+	if ticket.Flags.Has(FlagInitial) {
+		t.Error("Service ticket marked initial")
+	}
+
+	if _, err := IssueTicket(TicketRequest{Username: "username"}, tgt.Validity, DefaultPolicy(), &tgt); err != ErrTicketExpired {
+		t.Errorf("Expected %v from expired TGT got %v", ErrTicketExpired, err)
+	}
+}
+
+func TestServiceTicketRenewTillBoundedByTGT(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	req := TicketRequest{Username: "username"}
+	req.SetLifetimes(now, 0, 7*24*time.Hour)
+
+	// A non-renewable TGT never yields a renewable service ticket
+	tgt := issueTGT(t, now, 0, 0)
+	ticket, _ := IssueTicket(req, now, DefaultPolicy(), &tgt)
+	if ticket.Flags.Has(FlagRenewable) || !ticket.RenewTill.IsZero() {
+		t.Error("Renewable service ticket from non-renewable TGT")
+	}
+
+	tgt = issueTGT(t, now, 0, 3*time.Hour)
+	ticket, _ = IssueTicket(req, now, DefaultPolicy(), &tgt)
+	if !ticket.Flags.Has(FlagRenewable) || !ticket.RenewTill.Equal(tgt.RenewTill) {
+		t.Errorf("Expected renew-till capped at TGT's %v got %v", tgt.RenewTill, ticket.RenewTill)
+	}
+
+	// Without asking the service ticket is not renewable
+	ticket, _ = IssueTicket(TicketRequest{Username: "username"}, now, DefaultPolicy(), &tgt)
+	if ticket.Flags.Has(FlagRenewable) {
+		t.Error("Service ticket renewable without asking")
+	}
+}
+
+func TestETypeInfo2(t *testing.T) {
+	params := encryption.KeyParams{Salt: []byte("0123456789abcdef"), Iterations: 1000}
+	decoded, err := DecodeETypeInfo2(EncodeETypeInfo2(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Salt) != string(params.Salt) || decoded.Iterations != params.Iterations {
+		t.Errorf("Expected %v got %v", params, decoded)
+	}
+	if _, err := DecodeETypeInfo2(""); err == nil {
+		t.Error("Missing parameters accepted")
+	}
+}
+
+func TestKRBErrorRoundTrip(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	rec := httptest.NewRecorder()
+	WriteError(rec, ErrClockSkew, "KERBEROS", now)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 got %d", resp.StatusCode)
+	}
+
+	err := ReadError(resp)
+	var krbErr *KRBError
+	if !errors.As(err, &krbErr) {
+		t.Fatalf("Expected a KRBError got %v", err)
+	}
+	if krbErr.Code != ErrCodeSkew || krbErr.Realm != "KERBEROS" || !krbErr.ServerTime.Equal(now) {
+		t.Errorf("Unexpected error %+v", krbErr)
+	}
+	if !errors.Is(err, ErrClockSkew) {
+		t.Error("Received error does not match ErrClockSkew")
+	}
+}
+
+func TestKRBErrorCodes(t *testing.T) {
+	seen := make(map[ErrorCode]bool)
+	for _, c := range errorCodes {
+		if seen[c.code] {
+			t.Errorf("Code %s is used by more than one error", c.code)
+		}
+		seen[c.code] = true
+
+		if got := NewError(fmt.Errorf("wrapped: %w", c.err), "KERBEROS", time.Now()); got.Code != c.code || got.Unwrap() != c.err {
+			t.Errorf("Expected %s for %v got %s", c.code, c.err, got.Code)
+		}
+	}
+
+	if got := NewError(MissingField("X-Service"), "KERBEROS", time.Now()); got.Code != ErrCodeGeneric || got.Status() != http.StatusBadRequest {
+		t.Errorf("Expected a generic error with status 400 got %s", got.Code)
+	}
+}
+
+func TestReadErrorWithoutKRBError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	http.Error(rec, "File not found", http.StatusNotFound)
+
+	err := ReadError(rec.Result())
+	var krbErr *KRBError
+	if errors.As(err, &krbErr) || !strings.Contains(err.Error(), "File not found") {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
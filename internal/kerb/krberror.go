@@ -0,0 +1,192 @@
+package kerb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrorContentType marks an HTTP response body as a KRBError.
+const ErrorContentType = "application/x-kerberos-error+json"
+
+// ErrorCode is an RFC 4120 error code.
+type ErrorCode int32
+
+// Error codes from RFC 4120 section 7.5.9. The AS never answers with
+// ErrCodeClientUnknown, so that usernames cannot be enumerated; an unknown
+// user looks like one who got their password wrong.
+const (
+	ErrCodeClientUnknown   ErrorCode = 6
+	ErrCodeServiceUnknown  ErrorCode = 7
+	ErrCodeCannotPostdate  ErrorCode = 10
+	ErrCodeNeverValid      ErrorCode = 11
+	ErrCodePolicy          ErrorCode = 12
+	ErrCodeBadOption       ErrorCode = 13
+	ErrCodeETypeNoSupport  ErrorCode = 14
+	ErrCodePreauthFailed   ErrorCode = 24
+	ErrCodePreauthRequired ErrorCode = 25
+	ErrCodePathNotAccepted ErrorCode = 28
+	ErrCodeUnavailable     ErrorCode = 29
+	ErrCodeBadIntegrity    ErrorCode = 31
+	ErrCodeTicketExpired   ErrorCode = 32
+	ErrCodeRepeat          ErrorCode = 34
+	ErrCodeBadMatch        ErrorCode = 36
+	ErrCodeSkew            ErrorCode = 37
+	ErrCodeModified        ErrorCode = 41
+	ErrCodeBadKeyVersion   ErrorCode = 44
+	ErrCodeGeneric         ErrorCode = 60
+	ErrCodeWrongRealm      ErrorCode = 68
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrCodeClientUnknown:   "KDC_ERR_C_PRINCIPAL_UNKNOWN",
+	ErrCodeServiceUnknown:  "KDC_ERR_S_PRINCIPAL_UNKNOWN",
+	ErrCodeCannotPostdate:  "KDC_ERR_CANNOT_POSTDATE",
+	ErrCodeNeverValid:      "KDC_ERR_NEVER_VALID",
+	ErrCodePolicy:          "KDC_ERR_POLICY",
+	ErrCodeBadOption:       "KDC_ERR_BADOPTION",
+	ErrCodeETypeNoSupport:  "KDC_ERR_ETYPE_NOSUPP",
+	ErrCodePreauthFailed:   "KDC_ERR_PREAUTH_FAILED",
+	ErrCodePreauthRequired: "KDC_ERR_PREAUTH_REQUIRED",
+	ErrCodePathNotAccepted: "KDC_ERR_PATH_NOT_ACCEPTED",
+	ErrCodeUnavailable:     "KDC_ERR_SVC_UNAVAILABLE",
+	ErrCodeBadIntegrity:    "KRB_AP_ERR_BAD_INTEGRITY",
+	ErrCodeTicketExpired:   "KRB_AP_ERR_TKT_EXPIRED",
+	ErrCodeRepeat:          "KRB_AP_ERR_REPEAT",
+	ErrCodeBadMatch:        "KRB_AP_ERR_BADMATCH",
+	ErrCodeSkew:            "KRB_AP_ERR_SKEW",
+	ErrCodeModified:        "KRB_AP_ERR_MODIFIED",
+	ErrCodeBadKeyVersion:   "KRB_AP_ERR_BADKEYVER",
+	ErrCodeGeneric:         "KRB_ERR_GENERIC",
+	ErrCodeWrongRealm:      "KDC_ERR_WRONG_REALM",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error code %d", int32(c))
+}
+
+// errorCodes pairs each error a server may send with its code. Every code
+// appears once, so that a client can map the code back to the same error.
+var errorCodes = []struct {
+	err  error
+	code ErrorCode
+}{
+	{ErrServiceUnknown, ErrCodeServiceUnknown},
+	{ErrCannotPostdate, ErrCodeCannotPostdate},
+	{ErrNeverValid, ErrCodeNeverValid},
+	{ErrPolicy, ErrCodePolicy},
+	{ErrNotRenewable, ErrCodeBadOption},
+	{ErrETypeNoSupport, ErrCodeETypeNoSupport},
+	{ErrPreauthFailed, ErrCodePreauthFailed},
+	{ErrPreauthRequired, ErrCodePreauthRequired},
+	{ErrNoTrust, ErrCodePathNotAccepted},
+	{ErrUnavailable, ErrCodeUnavailable},
+	{ErrBadIntegrity, ErrCodeBadIntegrity},
+	{ErrTicketExpired, ErrCodeTicketExpired},
+	{ErrReplay, ErrCodeRepeat},
+	{ErrPrincipalMismatch, ErrCodeBadMatch},
+	{ErrClockSkew, ErrCodeSkew},
+	{ErrBadChecksum, ErrCodeModified},
+	{ErrBadKeyVersion, ErrCodeBadKeyVersion},
+	{ErrWrongRealm, ErrCodeWrongRealm},
+}
+
+// KRBError is the error message servers send in place of a reply, modelled
+// on the RFC 4120 KRB-ERROR. ServerTime lets a client see how far its clock
+// is off when it is rejected for clock skew.
+type KRBError struct {
+	Code       ErrorCode
+	ServerTime time.Time
+	Realm      string
+	Text       string
+}
+
+// NewError returns the KRBError reporting err from realm at now. Errors
+// without a code of their own are sent as ErrCodeGeneric.
+func NewError(err error, realm string, now time.Time) *KRBError {
+	code := ErrCodeGeneric
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			code = c.code
+			break
+		}
+	}
+	return &KRBError{Code: code, ServerTime: now.UTC(), Realm: realm, Text: err.Error()}
+}
+
+func (e *KRBError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Text, e.Code)
+}
+
+// Unwrap returns the error corresponding to e's code, so that errors.Is
+// recognises a KRBError received from a server.
+func (e *KRBError) Unwrap() error {
+	for _, c := range errorCodes {
+		if c.code == e.Code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// Status returns the HTTP status code e is sent with.
+func (e *KRBError) Status() int {
+	switch e.Code {
+	case ErrCodeServiceUnknown, ErrCodeClientUnknown, ErrCodePathNotAccepted:
+		return http.StatusNotFound
+	case ErrCodePolicy:
+		return http.StatusForbidden
+	case ErrCodeUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrCodePreauthFailed, ErrCodePreauthRequired, ErrCodeBadIntegrity, ErrCodeTicketExpired, ErrCodeRepeat,
+		ErrCodeBadMatch, ErrCodeSkew, ErrCodeModified, ErrCodeBadKeyVersion:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// Write sends e as the response to an HTTP request.
+func (e *KRBError) Write(w http.ResponseWriter) {
+	body, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", ErrorContentType)
+	w.WriteHeader(e.Status())
+	w.Write(body)
+}
+
+// MissingField returns the error for a request without the named header.
+func MissingField(name string) error {
+	return fmt.Errorf("%w: missing %s", ErrBadRequest, name)
+}
+
+// WriteError sends err to the client as a KRBError from realm.
+func WriteError(w http.ResponseWriter, err error, realm string, now time.Time) {
+	NewError(err, realm, now).Write(w)
+}
+
+// ReadError returns the error carried by a failed HTTP response: a
+// *KRBError if the server sent one, or an error describing the status
+// otherwise.
+func ReadError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.Header.Get("Content-Type") == ErrorContentType {
+		var krbErr KRBError
+		if err := json.Unmarshal(body, &krbErr); err == nil {
+			return &krbErr
+		}
+	}
+
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return fmt.Errorf("HTTP request failed with status code %d %s", resp.StatusCode, msg)
+}
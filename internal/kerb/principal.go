@@ -0,0 +1,79 @@
+package kerb
+
+import (
+	"errors"
+	"strings"
+)
+
+// DefaultRealm is the realm a KDC serves unless configured otherwise.
+const DefaultRealm = "KERBEROS"
+
+// TGSName is the first component of every ticket-granting service principal.
+const TGSName = "krbtgt"
+
+var (
+	ErrBadPrincipal = errors.New("kerb: malformed principal name")
+	ErrWrongRealm   = errors.New("kerb: principal belongs to another realm")
+	ErrNoTrust      = errors.New("kerb: no trust path to realm")
+)
+
+// Principal names a user or service as name/instance@REALM. Users usually
+// have no instance, services use it for the host they run on.
+type Principal struct {
+	Name     string
+	Instance string
+	Realm    string
+}
+
+// ParsePrincipal reads a principal in name[/instance][@REALM] form. A
+// principal without a realm belongs to defaultRealm.
+func ParsePrincipal(s, defaultRealm string) (Principal, error) {
+	name, realm, found := strings.Cut(s, "@")
+	if !found {
+		realm = defaultRealm
+	}
+	name, instance, hasInstance := strings.Cut(name, "/")
+
+	p := Principal{Name: name, Instance: instance, Realm: realm}
+	if p.Name == "" || p.Realm == "" || (hasInstance && p.Instance == "") ||
+		strings.ContainsAny(p.Instance, "/") || strings.ContainsAny(p.Realm, "/@") {
+		return Principal{}, ErrBadPrincipal
+	}
+	return p, nil
+}
+
+// TGSPrincipal returns krbtgt/serviceRealm@issuingRealm. When both realms
+// are the same this is the realm's own ticket-granting service. Otherwise it
+// names the cross-realm key that issuingRealm's TGS uses to seal referral
+// tickets for serviceRealm's TGS, which both realms must hold.
+func TGSPrincipal(serviceRealm, issuingRealm string) Principal {
+	return Principal{Name: TGSName, Instance: serviceRealm, Realm: issuingRealm}
+}
+
+// NameString returns the principal without its realm. Users are stored in
+// the authentication database under this name.
+func (p Principal) NameString() string {
+	if p.Instance == "" {
+		return p.Name
+	}
+	return p.Name + "/" + p.Instance
+}
+
+func (p Principal) String() string {
+	return p.NameString() + "@" + p.Realm
+}
+
+// IsTGS reports whether p names a ticket-granting service, local or
+// cross-realm.
+func (p Principal) IsTGS() bool {
+	return p.Name == TGSName && p.Instance != ""
+}
+
+// QualifyPrincipal appends realm to name unless it already names one, so
+// that "fs/host1" and "fs/host1@KERBEROS" refer to the same principal.
+func QualifyPrincipal(name, realm string) string {
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return name + "@" + realm
+}
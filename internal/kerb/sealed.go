@@ -0,0 +1,54 @@
+package kerb
+
+import (
+	"encoding/json"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+)
+
+// SealedTicket is a ticket as it travels between client and servers. Only
+// Data is encrypted. Service names the principal whose key decrypts it, as
+// the cleartext sname of an RFC 4120 ticket does, so that a TGS holding
+// keys for several realms knows which one to use. Kvno and EType are the
+// version and encryption type of that key.
+type SealedTicket struct {
+	Service string
+	Kvno    int
+	EType   encryption.EType
+	Data    []byte
+}
+
+// ServiceKey is a version of a service's long-term key.
+type ServiceKey struct {
+	Kvno  int
+	EType encryption.EType
+	Key   []byte
+}
+
+// SealTicket encrypts ticket with the long-term key of service and encodes
+// it for the wire.
+func SealTicket(ticket Ticket, service string, key ServiceKey) ([]byte, error) {
+	data, err := encryption.EncryptWith(key.EType, key.Key, KeyUsageTicket, ticket)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(SealedTicket{Service: service, Kvno: key.Kvno, EType: key.EType, Data: data})
+}
+
+// OpenSealedTicket decodes a ticket received from the wire without
+// decrypting it.
+func OpenSealedTicket(b []byte) (SealedTicket, error) {
+	var sealed SealedTicket
+	if err := json.Unmarshal(b, &sealed); err != nil {
+		return SealedTicket{}, err
+	}
+	return sealed, nil
+}
+
+// Decrypt recovers the ticket using version s.Kvno of the long-term key of
+// s.Service.
+func (s SealedTicket) Decrypt(key []byte) (Ticket, error) {
+	var ticket Ticket
+	err := encryption.DecryptWith(s.EType, key, KeyUsageTicket, s.Data, &ticket)
+	return ticket, err
+}
@@ -0,0 +1,238 @@
+// Package keytab stores the long-term keys of service principals in a file,
+// so that a service can decrypt its tickets without access to the KDC's
+// database.
+//
+// A keytab file starts with the magic "KTAB" and a 16 bit version, followed
+// by any number of entries. All integers are big-endian. An entry is:
+//
+//	principal length (uint16), principal
+//	kvno (uint32)
+//	encryption type (int32)
+//	expiry in seconds since the epoch, 0 for never (int64)
+//	key length (uint16), key
+package keytab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+	"github.com/khaugen7/kerberos-go/internal/kerb"
+)
+
+const (
+	magic   = "KTAB"
+	version = 1
+)
+
+var ErrFormat = errors.New("keytab: not a keytab file")
+
+// Entry is one version of a principal's long-term key. Old versions carry
+// the time after which they no longer decrypt tickets.
+type Entry struct {
+	Principal string
+	Kvno      int
+	EType     encryption.EType
+	Key       []byte
+	Expires   time.Time
+}
+
+// ServiceKey returns e in the form used to seal and open tickets.
+func (e Entry) ServiceKey() kerb.ServiceKey {
+	return kerb.ServiceKey{Kvno: e.Kvno, EType: e.EType, Key: e.Key}
+}
+
+// Usable reports whether e may still decrypt tickets at now.
+func (e Entry) Usable(now time.Time) bool {
+	return e.Expires.IsZero() || now.Before(e.Expires)
+}
+
+// Keytab is the set of keys held in a keytab file.
+type Keytab struct {
+	Entries []Entry
+}
+
+// Load reads the keytab at path.
+func Load(path string) (*Keytab, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kt, err := Read(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return kt, nil
+}
+
+// Read decodes a keytab from r.
+func Read(r io.Reader) (*Keytab, error) {
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+	if v := binary.BigEndian.Uint16(header[len(magic):]); v != version {
+		return nil, fmt.Errorf("keytab: unsupported version %d", v)
+	}
+
+	kt := &Keytab{}
+	for {
+		e, err := readEntry(r)
+		if err == io.EOF {
+			return kt, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		kt.Entries = append(kt.Entries, e)
+	}
+}
+
+func readEntry(r io.Reader) (Entry, error) {
+	var e Entry
+
+	principal, err := readBytes(r)
+	if err != nil {
+		// A clean end of file may only fall between entries
+		return e, err
+	}
+	e.Principal = string(principal)
+
+	var fixed struct {
+		Kvno    uint32
+		EType   int32
+		Expires int64
+	}
+	if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return e, ErrFormat
+	}
+	e.Kvno = int(fixed.Kvno)
+	e.EType = encryption.EType(fixed.EType)
+	if fixed.Expires != 0 {
+		e.Expires = time.Unix(fixed.Expires, 0)
+	}
+
+	if e.Key, err = readBytes(r); err != nil {
+		return e, ErrFormat
+	}
+	return e, nil
+}
+
+// readBytes reads a length-prefixed field. It returns io.EOF only if r
+// ends before the field starts.
+func readBytes(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrFormat
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrFormat
+	}
+	return b, nil
+}
+
+// Write encodes kt to w.
+func (kt *Keytab) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(version))
+
+	for _, e := range kt.Entries {
+		if len(e.Principal) > math.MaxUint16 || len(e.Key) > math.MaxUint16 {
+			return fmt.Errorf("keytab: entry for %s is too large", e.Principal)
+		}
+		var expires int64
+		if !e.Expires.IsZero() {
+			expires = e.Expires.Unix()
+		}
+
+		binary.Write(&buf, binary.BigEndian, uint16(len(e.Principal)))
+		buf.WriteString(e.Principal)
+		binary.Write(&buf, binary.BigEndian, uint32(e.Kvno))
+		binary.Write(&buf, binary.BigEndian, int32(e.EType))
+		binary.Write(&buf, binary.BigEndian, expires)
+		binary.Write(&buf, binary.BigEndian, uint16(len(e.Key)))
+		buf.Write(e.Key)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Save writes kt to path, readable and writable by the owner only. The file
+// is replaced in one step so that a server reading it never sees half of it.
+func (kt *Keytab) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := kt.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Replace discards every key of principal held in kt and adds keys in
+// their place.
+func (kt *Keytab) Replace(principal string, keys []Entry) {
+	kept := make([]Entry, 0, len(kt.Entries)+len(keys))
+	for _, e := range kt.Entries {
+		if e.Principal != principal {
+			kept = append(kept, e)
+		}
+	}
+	for _, e := range keys {
+		e.Principal = principal
+		kept = append(kept, e)
+	}
+	kt.Entries = kept
+}
+
+// Keys returns every key of principal held in kt.
+func (kt *Keytab) Keys(principal string) []Entry {
+	keys := make([]Entry, 0)
+	for _, e := range kt.Entries {
+		if e.Principal == principal {
+			keys = append(keys, e)
+		}
+	}
+	return keys
+}
+
+// Principals returns the principals with keys in kt, in the order they
+// first appear.
+func (kt *Keytab) Principals() []string {
+	seen := make(map[string]bool)
+	principals := make([]string, 0)
+	for _, e := range kt.Entries {
+		if !seen[e.Principal] {
+			seen[e.Principal] = true
+			principals = append(principals, e.Principal)
+		}
+	}
+	return principals
+}
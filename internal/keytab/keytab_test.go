@@ -0,0 +1,107 @@
+package keytab
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/khaugen7/kerberos-go/internal/encryption"
+)
+
+var now = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func testKeytab() *Keytab {
+	return &Keytab{Entries: []Entry{
+		{Principal: "fs/localhost@KERBEROS", Kvno: 1, EType: encryption.ETypeAES256GCM, Key: bytes.Repeat([]byte{1}, 32), Expires: now},
+		{Principal: "fs/localhost@KERBEROS", Kvno: 2, EType: encryption.ETypeAES256CTSHMACSHA196, Key: bytes.Repeat([]byte{2}, 32)},
+		{Principal: "krbtgt/KERBEROS@KERBEROS", Kvno: 7, EType: encryption.ETypeChaCha20Poly1305, Key: bytes.Repeat([]byte{3}, 32)},
+	}}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kt")
+
+	kt := testKeytab()
+	if err := kt.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected keytab permissions 0600, got %o", perm)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Entries) != len(kt.Entries) {
+		t.Fatalf("Expected %d entries, got %d", len(kt.Entries), len(loaded.Entries))
+	}
+	for i, e := range loaded.Entries {
+		want := kt.Entries[i]
+		if e.Principal != want.Principal || e.Kvno != want.Kvno || e.EType != want.EType || !bytes.Equal(e.Key, want.Key) || !e.Expires.Equal(want.Expires) {
+			t.Errorf("Entry %d not restored: %+v", i, e)
+		}
+	}
+}
+
+func TestReadRejectsCorruptFiles(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testKeytab().Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	tests := map[string][]byte{
+		"empty":     {},
+		"bad magic": append([]byte("XTAB"), data[4:]...),
+		"truncated": data[:len(data)-1],
+	}
+	for name, input := range tests {
+		if _, err := Read(bytes.NewReader(input)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := Read(bytes.NewReader([]byte("KTAB\x00\x09"))); err == nil || errors.Is(err, ErrFormat) {
+		t.Errorf("Expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	kt := testKeytab()
+	kt.Replace("fs/localhost@KERBEROS", []Entry{{Kvno: 3, EType: encryption.ETypeAES256GCM, Key: []byte("new")}})
+
+	keys := kt.Keys("fs/localhost@KERBEROS")
+	if len(keys) != 1 || keys[0].Kvno != 3 || keys[0].Principal != "fs/localhost@KERBEROS" {
+		t.Errorf("Expected only kvno 3 after replacing, got %+v", keys)
+	}
+	if len(kt.Keys("krbtgt/KERBEROS@KERBEROS")) != 1 {
+		t.Error("Replacing one principal's keys removed another's")
+	}
+
+	principals := kt.Principals()
+	if len(principals) != 2 || principals[0] != "krbtgt/KERBEROS@KERBEROS" {
+		t.Errorf("Unexpected principals %v", principals)
+	}
+}
+
+func TestUsable(t *testing.T) {
+	kt := testKeytab()
+	if kt.Entries[0].Usable(now) {
+		t.Error("Key past its expiry should not be usable")
+	}
+	if !kt.Entries[0].Usable(now.Add(-time.Second)) {
+		t.Error("Key before its expiry should be usable")
+	}
+	if !kt.Entries[1].Usable(now.Add(time.Hour * 24 * 365)) {
+		t.Error("Key without expiry should always be usable")
+	}
+}
@@ -0,0 +1,90 @@
+package keytab
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// Reloader holds the keytab at a path for a server, loading it again only
+// when the file has been replaced or modified, or when Reload is called. It
+// is safe for concurrent use.
+type Reloader struct {
+	path string
+
+	mu   sync.Mutex
+	kt   *Keytab
+	info os.FileInfo
+}
+
+// NewReloader loads the keytab at path.
+func NewReloader(path string) (*Reloader, error) {
+	r := &Reloader{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Path returns the path of the keytab.
+func (r *Reloader) Path() string {
+	return r.path
+}
+
+// Keytab returns the keytab, loading it again first if the file has changed
+// since it was last loaded. Keytabs returned must not be modified.
+func (r *Reloader) Keytab() (*Keytab, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if !os.SameFile(info, r.info) || !info.ModTime().Equal(r.info.ModTime()) || info.Size() != r.info.Size() {
+		if err := r.load(info); err != nil {
+			return nil, err
+		}
+	}
+	return r.kt, nil
+}
+
+// Reload loads the keytab again whether or not the file has changed. If it
+// fails the keytab loaded before is kept until the file changes.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	return r.load(info)
+}
+
+// ReloadOnSignal calls Reload whenever one of sig is received, for file
+// systems that do not show a change in the keytab's modification time.
+// Failures are logged and the keytab loaded before is kept.
+func (r *Reloader) ReloadOnSignal(sig ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+	go func() {
+		for range c {
+			if err := r.Reload(); err != nil {
+				log.Print("Unable to reload keytab: ", err)
+			} else {
+				log.Printf("Reloaded keytab %s", r.path)
+			}
+		}
+	}()
+}
+
+func (r *Reloader) load(info os.FileInfo) error {
+	kt, err := Load(r.path)
+	if err != nil {
+		return err
+	}
+	r.kt, r.info = kt, info
+	return nil
+}
@@ -0,0 +1,97 @@
+package keytab
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloaderLoadsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kt")
+	if _, err := NewReloader(path); err == nil {
+		t.Error("Expected a missing keytab to be refused")
+	}
+
+	kt := testKeytab()
+	if err := kt.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := r.Keytab()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := r.Keytab(); again != first {
+		t.Error("Keytab loaded again although the file has not changed")
+	}
+
+	kt.Replace("kadmin/admin@KERBEROS", []Entry{{Kvno: 1, EType: kt.Entries[0].EType, Key: kt.Entries[0].Key}})
+	if err := kt.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := r.Keytab()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed.Keys("kadmin/admin@KERBEROS")) != 1 {
+		t.Error("Keytab not loaded again after the file was replaced")
+	}
+
+	if err := os.WriteFile(path, []byte("not a keytab"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Keytab(); err == nil {
+		t.Error("Expected a corrupt keytab to be refused")
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("Expected reloading a corrupt keytab to fail")
+	}
+
+	if err := testKeytab().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, _ := r.Keytab(); len(reloaded.Keys("kadmin/admin@KERBEROS")) != 0 {
+		t.Error("Reload did not load the keytab again")
+	}
+}
+
+func TestReloaderReloadsOnSignal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kt")
+	kt := testKeytab()
+	if err := kt.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ReloadOnSignal(syscall.SIGUSR1)
+
+	kt.Replace("kadmin/admin@KERBEROS", []Entry{{Kvno: 1, EType: kt.Entries[0].EType, Key: kt.Entries[0].Key}})
+	if err := kt.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Look at the loaded keytab directly, since Keytab would notice the
+	// change by itself
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		reloaded := len(r.kt.Keys("kadmin/admin@KERBEROS")) == 1
+		r.mu.Unlock()
+		if reloaded {
+			return
+		}
+	}
+	t.Error("Keytab not loaded again after the signal")
+}
@@ -0,0 +1,270 @@
+// Package replay implements a replay cache for Kerberos authenticators.
+//
+// Servers record every authenticator they accept and reject any request
+// that presents the same authenticator a second time before it expires.
+package replay
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxEntries bounds the number of authenticators held in memory.
+const DefaultMaxEntries = 100000
+
+var ErrReplay = errors.New("replay: authenticator has already been used")
+
+// ErrFull is returned when the cache holds maxEntries authenticators that
+// have not expired. Forgetting one of them would let it be replayed, so new
+// authenticators are refused until some expire.
+var ErrFull = errors.New("replay: cache is full")
+
+type entry struct {
+	key     string
+	expires time.Time
+}
+
+// expiryHeap orders entries so the first to expire is always on top.
+type expiryHeap []entry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(entry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Cache remembers authenticators until they expire. When the cache is full
+// of live entries it refuses new ones rather than forget any. A Cache is safe
+// for concurrent use.
+type Cache struct {
+	mu         sync.Mutex
+	entries    map[string]time.Time
+	expiry     expiryHeap
+	maxEntries int
+	path       string
+	file       *os.File
+	now        func() time.Time
+}
+
+// NewCache returns an in-memory cache holding at most maxEntries
+// authenticators. A non-positive maxEntries uses DefaultMaxEntries.
+func NewCache(maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Cache{
+		entries:    make(map[string]time.Time),
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}
+}
+
+// OpenFileCache returns a cache backed by the file at path so that recorded
+// authenticators survive a server restart. Expired entries found in the file
+// are discarded and the file is compacted.
+func OpenFileCache(path string, maxEntries int) (*Cache, error) {
+	c := NewCache(maxEntries)
+	c.path = path
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if err := c.rewrite(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Open returns a file-backed cache when path is set and an in-memory cache
+// otherwise.
+func Open(path string, maxEntries int) (*Cache, error) {
+	if path == "" {
+		return NewCache(maxEntries), nil
+	}
+	return OpenFileCache(path, maxEntries)
+}
+
+// Key identifies an authenticator by the principal that sent it, its
+// timestamp and a hash of its encrypted bytes.
+func Key(principal string, timestamp time.Time, authenticator []byte) string {
+	return fmt.Sprintf("%s:%d:%x", principal, timestamp.UnixNano(), sha256.Sum256(authenticator))
+}
+
+// Check records the authenticator and returns ErrReplay if it has already
+// been seen, or ErrFull if there is no room for it. The entry is kept until
+// expires.
+func (c *Cache) Check(principal string, timestamp time.Time, authenticator []byte, expires time.Time) error {
+	key := Key(principal, timestamp, authenticator)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if exp, ok := c.entries[key]; ok && now.Before(exp) {
+		return ErrReplay
+	}
+
+	if len(c.entries) >= c.maxEntries {
+		c.sweep(now)
+	}
+	if len(c.entries) >= c.maxEntries {
+		return ErrFull
+	}
+
+	c.entries[key] = expires
+	heap.Push(&c.expiry, entry{key, expires})
+
+	if c.file != nil {
+		if _, err := fmt.Fprintf(c.file, "%d %s\n", expires.UnixNano(), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of authenticators currently held.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Sweep removes expired entries and returns how many were removed.
+func (c *Cache) Sweep() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := c.sweep(c.now())
+	if removed > 0 && c.file != nil {
+		return removed, c.rewrite()
+	}
+	return removed, nil
+}
+
+// StartSweeper runs Sweep every interval until the returned stop function
+// is called.
+func (c *Cache) StartSweeper(interval time.Duration, onError func(error)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := c.Sweep(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Close releases the backing file, if any.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+func (c *Cache) sweep(now time.Time) int {
+	removed := 0
+	for c.expiry.Len() > 0 && !now.Before(c.expiry[0].expires) {
+		e := heap.Pop(&c.expiry).(entry)
+		if exp, ok := c.entries[e.key]; ok && exp.Equal(e.expires) {
+			delete(c.entries, e.key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *Cache) load() error {
+	file, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := c.now()
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 || fields[1] == "" {
+			return fmt.Errorf("replay: %s line %d: expected EXPIRY KEY", c.path, number)
+		}
+		nanos, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("replay: %s line %d: invalid expiry: %w", c.path, number, err)
+		}
+		expires := time.Unix(0, nanos)
+		if !now.Before(expires) {
+			continue
+		}
+		c.entries[fields[1]] = expires
+		heap.Push(&c.expiry, entry{fields[1], expires})
+	}
+	// A file from a larger cache is kept whole, and new authenticators
+	// refused until enough of it expires
+	return scanner.Err()
+}
+
+// rewrite replaces the backing file with the current contents of the cache
+// and reopens it for appending.
+func (c *Cache) rewrite() error {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for key, expires := range c.entries {
+		fmt.Fprintf(w, "%d %s\n", expires.UnixNano(), key)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.file, err = os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
@@ -0,0 +1,125 @@
+package replay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func fixedClock(c *Cache, t *time.Time) {
+	c.now = func() time.Time { return *t }
+}
+
+func TestCheckRejectsReplay(t *testing.T) {
+	now := start
+	c := NewCache(10)
+	fixedClock(c, &now)
+
+	auth := []byte("encrypted authenticator")
+	if err := c.Check("jdoe42", start, auth, start.Add(time.Minute)); err != nil {
+		t.Fatalf("first use returned %v", err)
+	}
+	if err := c.Check("jdoe42", start, auth, start.Add(time.Minute)); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected ErrReplay on second use, got %v", err)
+	}
+	if err := c.Check("jdoe42", start, []byte("another authenticator"), start.Add(time.Minute)); err != nil {
+		t.Errorf("Different authenticator rejected: %v", err)
+	}
+	if err := c.Check("asmith", start, auth, start.Add(time.Minute)); err != nil {
+		t.Errorf("Different principal rejected: %v", err)
+	}
+}
+
+func TestSweepRemovesExpired(t *testing.T) {
+	now := start
+	c := NewCache(10)
+	fixedClock(c, &now)
+
+	c.Check("a", start, []byte("1"), start.Add(time.Minute))
+	c.Check("b", start, []byte("2"), start.Add(time.Hour))
+
+	now = start.Add(2 * time.Minute)
+	if removed, _ := c.Sweep(); removed != 1 {
+		t.Errorf("Expected 1 entry swept, got %d", removed)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Expected 1 entry remaining, got %d", c.Len())
+	}
+	if err := c.Check("a", start, []byte("1"), start.Add(time.Minute)); err != nil {
+		t.Errorf("Expired entry still rejected: %v", err)
+	}
+}
+
+func TestFullCacheFailsClosed(t *testing.T) {
+	now := start
+	c := NewCache(3)
+	fixedClock(c, &now)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Check("user", start.Add(time.Duration(i)), []byte("auth"), start.Add(time.Duration(i+1)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Flooding the cache must not push out a live authenticator
+	for i := 3; i < 10; i++ {
+		if err := c.Check("user", start.Add(time.Duration(i)), []byte("auth"), start.Add(time.Hour)); !errors.Is(err, ErrFull) {
+			t.Errorf("Expected ErrFull for entry %d, got %v", i, err)
+		}
+	}
+	if c.Len() != 3 {
+		t.Errorf("Expected cache to hold 3 entries, got %d", c.Len())
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Check("user", start.Add(time.Duration(i)), []byte("auth"), start.Add(time.Hour)); !errors.Is(err, ErrReplay) {
+			t.Errorf("Live entry %d was forgotten: %v", i, err)
+		}
+	}
+
+	// Once an entry expires there is room again
+	now = start.Add(90 * time.Second)
+	if err := c.Check("user", start.Add(10), []byte("auth"), start.Add(time.Hour)); err != nil {
+		t.Errorf("Expected room after an entry expired, got %v", err)
+	}
+}
+
+func TestFileCacheSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rcache")
+	ts := time.Now()
+
+	c, err := OpenFileCache(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Check("jdoe42", ts, []byte("auth"), ts.Add(time.Hour))
+	c.Check("asmith", ts, []byte("auth"), ts.Add(-time.Minute))
+	c.Close()
+
+	reopened, err := OpenFileCache(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.Len() != 1 {
+		t.Errorf("Expected expired entry to be dropped on reopen, got %d entries", reopened.Len())
+	}
+	if err := reopened.Check("jdoe42", ts, []byte("auth"), ts.Add(time.Hour)); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected ErrReplay after reopening, got %v", err)
+	}
+}
+
+func TestLoadRejectsMalformedFile(t *testing.T) {
+	for _, content := range []string{"not-a-number key\n", "12345\n", "12345 \n"} {
+		path := filepath.Join(t.TempDir(), "rcache")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenFileCache(path, 10); err == nil {
+			t.Errorf("Expected an error loading %q", content)
+		}
+	}
+}
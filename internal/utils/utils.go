@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -29,6 +30,34 @@ func Credentials() (string, string, error) {
 	return strings.TrimSpace(username), password, nil
 }
 
+// Password prompts for a password without echoing it.
+func Password(prompt string) (string, error) {
+	fmt.Print(prompt)
+	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return string(bytePassword), nil
+}
+
+// NewPassword prompts for a new password twice and fails unless both
+// entries match.
+func NewPassword(prompt string) (string, error) {
+	password, err := Password(prompt)
+	if err != nil {
+		return "", err
+	}
+	confirm, err := Password("Confirm " + strings.ToLower(prompt[:1]) + prompt[1:])
+	if err != nil {
+		return "", err
+	}
+	if password != confirm {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
 func FileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {